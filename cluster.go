@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/stratosphereips/p2p4slips/peer"
+	"github.com/stratosphereips/p2p4slips/utils"
+)
+
+// how long child processes get to say goodbye to their peers before they are killed
+const clusterStopTimeout = 15 * time.Second
+
+// run several pigeons on this machine, until a termination signal stops all of them
+// usage: p2p4slips cluster [flags] [-- pigeon flags]
+func runCluster(args []string) int {
+	fs := flag.NewFlagSet("cluster", flag.ExitOnError)
+	nodes := fs.Int("nodes", 3, "Number of pigeons")
+	basePort := fs.Int("base-port", 4001, "Port of the first pigeon, the others use the following ports")
+	dir := fs.String("dir", "cluster", "Directory for the key and peerstore files of the pigeons")
+	inProcess := fs.Bool("in-process", false, "Run the pigeons in this process instead of as child processes. "+
+		"Their logs are then not prefixed with the node name")
+	fs.Usage = func() {
+		fmt.Println("Usage: ./p2p4slips cluster [flags] [-- pigeon flags]")
+		fmt.Println("Run several pigeons, each with its own port, key file, peerstore file, Redis channels and " +
+			"Redis keys (the port is appended to file names, channel names and key names). The pigeons listen on 127.0.0.1. The pigeon " +
+			"flags are passed to every pigeon, and override the settings of the cluster")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+
+	if *nodes < 1 || *basePort < 1 || *basePort+*nodes-1 > 65535 {
+		fmt.Println("[CLUSTER] Invalid number of nodes or base port")
+		return 2
+	}
+	if err := os.MkdirAll(*dir, 0700); err != nil {
+		fmt.Println("[CLUSTER] Creating directory failed -", err)
+		return 1
+	}
+
+	// the arguments of each pigeon. Pigeon flags come last, so they can override the defaults of the cluster
+	nodeArgs := make([][]string, *nodes)
+	for i := range nodeArgs {
+		nodeArgs[i] = append([]string{
+			"-host", "127.0.0.1",
+			"-port", strconv.Itoa(*basePort + i),
+			"-key-file", filepath.Join(*dir, "key"),
+			"-peerstore-file", filepath.Join(*dir, "peerstore"),
+			"-rename-with-port",
+		}, fs.Args()...)
+	}
+
+	// the nodes share one redis, they are only kept apart by the port in their channels and keys
+	nodeFs := flag.NewFlagSet("pigeon", flag.ContinueOnError)
+	nodeCfg := utils.RegisterFlags(nodeFs)
+	if err := nodeFs.Parse(nodeArgs[0]); err != nil {
+		return 2
+	}
+	if !nodeCfg.RenameWithPort {
+		fmt.Println("[CLUSTER] The pigeons need -rename-with-port, otherwise they overwrite each other's " +
+			"files, Redis channels and keys")
+		return 2
+	}
+
+	if *inProcess {
+		return runClusterInProcess(nodeArgs)
+	}
+	return runClusterProcesses(nodeArgs)
+}
+
+func runClusterInProcess(nodeArgs [][]string) int {
+	var peers []*peer.Peer
+	stop := func() {
+		var wg sync.WaitGroup
+		for _, p := range peers {
+			wg.Add(1)
+			go func(p *peer.Peer) {
+				defer wg.Done()
+				p.Close()
+			}(p)
+		}
+		wg.Wait()
+	}
+
+	for i, args := range nodeArgs {
+		fs := flag.NewFlagSet(fmt.Sprintf("node%d", i), flag.ContinueOnError)
+		cfg := utils.RegisterFlags(fs)
+		if err := fs.Parse(args); err != nil {
+			stop()
+			return 2
+		}
+		renameFilesAndChannels(cfg)
+
+		fmt.Printf("[CLUSTER] Starting node%d on TCP port %d\n", i, cfg.ListenPort)
+		p, err := startPigeon(cfg)
+		if err != nil {
+			fmt.Printf("[CLUSTER] Starting node%d failed - %s\n", i, err)
+			stop()
+			return 1
+		}
+		peers = append(peers, p)
+	}
+
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM)
+	<-ch
+	fmt.Printf("\n[CLUSTER] Received signal, shutting down %d nodes...\n", len(peers))
+	stop()
+	return 0
+}
+
+func runClusterProcesses(nodeArgs [][]string) int {
+	executable, err := os.Executable()
+	if err != nil {
+		fmt.Println("[CLUSTER] Finding the pigeon executable failed -", err)
+		return 1
+	}
+
+	// a signal that comes while the nodes are starting is handled once they run
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM)
+
+	// lines from all nodes go through one writer, so they don't get mixed up
+	var logMutex sync.Mutex
+	exited := make(chan int, len(nodeArgs))
+	var children []*exec.Cmd
+	// nodes that haven't exited yet, only the main loop updates it
+	alive := map[int]bool{}
+
+	for i, args := range nodeArgs {
+		name := fmt.Sprintf("node%d", i)
+		cmd := exec.Command(executable, args...)
+		stdout, err := cmd.StdoutPipe()
+		if err == nil {
+			cmd.Stderr = cmd.Stdout
+			err = cmd.Start()
+		}
+		if err != nil {
+			fmt.Printf("[CLUSTER] Starting %s failed - %s\n", name, err)
+			stopChildren(children, alive, exited)
+			return 1
+		}
+		fmt.Printf("[CLUSTER] Started %s (pid %d) with %v\n", name, cmd.Process.Pid, args)
+		children = append(children, cmd)
+		alive[i] = true
+
+		go func(i int, name string, cmd *exec.Cmd, stdout io.Reader) {
+			scanner := bufio.NewScanner(stdout)
+			for scanner.Scan() {
+				logMutex.Lock()
+				fmt.Printf("[%s] %s\n", name, scanner.Text())
+				logMutex.Unlock()
+			}
+			err := cmd.Wait()
+			logMutex.Lock()
+			fmt.Printf("[CLUSTER] %s exited - %v\n", name, err)
+			logMutex.Unlock()
+			exited <- i
+		}(i, name, cmd, stdout)
+	}
+
+	// keep running until a signal comes, or until all nodes are gone
+	for len(alive) > 0 {
+		select {
+		case <-ch:
+			fmt.Printf("\n[CLUSTER] Received signal, shutting down %d nodes...\n", len(alive))
+			stopChildren(children, alive, exited)
+			return 0
+		case i := <-exited:
+			delete(alive, i)
+		}
+	}
+	fmt.Println("[CLUSTER] All nodes exited")
+	return 1
+}
+
+// ask all running children to shut down, and kill the ones that don't manage it in time
+func stopChildren(children []*exec.Cmd, alive map[int]bool, exited chan int) {
+	for i := range alive {
+		_ = children[i].Process.Signal(syscall.SIGTERM)
+	}
+
+	timeout := time.After(clusterStopTimeout)
+	for len(alive) > 0 {
+		select {
+		case i := <-exited:
+			delete(alive, i)
+		case <-timeout:
+			fmt.Println("[CLUSTER] Nodes didn't stop in time, killing them")
+			for i := range alive {
+				_ = children[i].Process.Kill()
+			}
+			return
+		}
+	}
+}
@@ -0,0 +1,161 @@
+// slips-mock plays the role of Slips for testing the pigeon without a Slips installation. It publishes messages from
+// a scenario file to the channel the pigeon listens on, records everything the pigeon publishes, and checks the
+// recording against the expectations of the scenario. Any Redis compatible server can be used.
+//
+// usage: slips-mock [flags] <scenario file>
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+	"github.com/stratosphereips/p2p4slips/schema"
+)
+
+func main() {
+	redisAddress := flag.String("redis-db", "localhost:6379", "Redis database shared with the pigeon")
+	channelPyGo := flag.String("redis-channel-pygo", "p2p_pygo", "Channel the pigeon listens on")
+	channelGoPy := flag.String("redis-channel-gopy", "p2p_gopy", "Channel the pigeon publishes to")
+	recordFile := flag.String("record", "", "File where all recorded messages are written, one per line")
+	flag.Usage = func() {
+		fmt.Println("Usage: slips-mock [flags] <scenario file>")
+		fmt.Println("Publish messages from the scenario to the pigeon and check what it sends back")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	scenario, err := readScenario(flag.Arg(0))
+	if err != nil {
+		fmt.Println("[SLIPS MOCK] Reading scenario failed -", err)
+		os.Exit(2)
+	}
+
+	client := redis.NewClient(&redis.Options{Addr: *redisAddress})
+	defer client.Close()
+	if err = client.Ping().Err(); err != nil {
+		fmt.Println("[SLIPS MOCK] Database connection failed -", err)
+		os.Exit(1)
+	}
+
+	rec, err := startRecording(client, *channelGoPy)
+	if err != nil {
+		fmt.Println("[SLIPS MOCK] Subscribing failed -", err)
+		os.Exit(1)
+	}
+
+	for i, step := range scenario.Steps {
+		time.Sleep(time.Duration(step.Delay))
+		message, err := step.message()
+		if err != nil {
+			fmt.Printf("[SLIPS MOCK] Step %d is invalid - %s\n", i+1, err)
+			os.Exit(2)
+		}
+		if err = client.Publish(*channelPyGo, message).Err(); err != nil {
+			fmt.Printf("[SLIPS MOCK] Publishing step %d failed - %s\n", i+1, err)
+			os.Exit(1)
+		}
+		fmt.Printf("[SLIPS MOCK] Published step %d\n", i+1)
+	}
+
+	time.Sleep(time.Duration(scenario.RecordFor))
+	messages := rec.stop()
+	fmt.Printf("[SLIPS MOCK] Recorded %d messages\n", len(messages))
+
+	if *recordFile != "" {
+		if err = writeRecording(*recordFile, messages); err != nil {
+			fmt.Println("[SLIPS MOCK] Writing recording failed -", err)
+		}
+	}
+
+	if !check(scenario, messages) {
+		os.Exit(1)
+	}
+}
+
+type recorder struct {
+	pubsub   *redis.PubSub
+	mutex    sync.Mutex
+	messages []string
+	done     chan struct{}
+}
+
+func startRecording(client *redis.Client, channel string) (*recorder, error) {
+	pubsub := client.Subscribe(channel)
+	// wait for the subscription, so no message of the pigeon is missed
+	if _, err := pubsub.Receive(); err != nil {
+		return nil, err
+	}
+
+	r := &recorder{pubsub: pubsub, done: make(chan struct{})}
+	go func() {
+		defer close(r.done)
+		for msg := range pubsub.Channel() {
+			r.mutex.Lock()
+			r.messages = append(r.messages, msg.Payload)
+			r.mutex.Unlock()
+		}
+	}()
+	return r, nil
+}
+
+func (r *recorder) stop() []string {
+	_ = r.pubsub.Close()
+	<-r.done
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.messages
+}
+
+func writeRecording(file string, messages []string) error {
+	out, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	for _, message := range messages {
+		if _, err = fmt.Fprintln(out, message); err != nil {
+			out.Close()
+			return err
+		}
+	}
+	return out.Close()
+}
+
+// check that all recorded messages match their schema and that the expectations are met
+// return bool: true if everything passed
+func check(scenario *Scenario, messages []string) bool {
+	passed := true
+	var parsed []recorded
+
+	for _, message := range messages {
+		r := recorded{}
+		if err := json.Unmarshal([]byte(message), &r); err != nil {
+			fmt.Printf("[SLIPS MOCK] FAIL message is not valid JSON: %s\n", message)
+			passed = false
+			continue
+		}
+		if err := schema.Validate(r.MessageType, []byte(message)); err != nil {
+			fmt.Printf("[SLIPS MOCK] FAIL %s message doesn't match the schema - %s\n", r.MessageType, err)
+			passed = false
+		}
+		parsed = append(parsed, r)
+	}
+
+	for i, expectation := range scenario.Expect {
+		if err := expectation.check(parsed); err != nil {
+			fmt.Printf("[SLIPS MOCK] FAIL expectation %d - %s\n", i+1, err)
+			passed = false
+		} else {
+			fmt.Printf("[SLIPS MOCK] PASS expectation %d\n", i+1)
+		}
+	}
+	return passed
+}
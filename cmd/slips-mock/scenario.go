@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"time"
+
+	"github.com/stratosphereips/p2p4slips/schema"
+)
+
+// Scenario is read from a JSON file. Steps are published to the pigeon in order, then everything the pigeon sends
+// is recorded for a while and compared with the expectations.
+type Scenario struct {
+	Steps []Step `json:"steps"`
+	// how long to keep recording after the last step
+	RecordFor Duration      `json:"record_for"`
+	Expect    []Expectation `json:"expect"`
+}
+
+// Step publishes a scroll, or a raw string (such as stop_process, or a deliberately invalid message)
+type Step struct {
+	// wait before publishing
+	Delay  Duration             `json:"delay"`
+	Scroll *schema.PigeonScroll `json:"scroll"`
+	Raw    *string              `json:"raw"`
+}
+
+// Expectation about the messages the pigeon sent. A message matches if it has the type and its contents include all
+// fields of Match (nested objects are compared the same way). The number of matching messages must be between Min
+// and Max, a missing Max means no limit.
+type Expectation struct {
+	MessageType string                 `json:"message_type"`
+	Match       map[string]interface{} `json:"match"`
+	Min         int                    `json:"min"`
+	Max         *int                   `json:"max"`
+}
+
+// Duration is a time.Duration written as a string, such as "1.5s"
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var text string
+	if err := json.Unmarshal(data, &text); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(text)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+func readScenario(file string) (*Scenario, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	scenario := &Scenario{}
+	if err = json.Unmarshal(data, scenario); err != nil {
+		return nil, err
+	}
+
+	for i, step := range scenario.Steps {
+		if (step.Scroll == nil) == (step.Raw == nil) {
+			return nil, fmt.Errorf("step %d must have either a scroll or a raw message", i+1)
+		}
+	}
+	for i, expectation := range scenario.Expect {
+		if expectation.MessageType == "" {
+			return nil, fmt.Errorf("expectation %d has no message type", i+1)
+		}
+		if expectation.Max != nil && *expectation.Max < expectation.Min {
+			return nil, fmt.Errorf("expectation %d has max lower than min", i+1)
+		}
+	}
+	return scenario, nil
+}
+
+// the message to publish for the step
+func (s *Step) message() (string, error) {
+	if s.Raw != nil {
+		return *s.Raw, nil
+	}
+	if s.Scroll.SchemaVersion == 0 {
+		s.Scroll.SchemaVersion = schema.Version
+	}
+	data, err := json.Marshal(s.Scroll)
+	if err != nil {
+		return "", err
+	}
+	if err = schema.Validate(schema.PigeonScrollType, data); err != nil {
+		return "", errors.New("scroll doesn't match the schema (use a raw step to send invalid messages) - " +
+			err.Error())
+	}
+	return string(data), nil
+}
+
+// recorded is a message the pigeon sent
+type recorded struct {
+	MessageType     string                 `json:"message_type"`
+	MessageContents map[string]interface{} `json:"message_contents"`
+}
+
+// check the expectation against the recorded messages
+// return error: nil if it is met
+func (e *Expectation) check(messages []recorded) error {
+	count := 0
+	for _, message := range messages {
+		if message.MessageType == e.MessageType && includes(message.MessageContents, e.Match) {
+			count++
+		}
+	}
+
+	if count < e.Min || (e.Max != nil && count > *e.Max) {
+		limit := "no limit"
+		if e.Max != nil {
+			limit = fmt.Sprint(*e.Max)
+		}
+		return fmt.Errorf("expected %d to %s matching %s messages, got %d", e.Min, limit, e.MessageType, count)
+	}
+	return nil
+}
+
+// check that all fields of the pattern are in the object with equal values
+func includes(object map[string]interface{}, pattern map[string]interface{}) bool {
+	for key, expected := range pattern {
+		actual, ok := object[key]
+		if !ok {
+			return false
+		}
+		expectedObject, isObject := expected.(map[string]interface{})
+		actualObject, bothObjects := actual.(map[string]interface{})
+		if isObject && bothObjects {
+			if !includes(actualObject, expectedObject) {
+				return false
+			}
+			continue
+		}
+		if !reflect.DeepEqual(actual, expected) {
+			return false
+		}
+	}
+	return true
+}
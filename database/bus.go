@@ -0,0 +1,89 @@
+package database
+
+import (
+	"sync"
+)
+
+// Bus carries messages between the pigeon and Slips. DBWrapper implements it with Redis, MemoryBus keeps everything
+// in memory, so several pigeons can run in one process.
+type Bus interface {
+	// SendStringToChannel publishes a message for Slips
+	SendStringToChannel(message string)
+	// SaveMultiAddresses stores the addresses this node listens on, where Slips can read them. The preferred address
+	// comes first.
+	SaveMultiAddresses(multiAddresses []string)
+	// SaveIdentity stores the latest identity message of this node, where Slips can read it
+	SaveIdentity(identity string)
+	// Commands returns the channel with messages from Slips. It should only be used by one reader.
+	Commands() <-chan string
+}
+
+// MemoryBus is a Bus without Redis. The Slips side of it is driven by Publish, and everything the pigeon sent is
+// kept, so it can be inspected with Published.
+type MemoryBus struct {
+	commands       chan string
+	mutex          sync.Mutex
+	published      []string
+	multiAddresses []string
+	identity       string
+	closeOnce      sync.Once
+}
+
+func NewMemoryBus() *MemoryBus {
+	return &MemoryBus{commands: make(chan string, 64)}
+}
+
+func (b *MemoryBus) SendStringToChannel(message string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.published = append(b.published, message)
+}
+
+func (b *MemoryBus) SaveMultiAddresses(multiAddresses []string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.multiAddresses = append([]string{}, multiAddresses...)
+}
+
+func (b *MemoryBus) SaveIdentity(identity string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.identity = identity
+}
+
+func (b *MemoryBus) Commands() <-chan string {
+	return b.commands
+}
+
+// Publish sends a message to the pigeon, as Slips would
+func (b *MemoryBus) Publish(command string) {
+	b.commands <- command
+}
+
+// Published returns a copy of all messages the pigeon sent to Slips, oldest first
+func (b *MemoryBus) Published() []string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return append([]string{}, b.published...)
+}
+
+// MultiAddresses returns the last addresses saved by the pigeon
+func (b *MemoryBus) MultiAddresses() []string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return append([]string{}, b.multiAddresses...)
+}
+
+// Identity returns the last identity message saved by the pigeon
+func (b *MemoryBus) Identity() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.identity
+}
+
+// Close stops the reader of Commands
+func (b *MemoryBus) Close() {
+	b.closeOnce.Do(func() {
+		close(b.commands)
+	})
+}
@@ -1,18 +1,18 @@
 package database
 
 import (
+	"encoding/json"
 	"fmt"
 
 	"github.com/go-redis/redis/v7"
 )
 
-var DBW *DBWrapper
-
 type DBWrapper struct {
 	DbAddress string
 	Rdb       *redis.Client
 	RdbGoPy   string
 	RdbPyGo   string
+	KeySuffix string                // appended to the keys, so pigeons sharing one redis don't overwrite each other
 	Ch        <-chan *redis.Message // this channel is only to be used by the slipsListener
 }
 
@@ -39,12 +39,23 @@ func (dw *DBWrapper) InitDB() bool {
 	return true
 }
 
-func (dw *DBWrapper) SaveMultiAddress(multiAddress string) {
+func (dw *DBWrapper) SaveMultiAddresses(multiAddresses []string) {
 	// expiration 0 means the key won't expire
 
-	//fmt.Printf("[db] setting multiaddr to -  %s \n", multiAddress)
-	dw.Rdb.Set("multiAddress", multiAddress, 0)
+	// multiAddress keeps holding a single address, for readers that expect one
+	if len(multiAddresses) > 0 {
+		dw.Rdb.Set("multiAddress"+dw.KeySuffix, multiAddresses[0], 0)
+	}
+	data, err := json.Marshal(multiAddresses)
+	if err != nil {
+		fmt.Println("[db] Encoding addresses failed -", err)
+		return
+	}
+	dw.Rdb.Set("multiAddresses"+dw.KeySuffix, string(data), 0)
+}
 
+func (dw *DBWrapper) SaveIdentity(identity string) {
+	dw.Rdb.Set("identity"+dw.KeySuffix, identity, 0)
 }
 
 func (dw *DBWrapper) SendStringToChannel(message string) {
@@ -54,6 +65,18 @@ func (dw *DBWrapper) SendStringToChannel(message string) {
 	dw.Rdb.Publish(dw.RdbGoPy, message)
 }
 
+// Commands passes payloads of messages from the subscribed channel
+func (dw *DBWrapper) Commands() <-chan string {
+	commands := make(chan string)
+	go func() {
+		for msg := range dw.Ch {
+			commands <- msg.Payload
+		}
+		close(commands)
+	}()
+	return commands
+}
+
 func (dw *DBWrapper) subscribeToPyGo() bool {
 	// taken from https://godoc.org/github.com/go-redis/redis#example-PubSub-Receive
 	pubsub := dw.Rdb.Subscribe(dw.RdbPyGo)
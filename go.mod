@@ -4,7 +4,11 @@ go 1.16
 
 require (
 	github.com/go-redis/redis/v7 v7.4.0
+	github.com/golang/snappy v0.0.4
 	github.com/libp2p/go-libp2p v0.13.0
 	github.com/libp2p/go-libp2p-core v0.8.5
 	github.com/multiformats/go-multiaddr v0.3.1
+	github.com/xeipuuv/gojsonschema v1.2.0
+	go.etcd.io/bbolt v1.3.6
+	golang.org/x/crypto v0.0.0-20200423211502-4bdfaf469ed5
 )
@@ -0,0 +1,229 @@
+// Package harness runs several pigeons in one process, connected over loopback. Each node talks to its own in-memory
+// bus instead of Redis, and the bus plays the role of Slips: scenarios publish scrolls to it and check what the
+// pigeon sent back.
+package harness
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/stratosphereips/p2p4slips/database"
+	"github.com/stratosphereips/p2p4slips/peer"
+	"github.com/stratosphereips/p2p4slips/schema"
+	"github.com/stratosphereips/p2p4slips/slistener"
+	"github.com/stratosphereips/p2p4slips/utils"
+)
+
+// DefaultTimeout is how long Wait waits for a condition, unless the cluster says otherwise
+const DefaultTimeout = 10 * time.Second
+
+// Node is one pigeon of the cluster, together with its fake Slips side
+type Node struct {
+	Name     string
+	Peer     *peer.Peer
+	Bus      *database.MemoryBus
+	Config   *utils.Config
+	stopOnce sync.Once
+}
+
+// Cluster is a group of nodes running in this process
+type Cluster struct {
+	Nodes   []*Node
+	Timeout time.Duration
+}
+
+// Start starts n nodes listening on loopback, on ports chosen by the system. The flags (as on the command line of the
+// pigeon) are applied to every node. Nodes don't discover each other, they are connected with Connect or ConnectAll.
+func Start(n int, flags ...string) (*Cluster, error) {
+	c := &Cluster{Timeout: DefaultTimeout}
+	// a random rendezvous string keeps the nodes away from pigeons running on the same network
+	rendezvous := fmt.Sprintf("harness-%d", rand.Int63())
+
+	for i := 0; i < n; i++ {
+		fs := flag.NewFlagSet("harness", flag.ContinueOnError)
+		cfg := utils.RegisterFlags(fs)
+		args := append([]string{"-host", "127.0.0.1", "-port", "0", "-mdns=false", "-rendezvous", rendezvous}, flags...)
+		if err := fs.Parse(args); err != nil {
+			c.Stop()
+			return nil, err
+		}
+
+		node := &Node{Name: fmt.Sprintf("node%d", i), Bus: database.NewMemoryBus(), Config: cfg}
+		node.Peer = peer.NewPeer(cfg, node.Bus)
+		if err := node.Peer.PeerInit(); err != nil {
+			c.Stop()
+			return nil, fmt.Errorf("starting %s failed: %s", node.Name, err)
+		}
+		listener := &slistener.SListener{Peer: node.Peer, Bus: node.Bus}
+		go listener.Run()
+
+		c.Nodes = append(c.Nodes, node)
+	}
+	return c, nil
+}
+
+// Stop shuts all nodes down at once. Each node says goodbye to its peers first.
+func (c *Cluster) Stop() {
+	var wg sync.WaitGroup
+	for _, node := range c.Nodes {
+		wg.Add(1)
+		go func(node *Node) {
+			defer wg.Done()
+			node.Stop()
+		}(node)
+	}
+	wg.Wait()
+}
+
+// Connect makes the first node say hello to the second one
+func (c *Cluster) Connect(from *Node, to *Node) error {
+	addresses := to.Peer.Addresses()
+	if len(addresses) == 0 {
+		return fmt.Errorf("%s has no address", to.Name)
+	}
+	if err := from.Peer.Connect(addresses[0]); err != nil {
+		return fmt.Errorf("connecting %s to %s failed: %s", from.Name, to.Name, err)
+	}
+	return nil
+}
+
+// ConnectAll connects every pair of nodes
+func (c *Cluster) ConnectAll() error {
+	for i, from := range c.Nodes {
+		for _, to := range c.Nodes[i+1:] {
+			if err := c.Connect(from, to); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Wait until the condition holds
+// description: what is waited for, used in the error
+// return error: nil if the condition held before the timeout of the cluster
+func (c *Cluster) Wait(description string, condition func() bool) error {
+	deadline := time.Now().Add(c.Timeout)
+	for time.Now().Before(deadline) {
+		if condition() {
+			return nil
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return errors.New("timed out waiting for " + description)
+}
+
+// Stop shuts the node down and closes its bus. Stopping a stopped node does nothing.
+func (n *Node) Stop() {
+	n.stopOnce.Do(func() {
+		n.Peer.Close()
+		n.Bus.Close()
+	})
+}
+
+// Kill closes the host of the node without a goodbye, as if the process crashed or the network went down. Its peers
+// only notice that pings fail. Stop still cleans up the rest of the node.
+func (n *Node) Kill() {
+	n.Peer.PeerShutdown()
+}
+
+// ID returns the peer id of the node
+func (n *Node) ID() string {
+	return n.Peer.ID()
+}
+
+// Send publishes the scroll to the node, as Slips would
+func (n *Node) Send(scroll schema.PigeonScroll) error {
+	scroll.SchemaVersion = schema.Version
+	data, err := json.Marshal(scroll)
+	if err != nil {
+		return err
+	}
+	n.Bus.Publish(string(data))
+	return nil
+}
+
+// Messages returns the contents of all messages of the given type that the node sent to Slips, oldest first
+func (n *Node) Messages(messageType string) []json.RawMessage {
+	var contents []json.RawMessage
+	for _, published := range n.Bus.Published() {
+		message := struct {
+			MessageType     string          `json:"message_type"`
+			MessageContents json.RawMessage `json:"message_contents"`
+		}{}
+		if err := json.Unmarshal([]byte(published), &message); err != nil || message.MessageType != messageType {
+			continue
+		}
+		contents = append(contents, message.MessageContents)
+	}
+	return contents
+}
+
+// Reports returns all messages from other peers that the node forwarded to Slips
+func (n *Node) Reports() []schema.Report {
+	var reports []schema.Report
+	for _, contents := range n.Messages(schema.ReportType) {
+		report := schema.Report{}
+		if json.Unmarshal(contents, &report) == nil {
+			reports = append(reports, report)
+		}
+	}
+	return reports
+}
+
+// FindReport returns the first report forwarded to Slips with the given message, nil if there is none
+func (n *Node) FindReport(message string) *schema.Report {
+	for _, report := range n.Reports() {
+		if report.Message == message {
+			return &report
+		}
+	}
+	return nil
+}
+
+// PeerUpdates returns all updates about the given peer that the node sent to Slips
+func (n *Node) PeerUpdates(peerId string) []schema.PeerUpdate {
+	var updates []schema.PeerUpdate
+	for _, contents := range n.Messages(schema.PeerUpdateType) {
+		update := schema.PeerUpdate{}
+		if json.Unmarshal(contents, &update) == nil && update.PeerID == peerId {
+			updates = append(updates, update)
+		}
+	}
+	return updates
+}
+
+// Interactions returns the rated interactions with the given peer that the node sent to Slips
+func (n *Node) Interactions(peerId string) []schema.Interaction {
+	var interactions []schema.Interaction
+	for _, contents := range n.Messages(schema.InteractionType) {
+		interaction := schema.Interaction{}
+		if json.Unmarshal(contents, &interaction) == nil && interaction.PeerID == peerId {
+			interactions = append(interactions, interaction)
+		}
+	}
+	return interactions
+}
+
+// Knows checks if the other node is in the peerstore of this node
+func (n *Node) Knows(other *Node) bool {
+	return n.Peer.PeerStore().IsKnown(other.ID()) != nil
+}
+
+// IsActive checks if the other node is among the active peers of this node
+func (n *Node) IsActive(other *Node) bool {
+	return n.Peer.PeerStore().IsActivePeer(other.ID()) != nil
+}
+
+// ConnectRaw makes the node say hello to the raw peer
+func (n *Node) ConnectRaw(raw *RawPeer) error {
+	if err := n.Peer.Connect(raw.Address()); err != nil {
+		return fmt.Errorf("connecting %s to the raw peer failed: %s", n.Name, err)
+	}
+	return nil
+}
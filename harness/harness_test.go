@@ -0,0 +1,20 @@
+package harness
+
+import (
+	"testing"
+)
+
+// runs the built-in scenarios, each on its own cluster
+func TestScenarios(t *testing.T) {
+	if testing.Short() {
+		t.Skip("the scenarios start pigeons and take a few seconds each")
+	}
+	for _, scenario := range Scenarios {
+		scenario := scenario
+		t.Run(scenario.Name, func(t *testing.T) {
+			if err := runScenario(scenario, nil); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
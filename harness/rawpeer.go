@@ -0,0 +1,151 @@
+package harness
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	libp2ppeer "github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/protocol"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/stratosphereips/p2p4slips/peer"
+)
+
+// RawPeer is a bare libp2p host that only speaks the legacy protocol. It answers hello and ping like a pigeon of
+// protocol version 1, and keeps every other line it receives. Scenarios use it in place of old pigeons, and to send
+// lines that no pigeon would send.
+type RawPeer struct {
+	host     host.Host
+	key      crypto.PrivKey
+	protocol protocol.ID
+	mutex    sync.Mutex
+	received []string
+}
+
+// StartRawPeer starts a raw peer listening on loopback
+// protocolID: the legacy protocol (-pid of the pigeons)
+func StartRawPeer(protocolID string) (*RawPeer, error) {
+	key, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	h, err := libp2p.New(context.Background(), libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"),
+		libp2p.Identity(key))
+	if err != nil {
+		return nil, err
+	}
+
+	r := &RawPeer{host: h, key: key, protocol: protocol.ID(protocolID)}
+	h.SetStreamHandler(r.protocol, r.handle)
+	return r, nil
+}
+
+// Stop closes the host of the raw peer
+func (r *RawPeer) Stop() {
+	_ = r.host.Close()
+}
+
+// ID returns the peer id of the raw peer
+func (r *RawPeer) ID() string {
+	return r.host.ID().Pretty()
+}
+
+// Address returns the full address of the raw peer, which nodes can connect to
+func (r *RawPeer) Address() string {
+	return fmt.Sprintf("%s/p2p/%s", r.host.Addrs()[0], r.ID())
+}
+
+// Received returns all lines the raw peer received, except hello and ping, oldest first
+func (r *RawPeer) Received() []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return append([]string{}, r.received...)
+}
+
+// Send sends one line (without the trailing newline) to the node over the legacy protocol
+func (r *RawPeer) Send(to *Node, line string) error {
+	addresses := to.Peer.Addresses()
+	if len(addresses) == 0 {
+		return fmt.Errorf("%s has no address", to.Name)
+	}
+	address, err := multiaddr.NewMultiaddr(addresses[0])
+	if err != nil {
+		return err
+	}
+	info, err := libp2ppeer.AddrInfoFromP2pAddr(address)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err = r.host.Connect(ctx, *info); err != nil {
+		return err
+	}
+	stream, err := r.host.NewStream(ctx, info.ID, r.protocol)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+	_, err = stream.Write([]byte(line + "\n"))
+	return err
+}
+
+// SignedMessage returns the payload in an envelope signed by the key of the raw peer, as if it was sent at the given
+// time
+func (r *RawPeer) SignedMessage(payload string, at time.Time) (string, error) {
+	line, err := peer.SignEnvelope(r.key, payload, false, at)
+	return strings.TrimSuffix(line, "\n"), err
+}
+
+// ForgedMessage returns a signed envelope whose payload was replaced after signing, so its signature is invalid
+func (r *RawPeer) ForgedMessage(payload string) (string, error) {
+	line, err := r.SignedMessage(base64.StdEncoding.EncodeToString([]byte("original")), time.Now())
+	if err != nil {
+		return "", err
+	}
+	data, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(line, "signed "))
+	if err != nil {
+		return "", err
+	}
+	envelope := &peer.SignedEnvelope{}
+	if err = json.Unmarshal(data, envelope); err != nil {
+		return "", err
+	}
+	envelope.Payload = payload
+	if data, err = json.Marshal(envelope); err != nil {
+		return "", err
+	}
+	return "signed " + base64.StdEncoding.EncodeToString(data), nil
+}
+
+// answer hello and ping like a version 1 pigeon, and keep all other lines
+func (r *RawPeer) handle(stream network.Stream) {
+	defer stream.Close()
+	line, err := bufio.NewReader(stream).ReadString('\n')
+	if err != nil {
+		return
+	}
+	line = strings.TrimSuffix(line, "\n")
+
+	switch fields := strings.Fields(line); {
+	case len(fields) > 0 && fields[0] == "hello":
+		_, _ = stream.Write([]byte("hello version1\n"))
+	case line == "ping":
+		_, _ = stream.Write([]byte("pong\n"))
+	default:
+		r.mutex.Lock()
+		r.received = append(r.received, line)
+		r.mutex.Unlock()
+	}
+}
@@ -0,0 +1,376 @@
+package harness
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/stratosphereips/p2p4slips/peer"
+	"github.com/stratosphereips/p2p4slips/schema"
+)
+
+// Scenario is a test of the pigeon, run on a fresh cluster
+type Scenario struct {
+	Name  string
+	Nodes int
+	// flags of the nodes, added to the flags given to Run
+	Flags []string
+	Run   func(c *Cluster) error
+}
+
+// Result of running a scenario, Err is nil if it passed
+type Result struct {
+	Scenario string
+	Err      error
+	Duration time.Duration
+}
+
+// Scenarios covering the basic behaviour of the pigeon
+var Scenarios = []Scenario{
+	{Name: "hello", Nodes: 2, Run: helloScenario},
+	{Name: "ping", Nodes: 2, Run: pingScenario},
+	{Name: "messaging", Nodes: 3, Run: messagingScenario},
+	{Name: "selection", Nodes: 3, Flags: []string{"-fanout", "1"}, Run: selectionScenario},
+	{Name: "goodbye", Nodes: 2, Run: goodbyeScenario},
+	{Name: "signatures", Nodes: 1, Run: signaturesScenario},
+	{Name: "unreachable", Nodes: 2, Flags: []string{"-ping-interval", "500ms", "-ping-max-interval", "500ms",
+		"-ping-jitter", "0", "-ping-timeout", "300ms", "-ping-deactivate-after", "2s", "-ping-min-gap", "100ms"},
+		Run: unreachableScenario},
+	{Name: "legacy", Nodes: 1, Run: legacyScenario},
+}
+
+// Run runs the scenarios one after another, each on its own cluster started with the given flags
+func Run(scenarios []Scenario, flags ...string) []Result {
+	results := make([]Result, 0, len(scenarios))
+	for _, scenario := range scenarios {
+		start := time.Now()
+		err := runScenario(scenario, flags)
+		results = append(results, Result{Scenario: scenario.Name, Err: err, Duration: time.Since(start)})
+	}
+	return results
+}
+
+func runScenario(scenario Scenario, flags []string) error {
+	c, err := Start(scenario.Nodes, append(append([]string(nil), flags...), scenario.Flags...)...)
+	if err != nil {
+		return err
+	}
+	defer c.Stop()
+	return scenario.Run(c)
+}
+
+// PrintResults shows the results, and returns true if all scenarios passed
+func PrintResults(results []Result) bool {
+	passed := true
+	for _, result := range results {
+		if result.Err != nil {
+			passed = false
+			fmt.Printf("[HARNESS] FAIL %s (%s) - %s\n", result.Scenario, result.Duration.Round(time.Millisecond),
+				result.Err)
+		} else {
+			fmt.Printf("[HARNESS] PASS %s (%s)\n", result.Scenario, result.Duration.Round(time.Millisecond))
+		}
+	}
+	return passed
+}
+
+// both nodes know each other after a hello, agree on capabilities and tell their slips about each other
+func helloScenario(c *Cluster) error {
+	a, b := c.Nodes[0], c.Nodes[1]
+	if err := c.Connect(a, b); err != nil {
+		return err
+	}
+
+	if err := c.Wait("nodes to know each other", func() bool { return a.IsActive(b) && b.IsActive(a) }); err != nil {
+		return err
+	}
+	if _, compatible := a.Peer.PeerStore().IsKnown(b.ID()).GetCapabilities(); !compatible {
+		return fmt.Errorf("%s considers %s incompatible", a.Name, b.Name)
+	}
+	return c.Wait("peer updates for slips", func() bool {
+		return len(a.PeerUpdates(b.ID())) > 0 && len(b.PeerUpdates(a.ID())) > 0
+	})
+}
+
+// a ping is answered, and the round trip time is recorded
+func pingScenario(c *Cluster) error {
+	a, b := c.Nodes[0], c.Nodes[1]
+	if err := c.Connect(a, b); err != nil {
+		return err
+	}
+
+	if !a.Peer.Ping(b.ID()) {
+		return fmt.Errorf("%s didn't answer the ping", b.Name)
+	}
+	if _, ok := a.Peer.PeerStore().IsKnown(b.ID()).RttPercentile(50); !ok {
+		return fmt.Errorf("%s didn't record the round trip time", a.Name)
+	}
+	if reliability := a.Peer.PeerStore().IsKnown(b.ID()).Reliability; reliability <= 0 {
+		return fmt.Errorf("reliability of %s is %v after a successful ping", b.Name, reliability)
+	}
+	return nil
+}
+
+// a broadcast reaches all peers with a valid signature, an encrypted direct message only reaches its recipient
+func messagingScenario(c *Cluster) error {
+	a, b, d := c.Nodes[0], c.Nodes[1], c.Nodes[2]
+	if err := c.ConnectAll(); err != nil {
+		return err
+	}
+
+	broadcast := base64.StdEncoding.EncodeToString([]byte(`{"ip": "192.0.2.1", "score": 0.9}`))
+	err := a.Send(schema.PigeonScroll{Message: broadcast, Recipient: "*",
+		Strategy: &schema.Strategy{Mode: schema.StrategyAll}})
+	if err != nil {
+		return err
+	}
+	for _, node := range []*Node{b, d} {
+		node := node
+		if err = c.Wait("broadcast at "+node.Name, func() bool { return node.FindReport(broadcast) != nil }); err != nil {
+			return err
+		}
+		report := node.FindReport(broadcast)
+		if report.Signature != schema.SignatureValid || report.Origin != a.ID() || report.Reporter != a.ID() {
+			return fmt.Errorf("%s received the broadcast with signature %s from origin %q", node.Name,
+				report.Signature, report.Origin)
+		}
+	}
+
+	direct := base64.StdEncoding.EncodeToString([]byte(`{"ip": "192.0.2.2", "score": 0.1}`))
+	if err = a.Send(schema.PigeonScroll{Message: direct, Recipient: d.ID(), Encrypt: true}); err != nil {
+		return err
+	}
+	if err = c.Wait("direct message at "+d.Name, func() bool { return d.FindReport(direct) != nil }); err != nil {
+		return err
+	}
+	if !d.FindReport(direct).Encrypted {
+		return fmt.Errorf("%s received the direct message unencrypted", d.Name)
+	}
+	// give a wrongly delivered message some time to arrive
+	time.Sleep(500 * time.Millisecond)
+	if b.FindReport(direct) != nil {
+		return fmt.Errorf("%s received a message for %s", b.Name, d.Name)
+	}
+	return nil
+}
+
+// the default fanout (1 in this scenario) limits how many peers get a message, and a scroll with fanout 0 lifts the
+// limit
+func selectionScenario(c *Cluster) error {
+	a, b, d := c.Nodes[0], c.Nodes[1], c.Nodes[2]
+	for _, node := range []*Node{b, d} {
+		if err := c.Connect(a, node); err != nil {
+			return err
+		}
+	}
+	if err := c.Wait("peers to be active", func() bool { return a.IsActive(b) && a.IsActive(d) }); err != nil {
+		return err
+	}
+
+	limited := base64.StdEncoding.EncodeToString([]byte(`{"ip": "192.0.2.3", "score": 0.5}`))
+	err := a.Send(schema.PigeonScroll{Message: limited, Recipient: "*",
+		Strategy: &schema.Strategy{Mode: schema.StrategyWeighted}})
+	if err != nil {
+		return err
+	}
+	err = c.Wait("limited message at one peer", func() bool {
+		return b.FindReport(limited) != nil || d.FindReport(limited) != nil
+	})
+	if err != nil {
+		return err
+	}
+	// give a message to the second peer some time to arrive
+	time.Sleep(500 * time.Millisecond)
+	if b.FindReport(limited) != nil && d.FindReport(limited) != nil {
+		return errors.New("a message with fanout 1 reached both peers")
+	}
+
+	unlimited := 0
+	all := base64.StdEncoding.EncodeToString([]byte(`{"ip": "192.0.2.4", "score": 0.5}`))
+	err = a.Send(schema.PigeonScroll{Message: all, Recipient: "*",
+		Strategy: &schema.Strategy{Mode: schema.StrategyRandom, Fanout: &unlimited}})
+	if err != nil {
+		return err
+	}
+	return c.Wait("message without fanout limit at both peers", func() bool {
+		return b.FindReport(all) != nil && d.FindReport(all) != nil
+	})
+}
+
+// a node that shuts down says goodbye, and its peer deactivates it
+func goodbyeScenario(c *Cluster) error {
+	a, b := c.Nodes[0], c.Nodes[1]
+	if err := c.Connect(a, b); err != nil {
+		return err
+	}
+	if err := c.Wait("nodes to know each other", func() bool { return b.IsActive(a) }); err != nil {
+		return err
+	}
+
+	a.Stop()
+	if err := c.Wait("goodbye to be handled", func() bool { return !b.IsActive(a) }); err != nil {
+		return err
+	}
+	if !b.Knows(a) {
+		return fmt.Errorf("%s forgot %s after its goodbye", b.Name, a.Name)
+	}
+	return nil
+}
+
+// a valid signed message is forwarded with its origin, while a replayed, forged or outdated one is rated as invalid.
+// The forged one is still forwarded, marked as invalid and without an origin, the others are dropped
+func signaturesScenario(c *Cluster) error {
+	a := c.Nodes[0]
+	raw, err := StartRawPeer(a.Config.ProtocolID)
+	if err != nil {
+		return err
+	}
+	defer raw.Stop()
+
+	valid := base64.StdEncoding.EncodeToString([]byte(`{"ip": "192.0.2.5", "score": 0.7}`))
+	line, err := raw.SignedMessage(valid, time.Now())
+	if err != nil {
+		return err
+	}
+	if err = raw.Send(a, line); err != nil {
+		return err
+	}
+	if err = c.Wait("signed message at "+a.Name, func() bool { return a.FindReport(valid) != nil }); err != nil {
+		return err
+	}
+	if report := a.FindReport(valid); report.Signature != schema.SignatureValid || report.Origin != raw.ID() {
+		return fmt.Errorf("signed message was forwarded with signature %s from origin %q", report.Signature,
+			report.Origin)
+	}
+
+	// the same envelope again is a replay
+	if err = raw.Send(a, line); err != nil {
+		return err
+	}
+	if err = c.Wait("replay to be rated", func() bool { return invalidSignatures(a, raw) >= 1 }); err != nil {
+		return err
+	}
+
+	forged := base64.StdEncoding.EncodeToString([]byte(`{"ip": "192.0.2.6", "score": 0.1}`))
+	if line, err = raw.ForgedMessage(forged); err != nil {
+		return err
+	}
+	if err = raw.Send(a, line); err != nil {
+		return err
+	}
+	if err = c.Wait("forged message at "+a.Name, func() bool { return a.FindReport(forged) != nil }); err != nil {
+		return err
+	}
+	if report := a.FindReport(forged); report.Signature != schema.SignatureInvalid || report.Origin != "" {
+		return fmt.Errorf("forged message was forwarded with signature %s from origin %q", report.Signature,
+			report.Origin)
+	}
+
+	outdated := base64.StdEncoding.EncodeToString([]byte(`{"ip": "192.0.2.7", "score": 0.2}`))
+	if line, err = raw.SignedMessage(outdated, time.Now().Add(-10*time.Minute)); err != nil {
+		return err
+	}
+	if err = raw.Send(a, line); err != nil {
+		return err
+	}
+	if err = c.Wait("outdated message to be rated", func() bool { return invalidSignatures(a, raw) >= 3 }); err != nil {
+		return err
+	}
+
+	if count := len(a.Reports()); count != 2 {
+		return fmt.Errorf("%d messages were forwarded, expected the valid and the forged one", count)
+	}
+	return nil
+}
+
+// number of invalid signatures of the raw peer that the node told slips about
+func invalidSignatures(n *Node, raw *RawPeer) int {
+	count := 0
+	for _, interaction := range n.Interactions(raw.ID()) {
+		if interaction.Kind == peer.InteractionSignature && interaction.Outcome == peer.OutcomeInvalid {
+			count++
+		}
+	}
+	return count
+}
+
+// a peer that disappears without a goodbye is deactivated once it didn't answer pings for -ping-deactivate-after
+func unreachableScenario(c *Cluster) error {
+	a, b := c.Nodes[0], c.Nodes[1]
+	if err := c.Connect(a, b); err != nil {
+		return err
+	}
+	if err := c.Wait("nodes to know each other", func() bool { return a.IsActive(b) }); err != nil {
+		return err
+	}
+	// peers that never answered a ping are kept, the deactivation counts from the last good ping
+	if !a.Peer.Ping(b.ID()) {
+		return fmt.Errorf("%s didn't answer the ping", b.Name)
+	}
+
+	b.Kill()
+	if err := c.Wait("unreachable peer to be deactivated", func() bool { return !a.IsActive(b) }); err != nil {
+		return err
+	}
+	if !a.Knows(b) {
+		return fmt.Errorf("%s forgot the unreachable %s", a.Name, b.Name)
+	}
+	return nil
+}
+
+// a peer speaking only the legacy protocol is compatible with version 1. It gets messages without a signature, and
+// its own plain messages are forwarded as unsigned
+func legacyScenario(c *Cluster) error {
+	a := c.Nodes[0]
+	raw, err := StartRawPeer(a.Config.ProtocolID)
+	if err != nil {
+		return err
+	}
+	defer raw.Stop()
+
+	if err = a.ConnectRaw(raw); err != nil {
+		return err
+	}
+	err = c.Wait("peer update of the legacy peer", func() bool {
+		for _, update := range a.PeerUpdates(raw.ID()) {
+			if update.Compatible != nil && *update.Compatible && update.ProtocolVersion == 1 {
+				return true
+			}
+		}
+		return false
+	})
+	if err != nil {
+		return err
+	}
+
+	outgoing := base64.StdEncoding.EncodeToString([]byte(`{"ip": "192.0.2.8", "score": 0.3}`))
+	err = a.Send(schema.PigeonScroll{Message: outgoing, Recipient: raw.ID()})
+	if err != nil {
+		return err
+	}
+	err = c.Wait("message at the legacy peer", func() bool { return len(raw.Received()) > 0 })
+	if err != nil {
+		return err
+	}
+	if received := raw.Received()[0]; received != outgoing {
+		if strings.HasPrefix(received, "signed ") {
+			return errors.New("the legacy peer got a signed message")
+		}
+		return fmt.Errorf("the legacy peer got %q instead of the message", received)
+	}
+
+	incoming := base64.StdEncoding.EncodeToString([]byte(`{"ip": "192.0.2.9", "score": 0.4}`))
+	if err = raw.Send(a, incoming); err != nil {
+		return err
+	}
+	if err = c.Wait("legacy message at "+a.Name, func() bool { return a.FindReport(incoming) != nil }); err != nil {
+		return err
+	}
+	if report := a.FindReport(incoming); report.Signature != schema.SignatureUnsigned || report.Reporter != raw.ID() {
+		return fmt.Errorf("legacy message was forwarded with signature %s from reporter %q", report.Signature,
+			report.Reporter)
+	}
+	return nil
+}
@@ -1,29 +1,50 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
-	"net"
 	"os"
 	"os/signal"
 	"strconv"
 	"syscall"
 
 	"github.com/stratosphereips/p2p4slips/database"
+	"github.com/stratosphereips/p2p4slips/metrics"
 	"github.com/stratosphereips/p2p4slips/peer"
+	"github.com/stratosphereips/p2p4slips/schema"
 	"github.com/stratosphereips/p2p4slips/slistener"
-	"github.com/stratosphereips/p2p4slips/tests"
 	"github.com/stratosphereips/p2p4slips/utils"
 )
 
 func main() {
 
+	// subcommands have their own flags, they are handled before the flags of the main program are parsed
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "export":
+			os.Exit(runExport(os.Args[2:]))
+		case "import":
+			os.Exit(runImport(os.Args[2:]))
+		case "simulate":
+			os.Exit(runSimulate(os.Args[2:]))
+		case "cluster":
+			os.Exit(runCluster(os.Args[2:]))
+		case "self-test":
+			os.Exit(runSelfTest(os.Args[2:]))
+		}
+	}
+
 	cfg := utils.ParseFlags()
 
 	if cfg.ShowHelp {
 		fmt.Println("This is the P2P component of the Stratosphere Linux IPS.")
 		fmt.Println("Run './p2p4slips' to start it.")
 		fmt.Println("For testing multiple peers on one machine, use './p2p4slips -port [port]'")
+		fmt.Println("To move known peers between machines, use './p2p4slips export' and './p2p4slips import'")
+		fmt.Println("To see how reliability of peers with different behaviours evolves, use './p2p4slips simulate'")
+		fmt.Println("To run several pigeons on this machine, use './p2p4slips cluster'")
+		fmt.Println("To check the setup before starting the pigeon, use './p2p4slips self-test' with the same flags")
 
 		fmt.Println()
 		fmt.Println("Usage:")
@@ -32,52 +53,54 @@ func main() {
 		os.Exit(0)
 	}
 
-	if cfg.RunTests {
-		fmt.Println("Running tests...")
-		tests.RunTests("127.0.0.1", "foo")
+	if cfg.RotateKey {
+		keyType, err := utils.ParseKeyType(cfg.KeyType)
+		var passphrase []byte
+		if err == nil {
+			passphrase, err = utils.ReadPassphrase(cfg.KeyPassphraseEnv, cfg.KeyPassphraseFile)
+		}
+		if err == nil {
+			err = utils.RotateKey(cfg.KeyFile, keyType, passphrase)
+		}
+		if err != nil {
+			fmt.Println("[MAIN] Key rotation failed -", err)
+			os.Exit(1)
+		}
 		os.Exit(0)
 	}
-	fmt.Printf("[DEBUGGG] LISTENING on IP: %s\n", cfg.ListenHost)
 
-	// check if port is available - if not, panic
-	testPort(cfg.ListenPort)
 	if cfg.RenameWithPort {
-		fmt.Printf("[DEBUGGING]: renaming channels and files with port %d\n", cfg.ListenPort)
+		fmt.Printf("[MAIN] Appending port %d to file names, channels and keys\n", cfg.ListenPort)
 		// add port to file names and channels (if config specifies it)
 		renameFilesAndChannels(cfg)
 	}
 
-	fmt.Printf("[MAIN] Pigeon is starting on TCP Port %d\n", cfg.ListenPort)
-
-	// initialize database interface
-	database.DBW = &database.DBWrapper{DbAddress: cfg.RedisDb, RdbGoPy: cfg.RedisChannelGoPy,
-		RdbPyGo: cfg.RedisChannelPyGo}
-	var dbSuccess = database.DBW.InitDB()
+	listenHost := cfg.ListenHost
+	if listenHost == "" {
+		listenHost = "all interfaces"
+	}
+	if cfg.ListenPort == 0 {
+		fmt.Printf("[MAIN] Pigeon is starting on a free TCP Port, listening on %s\n", listenHost)
+	} else {
+		fmt.Printf("[MAIN] Pigeon is starting on TCP Port %d, listening on %s\n", cfg.ListenPort, listenHost)
+	}
 
-	if !dbSuccess {
-		fmt.Println("[PEER] Initializing database failed")
+	// initialize the database interface, the peer and the node listening for data from slips
+	peer, err := startPigeon(cfg)
+	if err != nil {
+		fmt.Println("[PEER] Initializing peer failed -", err)
 		os.Exit(1)
 	}
-
-	// initialize peer
-	peer := peer.NewPeer(cfg)
 	// defer means do it at the	end of the function
 	defer peer.PeerShutdown()
-	err := peer.PeerInit()
 
-	if err != nil {
-		fmt.Println("[PEER] Initializing peer failed")
-		os.Exit(1)
+	if cfg.MetricsAddress != "" {
+		if err := metrics.Serve(cfg.MetricsAddress); err != nil {
+			fmt.Println("[MAIN] Serving metrics failed -", err)
+			os.Exit(1)
+		}
 	}
 
-	// initialize the node listening for data from slips
-	slist := slistener.SListener{Peer: peer}
-	go slist.Run()
-
-	// run tests
-	// TODO: remove tests for production
-	go tests.RunTests(cfg.RedisDb, cfg.RedisChannelPyGo)
-
 	// neatly exit when termination signal is received
 	ch := make(chan os.Signal, 1)
 	signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM)
@@ -89,22 +112,57 @@ func main() {
 	os.Exit(0)
 }
 
-// verify that the chosen port is not used by another service by trying to open a tcp socket on it
-// if the port is already used, this function will panic
-func testPort(listenPort int) {
-	portStr := strconv.Itoa(listenPort)
-	socket, err := net.Listen("tcp", ":"+portStr)
+// check the settings that the flag parser can't check
+func validateConfig(cfg *utils.Config) error {
+	if cfg.SelectionMode != schema.StrategyAll && cfg.SelectionMode != schema.StrategyRandom &&
+		cfg.SelectionMode != schema.StrategyWeighted {
+		return fmt.Errorf("unknown selection strategy '%s'", cfg.SelectionMode)
+	}
+	if cfg.ShareInteractions != peer.ShareInteractionsNone && cfg.ShareInteractions != peer.ShareInteractionsFailures &&
+		cfg.ShareInteractions != peer.ShareInteractionsAll {
+		return fmt.Errorf("unknown value of -share-interactions '%s'", cfg.ShareInteractions)
+	}
+	if cfg.ReportQualityWeight < 0 || cfg.ReportQualityWeight > 1 {
+		return errors.New("-report-quality-weight must be between 0 and 1")
+	}
+	if cfg.BulkQuotaMB < 0 || cfg.BulkMaxPerPeer < 1 || cfg.BulkPartTTL <= 0 {
+		return errors.New("invalid bulk transfer limits, the quota can't be negative, and each peer must be " +
+			"allowed at least one transfer for a positive time")
+	}
+	if err := peer.NewPingConfig(cfg).Validate(); err != nil {
+		return fmt.Errorf("invalid ping settings - %s", err)
+	}
+	if cfg.RenameWithPort && cfg.ListenPort == 0 {
+		return errors.New("-rename-with-port needs a fixed port, it can't be used with -port 0")
+	}
+	return nil
+}
+
+// check the settings, connect to the database, start the peer and start listening for commands from slips
+func startPigeon(cfg *utils.Config) (*peer.Peer, error) {
+	if err := validateConfig(cfg); err != nil {
+		return nil, fmt.Errorf("invalid configuration - %s", err)
+	}
 
-	if err != nil {
-		panicMsg := fmt.Sprintf("can't listen on port %q: %s", portStr, err)
-		panic(panicMsg)
+	db := &database.DBWrapper{DbAddress: cfg.RedisDb, RdbGoPy: cfg.RedisChannelGoPy, RdbPyGo: cfg.RedisChannelPyGo,
+		KeySuffix: cfg.RedisKeySuffix}
+	if !db.InitDB() {
+		return nil, errors.New("initializing database failed")
+	}
+
+	p := peer.NewPeer(cfg, db)
+	if err := p.PeerInit(); err != nil {
+		return nil, err
 	}
 
-	_ = socket.Close()
+	slist := slistener.SListener{Peer: p, Bus: db}
+	go slist.Run()
+	return p, nil
 }
 
 // check if config requires port to be appended to config strings, and if so, append the port
-// this affects file names (key file and peerstore file) and channels for communicating with python module
+// this affects file names (key file, peerstore file and database), channels for communicating with python module and
+// the redis keys where the identity and addresses are stored
 func renameFilesAndChannels(cfg *utils.Config) {
 	if cfg.RenameWithPort {
 		// if file name is empty, it means that file saving should not be used
@@ -115,7 +173,14 @@ func renameFilesAndChannels(cfg *utils.Config) {
 		if cfg.PeerstoreFile != "" {
 			cfg.PeerstoreFile = fmt.Sprintf("%s%d", cfg.PeerstoreFile, cfg.ListenPort)
 		}
+		if cfg.PeerstoreDB != "" {
+			cfg.PeerstoreDB = fmt.Sprintf("%s%d", cfg.PeerstoreDB, cfg.ListenPort)
+		}
+		if cfg.BulkDir != "" {
+			cfg.BulkDir = fmt.Sprintf("%s%d", cfg.BulkDir, cfg.ListenPort)
+		}
 		cfg.RedisChannelGoPy = fmt.Sprintf("%s%d", cfg.RedisChannelGoPy, cfg.ListenPort)
 		cfg.RedisChannelPyGo = fmt.Sprintf("%s%d", cfg.RedisChannelPyGo, cfg.ListenPort)
+		cfg.RedisKeySuffix = strconv.Itoa(cfg.ListenPort)
 	}
 }
@@ -0,0 +1,54 @@
+// Package metrics holds counters describing the work of the pigeon. They are published with expvar, and can be
+// served over HTTP (at /debug/vars) with Serve.
+package metrics
+
+import (
+	"expvar"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// Compression counts bytes of data messages before and after compression, in both directions
+// sent_messages: all data messages sent to peers, sent_compressed_messages: those of them that were compressed
+// sent_original_bytes: sent messages before compression, sent_bytes: the messages as they were sent
+// received_bytes: compressed messages as received, received_original_bytes: the same messages after decompression
+var Compression = expvar.NewMap("compression")
+
+// RecordSentMessage counts a data message sent to a peer. A message sent uncompressed (the peer doesn't support
+// compression, or compressing wouldn't make the message shorter) has the same size before and after
+func RecordSentMessage(original int, sent int, compressed bool) {
+	Compression.Add("sent_messages", 1)
+	if compressed {
+		Compression.Add("sent_compressed_messages", 1)
+	}
+	Compression.Add("sent_original_bytes", int64(original))
+	Compression.Add("sent_bytes", int64(sent))
+}
+
+// RecordReceivedCompression counts a compressed message that was received
+func RecordReceivedCompression(compressed int, original int) {
+	Compression.Add("received_messages", 1)
+	Compression.Add("received_bytes", int64(compressed))
+	Compression.Add("received_original_bytes", int64(original))
+}
+
+// Serve publishes all metrics over HTTP in the background
+// return error: nil if the address could be used
+func Serve(address string) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+	go func() {
+		if err := http.Serve(listener, mux); err != nil {
+			fmt.Println("[METRICS] Serving metrics stopped -", err)
+		}
+	}()
+
+	fmt.Printf("[METRICS] Serving metrics at http://%s/debug/vars\n", listener.Addr())
+	return nil
+}
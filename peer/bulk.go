@@ -0,0 +1,468 @@
+package peer
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/stratosphereips/p2p4slips/database"
+	"github.com/stratosphereips/p2p4slips/schema"
+)
+
+// Bulk transfer protocol, used on the bulk channel:
+// sender:   offer <base64 json of bulkOffer>
+// receiver: accept <index of the first missing chunk> | reject <reason>
+// sender:   chunk <index> <sha256 of the chunk> <base64 of the gzip compressed chunk>, for each missing chunk
+// receiver: done | failed <reason>, after the whole content was checked
+// The receiver keeps unfinished transfers on disk, so a transfer that was interrupted continues where it stopped.
+const (
+	bulkChunkSize        = 256 * 1024
+	bulkMaxChunkSize     = 512 * 1024 // compressed and base64 encoded, it still fits the line limit of the channel
+	bulkMaxSize          = 256 * 1024 * 1024
+	bulkCompression      = "gzip"
+	bulkAttempts         = 3
+	bulkRetryDelay       = 5 * time.Second
+	bulkProgressInterval = time.Second
+	bulkPartSuffix       = ".part"
+)
+
+var bulkName = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// bulkOffer describes the content of a bulk transfer
+type bulkOffer struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	Size        int64  `json:"size"`
+	ChunkSize   int    `json:"chunk_size"`
+	Sha256      string `json:"sha256"`
+	Compression string `json:"compression"`
+}
+
+// errors the receiver replies with a reject are not worth retrying
+type bulkRejected struct {
+	reason string
+}
+
+func (e *bulkRejected) Error() string {
+	return "rejected by the peer: " + e.reason
+}
+
+func newBulkOffer(name string, content []byte) *bulkOffer {
+	sum := sha256.Sum256(content)
+	offer := &bulkOffer{
+		Name:        name,
+		Size:        int64(len(content)),
+		ChunkSize:   bulkChunkSize,
+		Sha256:      hex.EncodeToString(sum[:]),
+		Compression: bulkCompression,
+	}
+	offer.ID = offer.expectedID()
+	return offer
+}
+
+// the id is derived from the name and the content, so sending the same content again resumes the transfer
+func (o *bulkOffer) expectedID() string {
+	sum := sha256.Sum256([]byte(o.Name + "|" + o.Sha256))
+	return hex.EncodeToString(sum[:16])
+}
+
+func (o *bulkOffer) chunks() int {
+	return int((o.Size + int64(o.ChunkSize) - 1) / int64(o.ChunkSize))
+}
+
+// size of the chunk with the given index, only the last one may be shorter
+func (o *bulkOffer) chunkLen(index int) int {
+	remaining := o.Size - int64(index)*int64(o.ChunkSize)
+	if remaining < int64(o.ChunkSize) {
+		return int(remaining)
+	}
+	return o.ChunkSize
+}
+
+func (o *bulkOffer) message() string {
+	data, _ := json.Marshal(o)
+	return "offer " + base64.StdEncoding.EncodeToString(data) + "\n"
+}
+
+func parseBulkOffer(command []string) (*bulkOffer, error) {
+	if len(command) != 2 {
+		return nil, errors.New("invalid offer format")
+	}
+	data, err := base64.StdEncoding.DecodeString(command[1])
+	if err != nil {
+		return nil, err
+	}
+	offer := &bulkOffer{}
+	if err = json.Unmarshal(data, offer); err != nil {
+		return nil, err
+	}
+
+	switch {
+	case !bulkName.MatchString(offer.Name) || strings.HasSuffix(offer.Name, bulkPartSuffix):
+		return nil, errors.New("invalid name")
+	case offer.Size <= 0 || offer.Size > bulkMaxSize:
+		return nil, fmt.Errorf("size must be between 1 and %d bytes", bulkMaxSize)
+	case offer.ChunkSize <= 0 || offer.ChunkSize > bulkMaxChunkSize:
+		return nil, fmt.Errorf("chunk size must be between 1 and %d bytes", bulkMaxChunkSize)
+	case offer.Compression != bulkCompression:
+		return nil, fmt.Errorf("unsupported compression %q", offer.Compression)
+	case len(offer.Sha256) != 2*sha256.Size:
+		return nil, errors.New("invalid checksum")
+	case offer.ID != offer.expectedID():
+		return nil, errors.New("id doesn't match the content")
+	}
+	return offer, nil
+}
+
+// the line carrying the chunk with the given index (including the trailing newline)
+func encodeChunk(offer *bulkOffer, content []byte, index int) (string, error) {
+	start := index * offer.ChunkSize
+	chunk := content[start : start+offer.chunkLen(index)]
+	sum := sha256.Sum256(chunk)
+
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	if _, err := writer.Write(chunk); err != nil {
+		return "", err
+	}
+	if err := writer.Close(); err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("chunk %d %s %s\n", index, hex.EncodeToString(sum[:]),
+		base64.StdEncoding.EncodeToString(compressed.Bytes())), nil
+}
+
+// decode the chunk line and check that it is the expected chunk, with the right size and checksum
+func decodeChunk(command []string, offer *bulkOffer, index int) ([]byte, error) {
+	if len(command) != 4 || command[0] != "chunk" {
+		return nil, errors.New("invalid chunk format")
+	}
+	if received, err := strconv.Atoi(command[1]); err != nil || received != index {
+		return nil, fmt.Errorf("expected chunk %d, got %s", index, command[1])
+	}
+	compressed, err := base64.StdEncoding.DecodeString(command[3])
+	if err != nil {
+		return nil, err
+	}
+	reader, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, err
+	}
+
+	// never decompress more than the chunk may have, in case the peer sends a compression bomb
+	expected := offer.chunkLen(index)
+	chunk, err := io.ReadAll(io.LimitReader(reader, int64(expected)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(chunk) != expected {
+		return nil, fmt.Errorf("chunk %d has %d bytes, expected %d", index, len(chunk), expected)
+	}
+	sum := sha256.Sum256(chunk)
+	if hex.EncodeToString(sum[:]) != command[2] {
+		return nil, fmt.Errorf("chunk %d has an invalid checksum", index)
+	}
+	return chunk, nil
+}
+
+// bulkStatus reports the state of a transfer to slips, progress at most once per bulkProgressInterval
+type bulkStatus struct {
+	schema.BulkTransfer
+	bus        database.Bus
+	lastReport time.Time
+}
+
+func newBulkStatus(bus database.Bus, offer *bulkOffer, peerId string, direction string) *bulkStatus {
+	return &bulkStatus{bus: bus, BulkTransfer: schema.BulkTransfer{
+		TransferID: offer.ID,
+		PeerID:     peerId,
+		Direction:  direction,
+		Name:       offer.Name,
+		Size:       offer.Size,
+		Sha256:     offer.Sha256,
+	}}
+}
+
+func (s *bulkStatus) progress(bytesDone int64) {
+	s.BytesDone = bytesDone
+	if time.Since(s.lastReport) < bulkProgressInterval {
+		return
+	}
+	s.lastReport = time.Now()
+	s.report(schema.BulkProgress)
+}
+
+func (s *bulkStatus) complete() {
+	s.BytesDone = s.Size
+	s.report(schema.BulkComplete)
+	fmt.Printf("[BULK] %s transfer %s (%s) with %s is complete\n", s.Direction, s.TransferID, s.Name, s.PeerID)
+}
+
+func (s *bulkStatus) fail(err error) {
+	s.Error = err.Error()
+	s.report(schema.BulkFailed)
+	fmt.Printf("[BULK] Transfer %s (%s) with %s failed - %s\n", s.TransferID, s.Name, s.PeerID, err)
+}
+
+func (s *bulkStatus) report(state string) {
+	s.State = state
+	s.Timestamp = time.Now().Unix()
+	ShareBulkTransfer(s.bus, &s.BulkTransfer)
+}
+
+// send the content of the scroll to the selected peers with the bulk transfer protocol
+func (p *Peer) sendBulkMessage(ps *schema.PigeonScroll) {
+	if ps.Encrypt {
+		fmt.Println("[BULK] Encrypted bulk transfers are not supported, not sending the message")
+		return
+	}
+
+	content := []byte(strings.TrimSuffix(ps.Message, "\n"))
+	offer := newBulkOffer(ps.Bulk.Name, content)
+	if offer.Size > bulkMaxSize {
+		fmt.Printf("[BULK] Content of %s is larger than %d bytes, not sending it\n", offer.Name, bulkMaxSize)
+		return
+	}
+
+	for _, peerData := range p.selectContacts(ps.AllRecipients(), ps.Selector, ps.Strategy) {
+		if caps, compatible := peerData.GetCapabilities(); !compatible || !caps.Has(FeatureBulk) {
+			fmt.Printf("[BULK] Peer %s doesn't accept bulk transfers, not sending %s to it\n", peerData.PeerID,
+				offer.Name)
+			continue
+		}
+		go p.sendBulk(peerData, offer, content)
+	}
+}
+
+// send the content to the peer, retry if the transfer is interrupted
+func (p *Peer) sendBulk(peerData *PeerData, offer *bulkOffer, content []byte) {
+	status := newBulkStatus(p.bus, offer, peerData.PeerID, schema.BulkOutgoing)
+
+	var err error
+	for attempt := 1; attempt <= bulkAttempts; attempt++ {
+		if err = p.sendBulkAttempt(peerData, offer, content, status); err == nil {
+			peerData.AddInteraction(InteractionBulk, OutcomeSuccess, 1, "sent "+offer.Name)
+			status.complete()
+			return
+		}
+		if _, rejected := err.(*bulkRejected); rejected || p.isClosing() {
+			break
+		}
+		fmt.Printf("[BULK] Sending %s to %s failed (attempt %d of %d) - %s\n", offer.Name, peerData.PeerID,
+			attempt, bulkAttempts, err)
+		time.Sleep(bulkRetryDelay)
+	}
+
+	peerData.AddInteraction(InteractionBulk, OutcomeFailure, 0, "sending "+offer.Name+" failed")
+	status.fail(err)
+}
+
+func (p *Peer) sendBulkAttempt(peerData *PeerData, offer *bulkOffer, content []byte, status *bulkStatus) error {
+	if p.isClosing() {
+		return errors.New("node is shutting down")
+	}
+
+	stream := p.openStreamFromPeerData(peerData, BulkChannel)
+	defer p.closeStream(stream)
+	if stream == nil {
+		return errors.New("opening stream failed")
+	}
+
+	rw := bufio.NewReadWriter(bufio.NewReader(stream), bufio.NewWriter(stream))
+	if !send2rw(rw, offer.message()) {
+		return errors.New("sending offer failed")
+	}
+
+	reply, err := readLine(stream, rw.Reader, limits[BulkChannel])
+	if err != nil {
+		return fmt.Errorf("no reply to the offer - %s", err)
+	}
+	command := strings.Fields(reply)
+	if len(command) > 0 && command[0] == "reject" {
+		return &bulkRejected{reason: strings.Join(command[1:], " ")}
+	}
+	if len(command) != 2 || command[0] != "accept" {
+		return fmt.Errorf("invalid reply to the offer: %s", reply)
+	}
+	next, err := strconv.Atoi(command[1])
+	if err != nil || next < 0 || next > offer.chunks() {
+		return fmt.Errorf("invalid reply to the offer: %s", reply)
+	}
+
+	for index := next; index < offer.chunks(); index++ {
+		line, err := encodeChunk(offer, content, index)
+		if err != nil {
+			return err
+		}
+		if !send2rw(rw, line) {
+			return fmt.Errorf("sending chunk %d failed", index)
+		}
+		status.progress(int64(index)*int64(offer.ChunkSize) + int64(offer.chunkLen(index)))
+	}
+
+	// the receiver checks the whole content before it confirms the transfer
+	reply, err = readLine(stream, rw.Reader, limits[BulkChannel])
+	if err != nil {
+		return fmt.Errorf("no confirmation of the transfer - %s", err)
+	}
+	if reply != "done" {
+		return fmt.Errorf("transfer not confirmed: %s", reply)
+	}
+	return nil
+}
+
+// handle messages of the bulk channel
+func (p *Peer) dispatchBulk(msg *inboundMessage) bool {
+	if msg.commands[0] != "offer" {
+		return false
+	}
+	p.receiveBulk(msg)
+	return true
+}
+
+// receive the offered content and store it to the bulk directory
+func (p *Peer) receiveBulk(msg *inboundMessage) {
+	peerData := msg.peerData
+	reply := func(line string) {
+		p.sendMessageToStream(msg.stream, line+"\n", 0)
+	}
+
+	if p.bulkDir == "" {
+		reply("reject disabled")
+		return
+	}
+	offer, err := parseBulkOffer(msg.commands)
+	if err != nil {
+		fmt.Printf("[BULK] Invalid offer from %s - %s\n", peerData.PeerID, err)
+		peerData.AddInteraction(InteractionBulk, OutcomeInvalid, 0, "invalid offer")
+		reply("reject invalid offer")
+		return
+	}
+
+	if reason := p.bulk.reserve(peerData.PeerID, offer); reason != "" {
+		reply("reject " + reason)
+		return
+	}
+	defer p.bulk.release(peerData.PeerID, offer)
+
+	status := newBulkStatus(p.bus, offer, peerData.PeerID, schema.BulkIncoming)
+	partFile := filepath.Join(p.bulkDir, bulkKey(peerData.PeerID, offer)+bulkPartSuffix)
+	file, next, err := openPartFile(partFile, offer)
+	if err != nil {
+		reply("reject internal error")
+		status.fail(err)
+		return
+	}
+	defer file.Close()
+
+	if next > 0 {
+		fmt.Printf("[BULK] Resuming transfer %s (%s) from %s at chunk %d\n", offer.ID, offer.Name, peerData.PeerID,
+			next)
+	}
+	reply(fmt.Sprintf("accept %d", next))
+
+	done := int64(next) * int64(offer.ChunkSize)
+	for index := next; index < offer.chunks(); index++ {
+		line, err := readLine(msg.stream, msg.reader, limits[BulkChannel])
+		if err != nil {
+			// the part file is kept, so the sender can resume the transfer (until it is older than the TTL)
+			status.fail(fmt.Errorf("connection lost - %s", err))
+			return
+		}
+		chunk, err := decodeChunk(strings.Fields(line), offer, index)
+		if err != nil {
+			peerData.AddInteraction(InteractionBulk, OutcomeInvalid, 0, "invalid chunk")
+			reply("failed invalid chunk")
+			status.fail(err)
+			return
+		}
+		if _, err = file.Write(chunk); err != nil {
+			reply("failed internal error")
+			status.fail(err)
+			return
+		}
+		done += int64(len(chunk))
+		status.progress(done)
+	}
+
+	// check the whole content, including chunks received in earlier attempts
+	if err = checkPartFile(file, offer); err != nil {
+		_ = os.Remove(partFile)
+		peerData.AddInteraction(InteractionBulk, OutcomeInvalid, 0, "checksum mismatch")
+		reply("failed checksum")
+		status.fail(err)
+		return
+	}
+
+	status.File = filepath.Join(p.bulkDir, fmt.Sprintf("%s-%s", offer.ID, offer.Name))
+	if err = os.Rename(partFile, status.File); err != nil {
+		reply("failed internal error")
+		status.File = ""
+		status.fail(err)
+		return
+	}
+
+	reply("done")
+	peerData.AddInteraction(InteractionBulk, OutcomeSuccess, 1, "received "+offer.Name)
+	status.complete()
+}
+
+// open the file with an unfinished transfer, or create it. Incomplete chunks at its end are dropped.
+// return int: index of the first missing chunk
+func openPartFile(path string, offer *bulkOffer) (*os.File, int, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, 0, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, 0, err
+	}
+
+	next := int(info.Size() / int64(offer.ChunkSize))
+	if next > offer.chunks() {
+		next = 0
+	}
+	offset := int64(next) * int64(offer.ChunkSize)
+	if err = file.Truncate(offset); err != nil {
+		file.Close()
+		return nil, 0, err
+	}
+	if _, err = file.Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		return nil, 0, err
+	}
+	return file, next, nil
+}
+
+func checkPartFile(file *os.File, offer *bulkOffer) error {
+	if err := file.Sync(); err != nil {
+		return err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return err
+	}
+	if hex.EncodeToString(hash.Sum(nil)) != offer.Sha256 {
+		return errors.New("checksum of the content doesn't match the offer")
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package peer
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/stratosphereips/p2p4slips/utils"
+)
+
+// how often unfinished transfers are checked for their age
+const bulkCleanupInterval = 10 * time.Minute
+
+// bulkStore limits what peers can store in the bulk directory. Content of all transfers, received and unfinished,
+// must fit the quota, and each peer can only have a few unfinished transfers. Unfinished transfers that are not
+// resumed in time are deleted.
+type bulkStore struct {
+	dir        string
+	quota      int64
+	maxPerPeer int
+	partTTL    time.Duration
+
+	mutex sync.Mutex
+	// incoming transfers in progress (peer id and transfer id), with the space reserved for them
+	active map[string]int64
+}
+
+func newBulkStore(cfg *utils.Config) *bulkStore {
+	return &bulkStore{
+		dir:        cfg.BulkDir,
+		quota:      cfg.BulkQuotaMB * 1024 * 1024,
+		maxPerPeer: cfg.BulkMaxPerPeer,
+		partTTL:    cfg.BulkPartTTL,
+		active:     make(map[string]int64),
+	}
+}
+
+// name of the part file of a transfer, without the suffix
+func bulkKey(peerId string, offer *bulkOffer) string {
+	return peerId + "-" + offer.ID
+}
+
+// reserve space for the whole content of the offer, before the transfer starts or resumes
+// return string: reason to reject the offer, empty if the space was reserved
+func (s *bulkStore) reserve(peerId string, offer *bulkOffer) string {
+	key := bulkKey(peerId, offer)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// the same transfer must not be written by two streams at once
+	if _, busy := s.active[key]; busy {
+		return "busy"
+	}
+
+	entries, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		fmt.Println("[BULK] Reading bulk transfer directory failed -", err)
+		return "internal error"
+	}
+
+	var used int64
+	unfinished := map[string]bool{}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		name := entry.Name()
+		if strings.HasSuffix(name, bulkPartSuffix) {
+			partKey := strings.TrimSuffix(name, bulkPartSuffix)
+			if strings.HasPrefix(partKey, peerId+"-") && partKey != key {
+				unfinished[partKey] = true
+			}
+			// transfers in progress and the resumed transfer are counted by their reservations
+			if _, ok := s.active[partKey]; ok || partKey == key {
+				continue
+			}
+		}
+		used += entry.Size()
+	}
+	for activeKey, reserved := range s.active {
+		if strings.HasPrefix(activeKey, peerId+"-") {
+			unfinished[activeKey] = true
+		}
+		used += reserved
+	}
+
+	if len(unfinished) >= s.maxPerPeer {
+		fmt.Printf("[BULK] Peer %s already has %d unfinished transfers, rejecting %s\n", peerId, len(unfinished),
+			offer.Name)
+		return "too many transfers"
+	}
+	if used+offer.Size > s.quota {
+		fmt.Printf("[BULK] %s (%d bytes) from %s doesn't fit the quota of the bulk directory, %d of %d bytes "+
+			"are used\n", offer.Name, offer.Size, peerId, used, s.quota)
+		return "quota exceeded"
+	}
+
+	s.active[key] = offer.Size
+	return ""
+}
+
+// the transfer ended, its content is now counted by the size of its file
+func (s *bulkStore) release(peerId string, offer *bulkOffer) {
+	s.mutex.Lock()
+	delete(s.active, bulkKey(peerId, offer))
+	s.mutex.Unlock()
+}
+
+// delete unfinished transfers that weren't written to for longer than the TTL
+func (s *bulkStore) removeStaleParts() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	entries, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		fmt.Println("[BULK] Reading bulk transfer directory failed -", err)
+		return
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, bulkPartSuffix) {
+			continue
+		}
+		if _, ok := s.active[strings.TrimSuffix(name, bulkPartSuffix)]; ok || time.Since(entry.ModTime()) < s.partTTL {
+			continue
+		}
+		if err = os.Remove(filepath.Join(s.dir, name)); err != nil {
+			fmt.Printf("[BULK] Removing unfinished transfer %s failed - %s\n", name, err)
+			continue
+		}
+		fmt.Printf("[BULK] Removed unfinished transfer %s, it wasn't resumed since %s\n", name,
+			entry.ModTime().Format(time.RFC3339))
+	}
+}
+
+// remove stale unfinished transfers periodically, until the node shuts down
+func (s *bulkStore) run(stopped chan struct{}) {
+	ticker := time.NewTicker(bulkCleanupInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopped:
+			return
+		case <-ticker.C:
+			s.removeStaleParts()
+		}
+	}
+}
@@ -0,0 +1,292 @@
+package peer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// the offer line, changed before it is encoded
+func offerCommand(offer bulkOffer, modify func(o *bulkOffer)) []string {
+	modify(&offer)
+	data, _ := json.Marshal(offer)
+	return []string{"offer", base64.StdEncoding.EncodeToString(data)}
+}
+
+func TestParseBulkOffer(t *testing.T) {
+	offer := *newBulkOffer("blocklist.txt", []byte("192.0.2.1\n192.0.2.2\n"))
+
+	tests := []struct {
+		name    string
+		command []string
+		valid   bool
+	}{
+		{"valid", offerCommand(offer, func(o *bulkOffer) {}), true},
+		{"small chunks", offerCommand(offer, func(o *bulkOffer) { o.ChunkSize = 1 }), true},
+		{"name with a path", offerCommand(offer, func(o *bulkOffer) {
+			o.Name = "../blocklist.txt"
+			o.ID = o.expectedID()
+		}), false},
+		{"name of a part file", offerCommand(offer, func(o *bulkOffer) {
+			o.Name = "blocklist" + bulkPartSuffix
+			o.ID = o.expectedID()
+		}), false},
+		{"empty", offerCommand(offer, func(o *bulkOffer) { o.Size = 0 }), false},
+		{"too large", offerCommand(offer, func(o *bulkOffer) { o.Size = bulkMaxSize + 1 }), false},
+		{"chunks too large", offerCommand(offer, func(o *bulkOffer) { o.ChunkSize = bulkMaxChunkSize + 1 }), false},
+		{"unknown compression", offerCommand(offer, func(o *bulkOffer) { o.Compression = "zstd" }), false},
+		{"short checksum", offerCommand(offer, func(o *bulkOffer) {
+			o.Sha256 = "abcd"
+			o.ID = o.expectedID()
+		}), false},
+		// the id decides the part file, another id would let the content overwrite a different transfer
+		{"id of other content", offerCommand(offer, func(o *bulkOffer) { o.ID = strings.Repeat("0", 32) }), false},
+		{"missing argument", []string{"offer"}, false},
+		{"not base64", []string{"offer", "!"}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := parseBulkOffer(test.command)
+			if valid := err == nil; valid != test.valid {
+				t.Errorf("valid %v, expected %v (%v)", valid, test.valid, err)
+			}
+		})
+	}
+}
+
+// gzip compress the data
+func compress(t *testing.T, data []byte) string {
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	if _, err := writer.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(compressed.Bytes())
+}
+
+func TestDecodeChunk(t *testing.T) {
+	content := []byte("0123456789")
+	offer := newBulkOffer("numbers", content)
+	offer.ChunkSize = 4
+
+	// the fields of the line carrying the chunk
+	chunk := func(index int) []string {
+		line, err := encodeChunk(offer, content, index)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.Fields(line)
+	}
+
+	tests := []struct {
+		name     string
+		command  []string
+		index    int
+		expected string // empty if the chunk is rejected
+	}{
+		{"first chunk", chunk(0), 0, "0123"},
+		{"last chunk is shorter", chunk(2), 2, "89"},
+		{"unexpected index", chunk(1), 0, ""},
+		{"checksum changed", func() []string {
+			c := chunk(0)
+			c[2] = strings.Repeat("0", 64)
+			return c
+		}(), 0, ""},
+		{"content changed", func() []string {
+			c := chunk(0)
+			c[3] = compress(t, []byte("3210"))
+			return c
+		}(), 0, ""},
+		// a peer must not make the receiver decompress more than the chunk can have
+		{"compression bomb", func() []string {
+			c := chunk(0)
+			c[3] = compress(t, make([]byte, 10*1024*1024))
+			return c
+		}(), 0, ""},
+		{"not compressed", func() []string {
+			c := chunk(0)
+			c[3] = base64.StdEncoding.EncodeToString([]byte("0123"))
+			return c
+		}(), 0, ""},
+		{"missing field", chunk(0)[:3], 0, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			decoded, err := decodeChunk(test.command, offer, test.index)
+			if test.expected == "" {
+				if err == nil {
+					t.Errorf("chunk %q was accepted", decoded)
+				}
+				return
+			}
+			if err != nil || string(decoded) != test.expected {
+				t.Errorf("decoded %q (%v), expected %q", decoded, err, test.expected)
+			}
+		})
+	}
+}
+
+// a resumed transfer continues after the last complete chunk
+func TestOpenPartFile(t *testing.T) {
+	offer := newBulkOffer("numbers", []byte("0123456789"))
+	offer.ChunkSize = 4
+
+	tests := []struct {
+		name    string
+		written string
+		next    int
+	}{
+		{"new transfer", "", 0},
+		{"incomplete first chunk", "01", 0},
+		{"one chunk", "0123", 1},
+		{"incomplete second chunk", "012345", 1},
+		{"all chunks", "0123456789", 2},
+		{"longer than the content", "0123456789abcdef", 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "numbers"+bulkPartSuffix)
+			if test.written != "" {
+				if err := ioutil.WriteFile(path, []byte(test.written), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			file, next, err := openPartFile(path, offer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer file.Close()
+			if next != test.next {
+				t.Errorf("transfer continues at chunk %d, expected %d", next, test.next)
+			}
+			if info, _ := file.Stat(); info.Size() != int64(next*offer.ChunkSize) {
+				t.Errorf("part file has %d bytes, expected %d", info.Size(), next*offer.ChunkSize)
+			}
+		})
+	}
+}
+
+// offer of the given size, with a content unique to the name
+func sizedOffer(name string, size int64) *bulkOffer {
+	offer := newBulkOffer(name, []byte(name))
+	offer.Size = size
+	return offer
+}
+
+func TestBulkStoreReserve(t *testing.T) {
+	dir := t.TempDir()
+	store := &bulkStore{dir: dir, quota: 1000, maxPerPeer: 2, partTTL: time.Hour, active: map[string]int64{}}
+	write := func(name string, size int) {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), make([]byte, size), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 300 bytes of received content, and an unfinished transfer of a with 100 bytes
+	write("received.txt", 300)
+	unfinished := sizedOffer("unfinished", 400)
+	write(bulkKey("a", unfinished)+bulkPartSuffix, 100)
+
+	steps := []struct {
+		name   string
+		peer   string
+		offer  *bulkOffer
+		reason string
+	}{
+		{"fits the quota", "b", sizedOffer("first", 200), ""},
+		{"same transfer twice", "b", sizedOffer("first", 200), "busy"},
+		// 300 received, 100 unfinished and 200 reserved
+		{"exceeds the quota", "c", sizedOffer("large", 401), "quota exceeded"},
+		{"fills the quota", "c", sizedOffer("fits", 400), ""},
+		// the resumed transfer is counted by its reservation, not by the part file
+		{"resume over the quota", "a", unfinished, "quota exceeded"},
+		{"a full quota takes nothing more", "b", sizedOffer("second", 1), "quota exceeded"},
+	}
+	for _, step := range steps {
+		if reason := store.reserve(step.peer, step.offer); reason != step.reason {
+			t.Fatalf("%s: reserve returned %q, expected %q", step.name, reason, step.reason)
+		}
+	}
+
+	// once transfers end, only their files count
+	store.release("c", sizedOffer("fits", 400))
+	store.release("b", sizedOffer("first", 200))
+	if reason := store.reserve("a", unfinished); reason != "" {
+		t.Fatalf("resuming the unfinished transfer was rejected - %s", reason)
+	}
+	store.release("a", unfinished)
+
+	// two unfinished transfers of b are the limit
+	write(bulkKey("b", sizedOffer("first", 200))+bulkPartSuffix, 10)
+	write(bulkKey("b", sizedOffer("second", 10))+bulkPartSuffix, 10)
+	if reason := store.reserve("b", sizedOffer("third", 10)); reason != "too many transfers" {
+		t.Errorf("third transfer of b: reserve returned %q", reason)
+	}
+	if reason := store.reserve("b", sizedOffer("second", 10)); reason != "" {
+		t.Errorf("resuming a transfer of b was rejected - %s", reason)
+	}
+}
+
+func TestRemoveStaleParts(t *testing.T) {
+	dir := t.TempDir()
+	store := &bulkStore{dir: dir, quota: 1000, maxPerPeer: 2, partTTL: time.Hour, active: map[string]int64{}}
+	old := time.Now().Add(-2 * time.Hour)
+
+	busy := sizedOffer("busy", 10)
+	if reason := store.reserve("a", busy); reason != "" {
+		t.Fatal(reason)
+	}
+	files := map[string]bool{
+		"stale" + bulkPartSuffix:            false,
+		"fresh" + bulkPartSuffix:            true,
+		"received.txt":                      true,
+		bulkKey("a", busy) + bulkPartSuffix: true,
+	}
+	for name := range files {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte("data"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if name != "fresh"+bulkPartSuffix {
+			if err := os.Chtimes(path, old, old); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	store.removeStaleParts()
+	for name, kept := range files {
+		_, err := os.Stat(filepath.Join(dir, name))
+		if exists := err == nil; exists != kept {
+			t.Errorf("%s exists %v, expected %v", name, exists, kept)
+		}
+	}
+}
+
+// chunk lengths add up to the size of the offer
+func TestBulkOfferChunks(t *testing.T) {
+	for _, size := range []int64{1, 3, 4, 5, 8, 9} {
+		offer := &bulkOffer{Size: size, ChunkSize: 4}
+		total := int64(0)
+		for i := 0; i < offer.chunks(); i++ {
+			total += int64(offer.chunkLen(i))
+		}
+		if total != size {
+			t.Errorf("chunks of %d bytes add up to %d", size, total)
+		}
+	}
+}
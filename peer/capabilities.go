@@ -0,0 +1,153 @@
+package peer
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/libp2p/go-libp2p-core/network"
+)
+
+// Capabilities are advertised by peers during the handshake
+// Versions are the protocol versions the peer speaks, features are optional message formats it understands.
+type Capabilities struct {
+	Versions []int    `json:"versions"`
+	Features []string `json:"features"`
+}
+
+// optional features
+const (
+	// slips messages are wrapped in a signed envelope
+	FeatureSigning = "signing"
+	// slips messages can be encrypted to the key of the recipient
+	FeatureEncryption = "encryption"
+	// the peer accepts bulk transfers
+	FeatureBulk = "bulk"
+	// data messages can be compressed with snappy
+	FeatureCompression = "snappy"
+)
+
+// Protocol versions:
+// 1 - plain text hello, ping, goodbye, slips messages forwarded verbatim
+// 2 - capabilities are exchanged after hello
+const helloVersion = "version2"
+
+// capabilities of this node
+var localCapabilities = Capabilities{
+	Versions: []int{1, 2},
+	Features: []string{FeatureSigning, FeatureEncryption},
+}
+
+// capabilities assumed for peers that announce version 1 in their hello, they don't know the capabilities message
+var legacyCapabilities = Capabilities{Versions: []int{1}}
+
+// Has checks if the feature is supported
+func (c *Capabilities) Has(feature string) bool {
+	if c == nil {
+		return false
+	}
+	for _, f := range c.Features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// pick the highest protocol version supported by both sides
+// return int: the version, 0 if there is no common version
+func negotiateVersion(local Capabilities, remote Capabilities) int {
+	best := 0
+	for _, l := range local.Versions {
+		for _, r := range remote.Versions {
+			if l == r && l > best {
+				best = l
+			}
+		}
+	}
+	return best
+}
+
+// capabilities of this node, including the features that depend on its configuration
+func (p *Peer) capabilities() Capabilities {
+	caps := Capabilities{
+		Versions: localCapabilities.Versions,
+		Features: append([]string{}, localCapabilities.Features...),
+	}
+	if p.bulkDir != "" {
+		caps.Features = append(caps.Features, FeatureBulk)
+	}
+	if p.compression {
+		caps.Features = append(caps.Features, FeatureCompression)
+	}
+	return caps
+}
+
+// the line carrying capabilities of this node (including the trailing newline)
+func (p *Peer) capabilitiesMessage() string {
+	data, _ := json.Marshal(p.capabilities())
+	return "capabilities " + base64.StdEncoding.EncodeToString(data) + "\n"
+}
+
+func parseCapabilities(command []string) (*Capabilities, bool) {
+	if len(command) != 2 || command[0] != "capabilities" {
+		return nil, false
+	}
+	data, err := base64.StdEncoding.DecodeString(command[1])
+	if err != nil {
+		return nil, false
+	}
+	caps := &Capabilities{}
+	if err = json.Unmarshal(data, caps); err != nil || len(caps.Versions) == 0 {
+		return nil, false
+	}
+	return caps, true
+}
+
+// after a hello, exchange capabilities with peers that support it, and assume legacy capabilities for the rest
+func (p *Peer) exchangeCapabilities(peerData *PeerData, remoteVersion string) {
+	if version, ok := parseVersion(remoteVersion); ok && version < 2 {
+		peerData.SetCapabilities(&legacyCapabilities, negotiateVersion(localCapabilities, legacyCapabilities))
+		return
+	}
+
+	response, ok := p.sendMessageToPeerData(peerData, ControlChannel, p.capabilitiesMessage(), p.pingConfig.Timeout)
+	if !ok {
+		return
+	}
+
+	caps, ok := parseCapabilities(strings.Fields(response))
+	if !ok {
+		fmt.Println("[CAPABILITIES] Peer sent invalid capabilities reply")
+		peerData.AddInteraction(InteractionCapabilities, OutcomeInvalid, 0, "invalid capabilities reply")
+		return
+	}
+	p.storeCapabilities(peerData, caps)
+}
+
+// store the capabilities announced by the peer and reply with capabilities of this node
+func (p *Peer) handleCapabilities(remotePeerData *PeerData, stream network.Stream, command *[]string) {
+	caps, ok := parseCapabilities(*command)
+	if !ok {
+		fmt.Println("[CAPABILITIES] Invalid capabilities format")
+		remotePeerData.AddInteraction(InteractionCapabilities, OutcomeInvalid, 0, "invalid capabilities format")
+		return
+	}
+
+	if _, ok = p.sendMessageToStream(stream, p.capabilitiesMessage(), 0); !ok {
+		fmt.Println("[CAPABILITIES] Something went wrong when sending capabilities reply")
+		remotePeerData.AddInteraction(InteractionCapabilities, OutcomeFailure, 0, "sending capabilities reply failed")
+		return
+	}
+	p.storeCapabilities(remotePeerData, caps)
+}
+
+func (p *Peer) storeCapabilities(peerData *PeerData, caps *Capabilities) {
+	version := negotiateVersion(localCapabilities, *caps)
+	if version == 0 {
+		fmt.Printf("[CAPABILITIES] Peer %s is incompatible, it supports protocol versions %v\n", peerData.PeerID,
+			caps.Versions)
+	}
+	peerData.SetCapabilities(caps, version)
+}
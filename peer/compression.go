@@ -0,0 +1,90 @@
+package peer
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/golang/snappy"
+	"github.com/stratosphereips/p2p4slips/metrics"
+)
+
+// Data messages to peers with the compression feature are sent as
+// compressed <command> <base64 of the snappy compressed argument>
+// where the argument is the base64 field of the original message, decoded before compression. Generic messages
+// (a single base64 field) use - as the command. Messages are only compressed if it makes them shorter.
+const genericCommand = "-"
+
+// compress the line if it is worth it
+// return string: the line to send, including the trailing newline
+func compressLine(line string) string {
+	fields := strings.Fields(line)
+	var command, argument string
+	switch len(fields) {
+	case 1:
+		command, argument = genericCommand, fields[0]
+	case 2:
+		command, argument = fields[0], fields[1]
+	default:
+		return line
+	}
+
+	data, err := base64.StdEncoding.DecodeString(argument)
+	if err != nil {
+		return line
+	}
+	compressed := "compressed " + command + " " + base64.StdEncoding.EncodeToString(snappy.Encode(nil, data)) + "\n"
+	if len(compressed) >= len(line) {
+		return line
+	}
+	return compressed
+}
+
+// restore the original line from a compressed message
+// maxSize: longest allowed line after decompression
+// return string: the original line without the trailing newline
+func decompressLine(command []string, maxSize int) (string, error) {
+	if len(command) != 3 || command[1] == "compressed" {
+		return "", errors.New("invalid compressed message format")
+	}
+	data, err := base64.StdEncoding.DecodeString(command[2])
+	if err != nil {
+		return "", err
+	}
+
+	// check the size before decompressing, in case the peer sends a compression bomb
+	size, err := snappy.DecodedLen(data)
+	if err != nil {
+		return "", err
+	}
+	if base64.StdEncoding.EncodedLen(size)+len(command[1])+1 > maxSize {
+		return "", fmt.Errorf("decompressed message would be longer than %d bytes", maxSize)
+	}
+	decoded, err := snappy.Decode(nil, data)
+	if err != nil {
+		return "", err
+	}
+
+	line := base64.StdEncoding.EncodeToString(decoded)
+	if command[1] != genericCommand {
+		line = command[1] + " " + line
+	}
+	metrics.RecordReceivedCompression(len(strings.Join(command, " "))+1, len(line)+1)
+	return line, nil
+}
+
+// decompress the message and handle the original one
+func (p *Peer) handleCompressedMessage(msg *inboundMessage) {
+	line, err := decompressLine(msg.commands, limits[DataChannel].maxMessageSize)
+	if err != nil {
+		fmt.Printf("[COMPRESSION] Message from %s could not be decompressed - %s\n", msg.peerData.PeerID, err)
+		msg.peerData.AddInteraction(InteractionMessage, OutcomeInvalid, 0, "decompression failed: "+err.Error())
+		return
+	}
+
+	original := *msg
+	original.text = line
+	original.commands = strings.Fields(line)
+	p.dispatchData(&original)
+}
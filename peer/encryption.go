@@ -0,0 +1,267 @@
+package peer
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+// EncryptedPayload is a slips payload readable only by the owner of the recipient's private key
+// For Ed25519 and ECDSA keys, an ephemeral key is agreed with the recipient's key (ECDH) and the shared secret is
+// expanded by HKDF. For RSA keys, a random content key is encrypted with RSA-OAEP. The payload itself is AES-GCM.
+type EncryptedPayload struct {
+	Scheme       string `json:"scheme"`
+	EphemeralKey []byte `json:"ephemeral_key,omitempty"`
+	WrappedKey   []byte `json:"wrapped_key,omitempty"`
+	Nonce        []byte `json:"nonce"`
+	Ciphertext   []byte `json:"ciphertext"`
+}
+
+const (
+	schemeX25519 = "x25519-hkdf-aes256gcm"
+	schemeP256   = "p256-hkdf-aes256gcm"
+	schemeRSA    = "rsa-oaep-aes256gcm"
+)
+
+var hkdfInfo = []byte("p2p4slips encryption")
+
+// Encrypt the payload to the public key of the recipient
+// return string: base64 encoded EncryptedPayload
+func encryptPayload(payload string, recipient crypto.PubKey) (string, error) {
+	stdKey, err := crypto.PubKeyToStdKey(recipient)
+	if err != nil {
+		return "", err
+	}
+
+	ep := &EncryptedPayload{}
+	var contentKey []byte
+
+	switch key := stdKey.(type) {
+	case ed25519.PublicKey:
+		raw, err := recipient.Raw()
+		if err != nil {
+			return "", err
+		}
+		recipientX, err := ed25519PublicToX25519(raw)
+		if err != nil {
+			return "", err
+		}
+		ephemeral := make([]byte, curve25519.ScalarSize)
+		if _, err = rand.Read(ephemeral); err != nil {
+			return "", err
+		}
+		if ep.EphemeralKey, err = curve25519.X25519(ephemeral, curve25519.Basepoint); err != nil {
+			return "", err
+		}
+		shared, err := curve25519.X25519(ephemeral, recipientX)
+		if err != nil {
+			return "", err
+		}
+		ep.Scheme = schemeX25519
+		contentKey, err = deriveKey(shared, ep.EphemeralKey, recipientX)
+		if err != nil {
+			return "", err
+		}
+	case *ecdsa.PublicKey:
+		if key.Curve != elliptic.P256() {
+			return "", errors.New("only P-256 ECDSA keys can be used for encryption")
+		}
+		ephemeral, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return "", err
+		}
+		ep.EphemeralKey = elliptic.Marshal(elliptic.P256(), ephemeral.X, ephemeral.Y)
+		sharedX, _ := elliptic.P256().ScalarMult(key.X, key.Y, ephemeral.D.Bytes())
+		ep.Scheme = schemeP256
+		contentKey, err = deriveKey(sharedX.Bytes(), ep.EphemeralKey, elliptic.Marshal(key.Curve, key.X, key.Y))
+		if err != nil {
+			return "", err
+		}
+	case *rsa.PublicKey:
+		contentKey = make([]byte, 32)
+		if _, err = rand.Read(contentKey); err != nil {
+			return "", err
+		}
+		if ep.WrappedKey, err = rsa.EncryptOAEP(sha256.New(), rand.Reader, key, contentKey, hkdfInfo); err != nil {
+			return "", err
+		}
+		ep.Scheme = schemeRSA
+	default:
+		return "", fmt.Errorf("keys of type %T can't be used for encryption", stdKey)
+	}
+
+	aead, err := newAead(contentKey)
+	if err != nil {
+		return "", err
+	}
+	ep.Nonce = make([]byte, aead.NonceSize())
+	if _, err = rand.Read(ep.Nonce); err != nil {
+		return "", err
+	}
+	ep.Ciphertext = aead.Seal(nil, ep.Nonce, []byte(payload), []byte(ep.Scheme))
+
+	data, err := json.Marshal(ep)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(data), nil
+}
+
+// Decrypt a payload encrypted to the key of this node. The payload must come from an envelope with a verified
+// signature, and errors must be penalized like an invalid signature (see Peer.handleSignedMessage)
+func decryptPayload(encoded string, key crypto.PrivKey) (string, error) {
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", err
+	}
+	ep := &EncryptedPayload{}
+	if err = json.Unmarshal(data, ep); err != nil {
+		return "", err
+	}
+
+	var contentKey []byte
+	switch ep.Scheme {
+	case schemeX25519:
+		if key.Type() != crypto.Ed25519 {
+			return "", errors.New("payload was encrypted for a different key type")
+		}
+		raw, err := key.Raw()
+		if err != nil {
+			return "", err
+		}
+		scalar := ed25519PrivateToX25519(raw)
+		shared, err := curve25519.X25519(scalar, ep.EphemeralKey)
+		if err != nil {
+			return "", err
+		}
+		ownX, err := curve25519.X25519(scalar, curve25519.Basepoint)
+		if err != nil {
+			return "", err
+		}
+		if contentKey, err = deriveKey(shared, ep.EphemeralKey, ownX); err != nil {
+			return "", err
+		}
+	case schemeP256:
+		stdKey, err := crypto.PrivKeyToStdKey(key)
+		if err != nil {
+			return "", err
+		}
+		own, ok := stdKey.(*ecdsa.PrivateKey)
+		if !ok || own.Curve != elliptic.P256() {
+			return "", errors.New("payload was encrypted for a different key type")
+		}
+		x, y := elliptic.Unmarshal(elliptic.P256(), ep.EphemeralKey)
+		if x == nil {
+			return "", errors.New("invalid ephemeral key")
+		}
+		sharedX, _ := elliptic.P256().ScalarMult(x, y, own.D.Bytes())
+		ownPublic := elliptic.Marshal(elliptic.P256(), own.X, own.Y)
+		if contentKey, err = deriveKey(sharedX.Bytes(), ep.EphemeralKey, ownPublic); err != nil {
+			return "", err
+		}
+	case schemeRSA:
+		stdKey, err := crypto.PrivKeyToStdKey(key)
+		if err != nil {
+			return "", err
+		}
+		own, ok := stdKey.(*rsa.PrivateKey)
+		if !ok {
+			return "", errors.New("payload was encrypted for a different key type")
+		}
+		if contentKey, err = rsa.DecryptOAEP(sha256.New(), rand.Reader, own, ep.WrappedKey, hkdfInfo); err != nil {
+			return "", err
+		}
+	default:
+		return "", fmt.Errorf("unknown encryption scheme '%s'", ep.Scheme)
+	}
+
+	aead, err := newAead(contentKey)
+	if err != nil {
+		return "", err
+	}
+	if len(ep.Nonce) != aead.NonceSize() {
+		return "", errors.New("invalid nonce")
+	}
+	plain, err := aead.Open(nil, ep.Nonce, ep.Ciphertext, []byte(ep.Scheme))
+	if err != nil {
+		return "", errors.New("payload could not be decrypted")
+	}
+	return string(plain), nil
+}
+
+// expand the shared secret to an AES key, bound to both public keys
+func deriveKey(shared []byte, ephemeralPublic []byte, recipientPublic []byte) ([]byte, error) {
+	salt := append(append([]byte(nil), ephemeralPublic...), recipientPublic...)
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, shared, salt, hkdfInfo), key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func newAead(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// field prime of curve25519, 2^255 - 19
+var curve25519P, _ = new(big.Int).SetString("7fffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffed", 16)
+
+// convert an Ed25519 public key to the X25519 key of the same key pair: u = (1 + y) / (1 - y) mod p
+func ed25519PublicToX25519(public []byte) ([]byte, error) {
+	if len(public) != ed25519.PublicKeySize {
+		return nil, errors.New("invalid Ed25519 public key")
+	}
+
+	// the encoding is little endian y, with the sign of x in the top bit
+	le := append([]byte(nil), public...)
+	le[31] &= 0x7f
+	y := new(big.Int).SetBytes(reverse(le))
+
+	one := big.NewInt(1)
+	denominator := new(big.Int).Sub(one, y)
+	denominator.Mod(denominator, curve25519P)
+	if denominator.Sign() == 0 {
+		return nil, errors.New("invalid Ed25519 public key")
+	}
+	u := new(big.Int).Add(one, y)
+	u.Mul(u, new(big.Int).ModInverse(denominator, curve25519P))
+	u.Mod(u, curve25519P)
+
+	out := make([]byte, 32)
+	u.FillBytes(out)
+	return reverse(out), nil
+}
+
+// convert an Ed25519 private key (seed followed by the public key) to its X25519 scalar
+// curve25519.X25519 clamps the scalar, so the first half of the hashed seed can be used directly
+func ed25519PrivateToX25519(private []byte) []byte {
+	digest := sha512.Sum512(private[:ed25519.SeedSize])
+	return digest[:32]
+}
+
+func reverse(b []byte) []byte {
+	for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+		b[i], b[j] = b[j], b[i]
+	}
+	return b
+}
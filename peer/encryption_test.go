@@ -0,0 +1,140 @@
+package peer
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+
+	"github.com/libp2p/go-libp2p-core/crypto"
+)
+
+// generate a key of the given libp2p type
+func generateKey(t *testing.T, keyType int) crypto.PrivKey {
+	key, _, err := crypto.GenerateKeyPairWithReader(keyType, 2048, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// change the encrypted payload after encryption
+func modifyPayload(t *testing.T, encoded string, modify func(ep *EncryptedPayload)) string {
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ep := &EncryptedPayload{}
+	if err = json.Unmarshal(data, ep); err != nil {
+		t.Fatal(err)
+	}
+	modify(ep)
+	if data, err = json.Marshal(ep); err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(data)
+}
+
+func TestEncryptionRoundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		keyType int
+		scheme  string
+	}{
+		{"ed25519", crypto.Ed25519, schemeX25519},
+		{"ecdsa", crypto.ECDSA, schemeP256},
+		{"rsa", crypto.RSA, schemeRSA},
+	}
+
+	payload := base64.StdEncoding.EncodeToString([]byte(`{"ip": "192.0.2.1", "score": 0.9}`))
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			key := generateKey(t, test.keyType)
+			encrypted, err := encryptPayload(payload, key.GetPublic())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			scheme := ""
+			modifyPayload(t, encrypted, func(ep *EncryptedPayload) { scheme = ep.Scheme })
+			if scheme != test.scheme {
+				t.Errorf("scheme %s, expected %s", scheme, test.scheme)
+			}
+
+			plain, err := decryptPayload(encrypted, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if plain != payload {
+				t.Errorf("decrypted %q, expected %q", plain, payload)
+			}
+		})
+	}
+}
+
+// a payload can only be read with the key of its recipient, and any change to it is detected
+func TestDecryptionFailures(t *testing.T) {
+	keys := map[int]crypto.PrivKey{}
+	for _, keyType := range []int{crypto.Ed25519, crypto.ECDSA, crypto.RSA} {
+		keys[keyType] = generateKey(t, keyType)
+	}
+
+	tests := []struct {
+		name      string
+		keyType   int
+		decryptor crypto.PrivKey // nil decrypts with a new key of the same type
+		modify    func(ep *EncryptedPayload)
+	}{
+		{"ed25519 other key", crypto.Ed25519, nil, nil},
+		{"ecdsa other key", crypto.ECDSA, nil, nil},
+		{"rsa other key", crypto.RSA, nil, nil},
+		{"ed25519 to ecdsa key", crypto.Ed25519, keys[crypto.ECDSA], nil},
+		{"ecdsa to rsa key", crypto.ECDSA, keys[crypto.RSA], nil},
+		{"rsa to ed25519 key", crypto.RSA, keys[crypto.Ed25519], nil},
+		{"ed25519 ciphertext changed", crypto.Ed25519, keys[crypto.Ed25519],
+			func(ep *EncryptedPayload) { ep.Ciphertext[0] ^= 1 }},
+		{"ecdsa ciphertext changed", crypto.ECDSA, keys[crypto.ECDSA],
+			func(ep *EncryptedPayload) { ep.Ciphertext[0] ^= 1 }},
+		{"rsa ciphertext changed", crypto.RSA, keys[crypto.RSA],
+			func(ep *EncryptedPayload) { ep.Ciphertext[0] ^= 1 }},
+		{"ephemeral key changed", crypto.Ed25519, keys[crypto.Ed25519],
+			func(ep *EncryptedPayload) { ep.EphemeralKey[0] ^= 1 }},
+		{"ephemeral key not on the curve", crypto.ECDSA, keys[crypto.ECDSA],
+			func(ep *EncryptedPayload) { ep.EphemeralKey[1] ^= 1 }},
+		{"wrapped key changed", crypto.RSA, keys[crypto.RSA],
+			func(ep *EncryptedPayload) { ep.WrappedKey[0] ^= 1 }},
+		{"nonce changed", crypto.Ed25519, keys[crypto.Ed25519], func(ep *EncryptedPayload) { ep.Nonce[0] ^= 1 }},
+		{"nonce too short", crypto.Ed25519, keys[crypto.Ed25519],
+			func(ep *EncryptedPayload) { ep.Nonce = ep.Nonce[1:] }},
+		{"scheme changed", crypto.ECDSA, keys[crypto.ECDSA], func(ep *EncryptedPayload) { ep.Scheme = schemeRSA }},
+		{"unknown scheme", crypto.Ed25519, keys[crypto.Ed25519], func(ep *EncryptedPayload) { ep.Scheme = "none" }},
+	}
+
+	payload := base64.StdEncoding.EncodeToString([]byte(`{"ip": "192.0.2.2", "score": 0.1}`))
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			encrypted, err := encryptPayload(payload, keys[test.keyType].GetPublic())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.modify != nil {
+				encrypted = modifyPayload(t, encrypted, test.modify)
+			}
+			decryptor := test.decryptor
+			if decryptor == nil {
+				decryptor = generateKey(t, test.keyType)
+			}
+
+			if plain, err := decryptPayload(encrypted, decryptor); err == nil {
+				t.Errorf("payload was decrypted to %q", plain)
+			}
+		})
+	}
+}
+
+func TestEncryptionUnsupportedKey(t *testing.T) {
+	key := generateKey(t, crypto.Secp256k1)
+	if _, err := encryptPayload("cGF5bG9hZA==", key.GetPublic()); err == nil {
+		t.Error("payload was encrypted to a secp256k1 key")
+	}
+}
@@ -1,84 +1,50 @@
 package peer
 
 import (
-	"encoding/json"
 	"fmt"
 	"time"
 
 	"github.com/stratosphereips/p2p4slips/database"
+	"github.com/stratosphereips/p2p4slips/schema"
 )
 
-type PeerUpdateStruct struct {
-	PeerID      string  `json:"peerid"`
-	Ip          string  `json:"ip,omitempty"`
-	Reliability float64 `json:"reliability,omitempty"`
-	Timestamp   int64   `json:"timestamp"`
-	// `json...` makes the properties to parse correctly when using json.Marshal
-}
-
-type ReportStruct struct {
-	Reporter  string `json:"reporter"`
-	ReportTme int64  `json:"report_time"`
-	Message   string `json:"message"`
-}
-
-type UpdateMessage struct {
-	MessageType     string           `json:"message_type"`
-	MessageContents PeerUpdateStruct `json:"message_contents"`
-}
-
-type ReportMessage struct {
-	MessageType     string       `json:"message_type"`
-	MessageContents ReportStruct `json:"message_contents"`
-}
-
-func (p *UpdateMessage) pdu2json() string {
-	byteData, err := json.Marshal(p)
-	data := string(byteData)
-	if err != nil {
-		fmt.Println(err)
+// validate the message against its schema and publish it to slips. Invalid messages are not sent
+// Without a bus (for example in the export and import tools) nothing is sent
+func shareWithSlips(bus database.Bus, message *schema.Message) {
+	if bus == nil {
+		return
 	}
-	//fmt.Println(data)
-	return data
-}
-
-func (p *ReportMessage) pdu2json() string {
-	byteData, err := json.Marshal(p)
-	data := string(byteData)
+	data, err := message.Encode()
 	if err != nil {
-		fmt.Println(err)
+		fmt.Printf("[SCHEMA] Invalid %s message, not sending it to slips - %s\n", message.MessageType, err)
+		return
 	}
-	//fmt.Println(data)
-	return data
+
+	bus.SendStringToChannel(string(data))
 }
 
-func ShareReport(data *ReportStruct) {
-	pdum := &ReportMessage{
-		MessageType:     "go_data",
-		MessageContents: *data,
+func ShareReport(bus database.Bus, data *schema.Report) {
+	if data.ReportID == "" {
+		data.ReportID = newReportID()
 	}
+	shareWithSlips(bus, schema.NewReport(*data))
+}
 
-	strJson := pdum.pdu2json()
-
-	database.DBW.SendStringToChannel(strJson)
+func ShareBulkTransfer(bus database.Bus, data *schema.BulkTransfer) {
+	shareWithSlips(bus, schema.NewBulkTransfer(*data))
 }
 
 func SharePeerDataUpdate(data *PeerData) {
-	peerID := data.PeerID
-	ip := data.LastUsedIP
-	reliability := data.Reliability
-
-	pdum := &UpdateMessage{
-		MessageType: "peer_update",
-		MessageContents: PeerUpdateStruct{
-			PeerID:      peerID,
-			Ip:          ip,
-			Reliability: reliability,
-			Timestamp:   time.Now().Unix(),
-		},
+	update := schema.PeerUpdate{
+		PeerID:        data.PeerID,
+		Ip:            data.LastUsedIP,
+		Reliability:   data.Reliability,
+		Timestamp:     time.Now().Unix(),
+		Latency:       data.latencySummary(),
+		ReportQuality: data.reportQuality(),
+		Trust:         data.Trust(),
 	}
+	data.addCapabilities(&update)
 
-	strJson := pdum.pdu2json()
-
-	database.DBW.SendStringToChannel(strJson)
+	shareWithSlips(data.bus, schema.NewPeerUpdate(update))
 }
@@ -0,0 +1,154 @@
+package peer
+
+import (
+	"encoding/base64"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/event"
+	"github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+	"github.com/stratosphereips/p2p4slips/schema"
+)
+
+// how often the addresses are checked, in case libp2p didn't announce a change
+const identityCheckInterval = time.Minute
+
+// remembers the addresses that were published last, so the identity is only sent again when they change
+type identityWatch struct {
+	mutex     sync.Mutex
+	published string
+}
+
+// Identity describes this node: its keys, addresses and protocols
+func (p *Peer) Identity() schema.Identity {
+	identity := schema.Identity{
+		PeerID:            p.ID(),
+		KeyType:           strings.ToLower(p.privKey.Type().String()),
+		ListenAddresses:   []string{},
+		ObservedAddresses: []string{},
+		Protocols:         []string{},
+		StartTime:         p.startTime.Unix(),
+		Timestamp:         time.Now().Unix(),
+	}
+	if publicKey, err := crypto.MarshalPublicKey(p.privKey.GetPublic()); err == nil {
+		identity.PublicKey = base64.StdEncoding.EncodeToString(publicKey)
+	}
+	for _, version := range localCapabilities.Versions {
+		if version > identity.ProtocolVersion {
+			identity.ProtocolVersion = version
+		}
+	}
+	identity.Protocols = append(identity.Protocols, p.host.Mux().Protocols()...)
+	sort.Strings(identity.Protocols)
+
+	// with an unspecified listen address (0.0.0.0), the interface addresses are the ones peers can use
+	listen, err := p.host.Network().InterfaceListenAddresses()
+	if err != nil {
+		listen = p.host.Network().ListenAddresses()
+	}
+	identity.ListenAddresses = append(identity.ListenAddresses, p.withPeerID(listen)...)
+
+	// all other addresses of the host were reported by peers
+	isListen := map[string]bool{}
+	for _, address := range listen {
+		isListen[address.String()] = true
+	}
+	var observed []multiaddr.Multiaddr
+	for _, address := range p.host.Addrs() {
+		if !isListen[address.String()] {
+			observed = append(observed, address)
+		}
+	}
+	identity.ObservedAddresses = append(identity.ObservedAddresses, p.withPeerID(observed)...)
+
+	return identity
+}
+
+// send the identity to slips, unless its addresses are the same as when it was sent last time
+// return bool: true if the identity was sent
+func (p *Peer) publishIdentity() bool {
+	identity := p.Identity()
+	addresses := strings.Join(identity.ListenAddresses, " ") + "|" + strings.Join(identity.ObservedAddresses, " ")
+
+	p.identity.mutex.Lock()
+	defer p.identity.mutex.Unlock()
+	if addresses == p.identity.published || p.bus == nil {
+		return false
+	}
+
+	data, err := schema.NewIdentity(identity).Encode()
+	if err != nil {
+		fmt.Println("[IDENTITY] Invalid identity, not sending it to slips -", err)
+		return false
+	}
+	p.identity.published = addresses
+
+	// each list has its loopback addresses last, but the combined list must have them after the observed addresses too
+	all := append(append([]string(nil), identity.ListenAddresses...), identity.ObservedAddresses...)
+	sort.SliceStable(all, func(i, j int) bool {
+		return !isLoopbackAddress(all[i]) && isLoopbackAddress(all[j])
+	})
+	p.bus.SaveMultiAddresses(all)
+	p.bus.SaveIdentity(string(data))
+	p.bus.SendStringToChannel(string(data))
+	fmt.Printf("[IDENTITY] Published identity with %d listen and %d observed addresses\n",
+		len(identity.ListenAddresses), len(identity.ObservedAddresses))
+	return true
+}
+
+// publish the identity again whenever the addresses of the node change, until the node shuts down
+func (p *Peer) watchAddresses() {
+	var updates <-chan interface{}
+	subscription, err := p.host.EventBus().Subscribe(new(event.EvtLocalAddressesUpdated))
+	if err != nil {
+		fmt.Println("[IDENTITY] Can't watch address changes, checking them periodically -", err)
+	} else {
+		defer subscription.Close()
+		updates = subscription.Out()
+	}
+
+	ticker := time.NewTicker(identityCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.stopped:
+			return
+		case _, ok := <-updates:
+			if !ok {
+				return
+			}
+			p.publishIdentity()
+		case <-ticker.C:
+			p.publishIdentity()
+		}
+	}
+}
+
+// full addresses with the peer id of this node. Loopback addresses come last, as other hosts can't use them
+// Addresses without a TCP port (such as the relay address) are left out
+func (p *Peer) withPeerID(addresses []multiaddr.Multiaddr) []string {
+	var full, loopback []string
+	for _, address := range addresses {
+		if _, err := address.ValueForProtocol(multiaddr.P_TCP); err != nil {
+			continue
+		}
+		text := fmt.Sprintf("%s/p2p/%s", address, p.ID())
+		if manet.IsIPLoopback(address) {
+			loopback = append(loopback, text)
+		} else {
+			full = append(full, text)
+		}
+	}
+	return append(full, loopback...)
+}
+
+// true if the address (with or without the peer id) is a loopback address, which other hosts can't use
+func isLoopbackAddress(address string) bool {
+	parsed, err := multiaddr.NewMultiaddr(address)
+	return err == nil && manet.IsIPLoopback(parsed)
+}
@@ -0,0 +1,241 @@
+package peer
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/stratosphereips/p2p4slips/peerdb"
+	"github.com/stratosphereips/p2p4slips/schema"
+)
+
+// kinds of interactions, they say what a rating was for
+const (
+	// connecting to a discovered peer
+	InteractionConnect = "connect"
+	// opening a stream to the peer and sending a message over it
+	InteractionStream = "stream"
+	// hello sent to the peer, or received from it
+	InteractionHello = "hello"
+	// ping sent to the peer
+	InteractionPing = "ping"
+	// ping received from the peer
+	InteractionPingReply = "ping_reply"
+	// message that was empty, too long, unknown or malformed
+	InteractionMessage = "message"
+	// slips message in a signed envelope
+	InteractionSignature    = "signature"
+	InteractionCapabilities = "capabilities"
+	InteractionRotation     = "rotation"
+	InteractionBulk         = "bulk"
+	// interactions recorded before kinds existed
+	InteractionUnknown = "unknown"
+)
+
+// outcomes of interactions
+const (
+	OutcomeSuccess = "success"
+	// the interaction could not be completed, for example the connection failed or there was no reply
+	OutcomeFailure = "failure"
+	// the peer sent something that breaks the protocol
+	OutcomeInvalid = "invalid"
+	// the peer contacts this node more often than allowed
+	OutcomeFlood = "flood"
+)
+
+// which interactions are sent to slips
+const (
+	ShareInteractionsNone     = "none"
+	ShareInteractionsFailures = "failures"
+	ShareInteractionsAll      = "all"
+)
+
+// InteractionEvent says what an interaction was for. PeerData keeps one for each rating in BasicInteractions.
+type InteractionEvent struct {
+	Kind    string `json:"kind"`
+	Outcome string `json:"outcome"`
+	Details string `json:"details,omitempty"`
+}
+
+// event of interactions stored before kinds existed
+var unknownEvent = InteractionEvent{Kind: InteractionUnknown, Outcome: InteractionUnknown}
+
+// InteractionQuery selects interactions of a peer. Empty fields match everything.
+type InteractionQuery struct {
+	// interactions at or after this time
+	Since time.Time
+	// interactions before this time, the bound is exclusive
+	Until   time.Time
+	Kind    string
+	Outcome string
+	// only the given number of most recent matching interactions is returned, 0 means no limit
+	Last int
+}
+
+func (q *InteractionQuery) matches(interaction peerdb.Interaction) bool {
+	if !q.Until.IsZero() && !interaction.Time.Before(q.Until) {
+		return false
+	}
+	if q.Kind != "" && interaction.Kind != q.Kind {
+		return false
+	}
+	return q.Outcome == "" || interaction.Outcome == q.Outcome
+}
+
+// QueryInteractions returns the interactions with the peer that match the query, oldest first
+func (ps *PeerStore) QueryInteractions(peerId string, query InteractionQuery) ([]peerdb.Interaction, error) {
+	interactions, err := ps.InteractionsSince(peerId, query.Since)
+	if err != nil {
+		return nil, err
+	}
+
+	var matching []peerdb.Interaction
+	for _, interaction := range interactions {
+		if interaction.Kind == "" {
+			interaction.Kind = unknownEvent.Kind
+			interaction.Outcome = unknownEvent.Outcome
+		}
+		if query.matches(interaction) {
+			matching = append(matching, interaction)
+		}
+	}
+	if query.Last > 0 && len(matching) > query.Last {
+		matching = matching[len(matching)-query.Last:]
+	}
+	return matching, nil
+}
+
+// HandleInteractionQuery sends slips the interactions with a peer that match its query
+// return bool: true if the peer is known
+func (p *Peer) HandleInteractionQuery(query *schema.InteractionQuery) bool {
+	history := schema.InteractionHistory{QueryID: query.QueryID, PeerID: query.PeerID,
+		Interactions: []schema.HistoryInteraction{}}
+
+	peerData := p.peerstore.IsKnown(query.PeerID)
+	if peerData == nil {
+		fmt.Printf("[INTERACTIONS] Slips asked for the history of unknown peer %s\n", query.PeerID)
+		shareWithSlips(p.bus, schema.NewInteractionHistory(history))
+		return false
+	}
+	history.Known = true
+	peerData.mutex.Lock()
+	history.Reliability = peerData.Reliability
+	peerData.mutex.Unlock()
+
+	q := InteractionQuery{Kind: query.Kind, Outcome: query.Outcome, Last: query.Last}
+	if query.Since > 0 {
+		q.Since = time.Unix(query.Since, 0)
+	}
+	// slips gives whole seconds and includes the until second, so the bound is the start of the next second
+	if query.Until > 0 {
+		q.Until = time.Unix(query.Until+1, 0)
+	}
+	interactions, err := p.peerstore.QueryInteractions(query.PeerID, q)
+	if err != nil {
+		fmt.Printf("[INTERACTIONS] Reading the history of %s failed - %s\n", query.PeerID, err)
+	}
+	for _, interaction := range interactions {
+		history.Interactions = append(history.Interactions, schema.HistoryInteraction{
+			Kind:      interaction.Kind,
+			Outcome:   interaction.Outcome,
+			Rating:    interaction.Rating,
+			Details:   interaction.Details,
+			Timestamp: interaction.Time.Unix(),
+		})
+	}
+	shareWithSlips(p.bus, schema.NewInteractionHistory(history))
+	return true
+}
+
+// the event of the i-th interaction. Must be called with the mutex locked
+func (pd *PeerData) eventAt(i int) InteractionEvent {
+	// events are aligned with the end of the history, older interactions may have no event
+	offset := len(pd.BasicInteractions) - len(pd.InteractionEvents)
+	if i < offset {
+		return unknownEvent
+	}
+	return pd.InteractionEvents[i-offset]
+}
+
+// add missing events of interactions stored before kinds existed, so there is an event for each rating
+// Must be called with the mutex locked
+func (pd *PeerData) alignEvents() {
+	missing := len(pd.BasicInteractions) - len(pd.InteractionEvents)
+	if missing == 0 {
+		return
+	}
+	events := make([]InteractionEvent, len(pd.BasicInteractions))
+	for i := range events {
+		events[i] = pd.eventAt(i)
+	}
+	pd.InteractionEvents = events
+}
+
+// the reliability computed from the latest reliabilityWindow interactions. Must be called with the mutex locked
+func (pd *PeerData) computeReliability() float64 {
+	start := 0
+	if len(pd.BasicInteractions) > reliabilityWindow {
+		start = len(pd.BasicInteractions) - reliabilityWindow
+	}
+	outcomes := make([]string, 0, len(pd.BasicInteractions)-start)
+	for i := start; i < len(pd.BasicInteractions); i++ {
+		outcomes = append(outcomes, pd.eventAt(i).Outcome)
+	}
+	return ComputeReliability(pd.BasicInteractions[start:], outcomes)
+}
+
+// with a database, forget the interactions in memory that the reliability is no longer computed from. They stay in
+// the database. Must be called with the mutex locked
+func (pd *PeerData) trimHistory() {
+	// trimming copies the history, so it is only done once it has grown to twice the window
+	if pd.history == nil || len(pd.BasicInteractions) <= 2*reliabilityWindow {
+		return
+	}
+	pd.alignEvents()
+	drop := len(pd.BasicInteractions) - reliabilityWindow
+	pd.BasicInteractions = append([]float64(nil), pd.BasicInteractions[drop:]...)
+	pd.BasicInteractionTimes = append([]time.Time(nil), pd.BasicInteractionTimes[drop:]...)
+	pd.InteractionEvents = append([]InteractionEvent(nil), pd.InteractionEvents[drop:]...)
+}
+
+// the i-th interaction with its event. Must be called with the mutex locked
+func (pd *PeerData) interactionAt(i int) peerdb.Interaction {
+	event := pd.eventAt(i)
+	return peerdb.Interaction{Time: pd.BasicInteractionTimes[i], Rating: pd.BasicInteractions[i], Kind: event.Kind,
+		Outcome: event.Outcome, Details: event.Details}
+}
+
+// add a stored interaction to the history, without rating the peer again. Must be called with the mutex locked
+// or before the peer data is shared
+func (pd *PeerData) appendInteraction(interaction peerdb.Interaction) {
+	event := InteractionEvent{Kind: interaction.Kind, Outcome: interaction.Outcome, Details: interaction.Details}
+	if event.Kind == "" {
+		event = unknownEvent
+	}
+	pd.alignEvents()
+	pd.BasicInteractions = append(pd.BasicInteractions, interaction.Rating)
+	pd.BasicInteractionTimes = append(pd.BasicInteractionTimes, interaction.Time)
+	pd.InteractionEvents = append(pd.InteractionEvents, event)
+}
+
+// let slips know about the interaction, if the peerstore is configured to share it
+func (pd *PeerData) shareInteraction(interaction peerdb.Interaction, reliability float64) {
+	switch pd.shareInteractions {
+	case ShareInteractionsAll:
+	case ShareInteractionsFailures:
+		if interaction.Outcome == OutcomeSuccess {
+			return
+		}
+	default:
+		return
+	}
+
+	shareWithSlips(pd.bus, schema.NewInteraction(schema.Interaction{
+		PeerID:      pd.PeerID,
+		Kind:        interaction.Kind,
+		Outcome:     interaction.Outcome,
+		Rating:      interaction.Rating,
+		Reliability: reliability,
+		Details:     interaction.Details,
+		Timestamp:   interaction.Time.Unix(),
+	}))
+}
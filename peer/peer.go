@@ -10,57 +10,132 @@ import (
 	"github.com/libp2p/go-libp2p-core/host"
 	"github.com/libp2p/go-libp2p-core/network"
 	libp2ppeer "github.com/libp2p/go-libp2p-core/peer"
-	"github.com/libp2p/go-libp2p-core/protocol"
 	"github.com/multiformats/go-multiaddr"
 	"github.com/stratosphereips/p2p4slips/database"
+	"github.com/stratosphereips/p2p4slips/metrics"
+	"github.com/stratosphereips/p2p4slips/peerdb"
+	"github.com/stratosphereips/p2p4slips/schema"
 	"github.com/stratosphereips/p2p4slips/utils"
 	"io"
+	"os"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
 type Peer struct {
-	host          host.Host
-	port          int
-	hostname      string
-	protocol      string
-	rendezVous    string
-	ctx           context.Context
-	peerstore     PeerStore
-	privKey       crypto.PrivKey
-	keyFile       string
-	resetKey      bool
-	peerstoreFile string
-	closing       bool
-}
-
-func NewPeer(cfg *utils.Config) *Peer {
+	host           host.Host
+	port           int
+	hostname       string
+	protocol       string
+	protocolPrefix string
+	rendezVous     string
+	mdns           bool
+	bus            database.Bus
+	ctx            context.Context
+	peerstore      PeerStore
+	privKey        crypto.PrivKey
+	keyFile        string
+	resetKey       bool
+	keyType        string
+	passphraseEnv  string
+	passphraseFile string
+	rotation       *utils.RotationAnnouncement
+	peerstoreFile  string
+	peerstoreDB    string
+	retention      time.Duration
+	bulkDir        string
+	compression    bool
+	shareLevel     string         // which interactions are sent to slips
+	qualityWeight  float64        // weight of report quality in the trust of peers
+	bulk           *bulkStore     // limits of incoming bulk transfers
+	reports        *issuedReports // reports forwarded to slips, which slips can rate
+	envelopes      *seenEnvelopes // signed messages received recently, to reject replays
+	strategy       schema.Strategy
+	pingConfig     PingConfig
+	saveInterval   time.Duration
+	stopped        chan struct{} // closed when the node shuts down
+	closing        int32         // set to 1 when the node starts shutting down, accessed atomically
+	startTime      time.Time
+	identity       identityWatch
+}
+
+// NewPeer prepares a peer with the given configuration, talking to slips over the bus
+func NewPeer(cfg *utils.Config, bus database.Bus) *Peer {
 	p := &Peer{
-		port:          cfg.ListenPort,
-		hostname:      cfg.ListenHost,
-		protocol:      cfg.ProtocolID,
-		rendezVous:    cfg.RendezvousString,
-		peerstore:     PeerStore{},
-		privKey:       nil,
-		keyFile:       cfg.KeyFile,
-		resetKey:      cfg.ResetKeys,
-		peerstoreFile: cfg.PeerstoreFile,
-		closing:       false,
+		port:           cfg.ListenPort,
+		hostname:       cfg.ListenHost,
+		protocol:       cfg.ProtocolID,
+		protocolPrefix: cfg.ProtocolPrefix,
+		rendezVous:     cfg.RendezvousString,
+		mdns:           cfg.Mdns,
+		bus:            bus,
+		peerstore:      PeerStore{},
+		privKey:        nil,
+		keyFile:        cfg.KeyFile,
+		resetKey:       cfg.ResetKeys,
+		keyType:        cfg.KeyType,
+		passphraseEnv:  cfg.KeyPassphraseEnv,
+		passphraseFile: cfg.KeyPassphraseFile,
+		peerstoreFile:  cfg.PeerstoreFile,
+		peerstoreDB:    cfg.PeerstoreDB,
+		retention:      cfg.PeerstoreRetention,
+		bulkDir:        cfg.BulkDir,
+		bulk:           newBulkStore(cfg),
+		reports:        newIssuedReports(),
+		envelopes:      newSeenEnvelopes(),
+		compression:    cfg.Compression,
+		strategy:       schema.Strategy{Mode: cfg.SelectionMode, Fanout: &cfg.Fanout},
+		shareLevel:     cfg.ShareInteractions,
+		qualityWeight:  cfg.ReportQualityWeight,
+		pingConfig:     NewPingConfig(cfg),
+		saveInterval:   cfg.PeerstoreSaveInterval,
+		stopped:        make(chan struct{}),
 	}
 	return p
 }
 
 func (p *Peer) PeerInit() error {
+	p.startTime = time.Now()
+
 	// prepare p2p host
-	p.p2pInit(p.keyFile, p.resetKey)
+	if err := p.p2pInit(p.keyFile, p.resetKey); err != nil {
+		return err
+	}
+	p.loadRotationAnnouncement()
 
-	// link to a listener for new connections
-	p.host.SetStreamHandler(protocol.ID(p.protocol),
-		p.listener)
+	if p.bulkDir != "" {
+		if err := os.MkdirAll(p.bulkDir, 0700); err != nil {
+			fmt.Println("[PEER] Creating bulk transfer directory failed -", err)
+			return err
+		}
+		p.bulk.removeStaleParts()
+		go p.bulk.run(p.stopped)
+	}
 
+	// the stream handlers use the peerstore, so it must be ready before they are registered
 	p.peerstore = PeerStore{Store: p.host.Peerstore(),
-		SaveFile: p.peerstoreFile}
+		SaveFile: p.peerstoreFile, Retention: p.retention, Bus: p.bus, ShareInteractions: p.shareLevel,
+		ReportQualityWeight: p.qualityWeight}
+	if p.peerstoreDB != "" {
+		db, err := peerdb.Open(p.peerstoreDB)
+		if err != nil {
+			fmt.Println("[PEER] Opening peer database failed -", err)
+			return err
+		}
+		p.peerstore.DB = db
+	}
 	p.peerstore.ReadFromFile(p.privKey)
+	p.peerstore.Prune()
+	go p.peerstore.AutoSave(p.privKey, p.saveInterval, p.stopped)
+
+	// link to listeners for new connections
+	p.registerProtocols()
+
+	// tell slips who this node is, now and whenever its addresses change
+	p.publishIdentity()
+	go p.watchAddresses()
 
 	// run peer discovery in the background
 	err := p.discoverPeers()
@@ -68,7 +143,7 @@ func (p *Peer) PeerInit() error {
 		return err
 	}
 
-	go p.pingLoop()
+	go newPingScheduler(p, p.pingConfig).run()
 	return nil
 }
 
@@ -80,16 +155,40 @@ func (p *Peer) PeerShutdown() {
 func (p *Peer) p2pInit(keyFile string, keyReset bool) error {
 	p.ctx = context.Background()
 
-	prvKey := utils.LoadKey(keyFile, keyReset)
+	keyType, err := utils.ParseKeyType(p.keyType)
+	if err != nil {
+		fmt.Println("[PEER] P2P initialization failed -", err)
+		return err
+	}
+
+	passphrase, err := utils.ReadPassphrase(p.passphraseEnv, p.passphraseFile)
+	if err != nil {
+		fmt.Println("[PEER] P2P initialization failed -", err)
+		return err
+	}
+
+	prvKey, err := utils.LoadKey(keyFile, keyReset, keyType, passphrase)
+	if err != nil {
+		fmt.Println("[PEER] P2P initialization failed -", err)
+		return err
+	}
 
 	p.privKey = prvKey
 
 	// 0.0.0.0 will listen on any interface device.
-	sourceMultiAddr, _ := multiaddr.NewMultiaddr(fmt.Sprintf("/ip4/%s/tcp/%d", p.hostname, p.port))
+	hostname := p.hostname
+	if hostname == "" {
+		hostname = "0.0.0.0"
+	}
+	// port 0 lets the system pick a free port
+	sourceMultiAddr, err := multiaddr.NewMultiaddr(fmt.Sprintf("/ip4/%s/tcp/%d", hostname, p.port))
+	if err != nil {
+		fmt.Printf("[PEER] Invalid listen address '%s' - %s\n", hostname, err)
+		return err
+	}
 
 	// libp2p.New constructs a new libp2p Host.
 	// Other options can be added here.
-	var err error
 	p.host, err = libp2p.New(
 		p.ctx,
 		libp2p.ListenAddrs(sourceMultiAddr),
@@ -97,17 +196,29 @@ func (p *Peer) p2pInit(keyFile string, keyReset bool) error {
 	)
 
 	if err != nil {
-		fmt.Println("[PEER] P2P initialization failed -", err)
+		fmt.Printf("[PEER] Can't listen on %s - %s\n", sourceMultiAddr, err)
 		return err
 	}
 
-	multiAddress := fmt.Sprintf("/ip4/%s/tcp/%v/p2p/%s", p.hostname, p.port, p.host.ID().Pretty())
-	fmt.Println("\n[*] Your Multiaddress Is: ", multiAddress)
-	database.DBW.SaveMultiAddress(multiAddress)
+	// remember the port that was actually bound
+	for _, address := range p.host.Addrs() {
+		if port, err := address.ValueForProtocol(multiaddr.P_TCP); err == nil {
+			p.port, _ = strconv.Atoi(port)
+			break
+		}
+	}
+
+	for _, address := range p.Addresses() {
+		fmt.Println("\n[*] Your Multiaddress Is: ", address)
+	}
 	return nil
 }
 
 func (p *Peer) discoverPeers() error {
+	if !p.mdns {
+		fmt.Println("Peer discovery is disabled")
+		return nil
+	}
 	fmt.Println("Looking for peers")
 
 	peerChan, err := utils.InitMDNS(p.ctx, p.host, p.rendezVous)
@@ -117,7 +228,7 @@ func (p *Peer) discoverPeers() error {
 	}
 	go func() {
 		for {
-			if p.closing {
+			if p.isClosing() {
 				return
 			}
 			peerAddress := <-peerChan // will block until we discover a peerAddress
@@ -130,16 +241,11 @@ func (p *Peer) discoverPeers() error {
 				// unknown peer
 				fmt.Println("This is a new node, contacting him...")
 
-				if err := p.host.Connect(p.ctx, peerAddress); err != nil {
-					fmt.Println("Connection failed:", err)
+				if err := p.contactPeer(peerData, peerAddress); err != nil {
 					fmt.Println("Please make sure that the port of this Node is not used by other processes")
-					peerData.AddBasicInteraction(0)
 					return
 				}
 
-				remoteMA := fmt.Sprintf("%s/p2p/%s", peerAddress.Addrs[0], peerId)
-				peerData.SetMultiaddr(remoteMA)
-
 				go p.sayHello(peerData)
 
 				// sleep, because a new peer might be found twice, and we want to save him before the second message is read
@@ -150,84 +256,125 @@ func (p *Peer) discoverPeers() error {
 	return nil
 }
 
-func (p *Peer) listener(stream network.Stream) {
-	defer p.closeStream(stream)
-
-	remotePeer := stream.Conn().RemotePeer()
-	remotePeerStr := remotePeer.Pretty()
-	remoteMA := fmt.Sprintf("%s/p2p/%s", stream.Conn().RemoteMultiaddr(), remotePeerStr)
-
-	remotePeerData, _ := p.peerstore.ActivatePeer(remotePeerStr)
-	remotePeerData.SetMultiaddr(remoteMA)
-
-	// Create a buffer stream for non blocking read and write.
-	reader := bufio.NewReader(stream)
+// connect to a newly found peer and remember its address
+func (p *Peer) contactPeer(peerData *PeerData, peerAddress libp2ppeer.AddrInfo) error {
+	if err := p.host.Connect(p.ctx, peerAddress); err != nil {
+		fmt.Println("Connection failed:", err)
+		peerData.AddInteraction(InteractionConnect, OutcomeFailure, 0, err.Error())
+		return err
+	}
 
-	str, err := reader.ReadString('\n')
+	remoteMA := fmt.Sprintf("%s/p2p/%s", peerAddress.Addrs[0], peerAddress.ID.Pretty())
+	peerData.SetMultiaddr(remoteMA)
+	return nil
+}
 
+// Connect to the peer with the given multiaddress (including the /p2p/ part) and say hello to it. This is the
+// manual alternative to discovery with mDNS.
+// return error: nil if the peer replied to the hello
+func (p *Peer) Connect(address string) error {
+	multiaddress, err := multiaddr.NewMultiaddr(address)
 	if err != nil {
-		fmt.Println("Error reading from buffer")
-		remotePeerData.AddBasicInteraction(0)
-		return
+		return err
+	}
+	peerAddress, err := libp2ppeer.AddrInfoFromP2pAddr(multiaddress)
+	if err != nil {
+		return err
 	}
 
-	if len(str) == 0 {
-		fmt.Println("Peer sent empty message")
-		remotePeerData.AddBasicInteraction(0)
-		return
+	peerData, _ := p.peerstore.ActivatePeer(peerAddress.ID.Pretty())
+	if err = p.contactPeer(peerData, *peerAddress); err != nil {
+		return err
+	}
+	if !p.sayHello(peerData) {
+		return fmt.Errorf("peer %s didn't reply to hello", peerAddress.ID.Pretty())
 	}
+	return nil
+}
 
-	// remove trailing newlines
-	// fmt.Println("String:", str)
-	// fmt.Println("Err:", err)
-	str = str[:len(str)-1]
+// ID returns the peer id of this node
+func (p *Peer) ID() string {
+	return p.host.ID().Pretty()
+}
 
-	commands := strings.Fields(str)
+// Addresses returns the addresses this node listens on, including its peer id. Loopback addresses come last
+func (p *Peer) Addresses() []string {
+	return p.withPeerID(p.host.Addrs())
+}
 
-	if len(commands) == 0 {
-		// peer sent empty message
-		fmt.Println("[", remotePeer, "] sent an empty string")
-		remotePeerData.AddBasicInteraction(0)
-		return
+// PeerStore returns the peers known to this node
+func (p *Peer) PeerStore() *PeerStore {
+	return &p.peerstore
+}
+
+// Ping the peer with the given id right away, regardless of the ping schedule
+// return bool: true if the peer replied
+func (p *Peer) Ping(peerId string) bool {
+	peerData := p.peerstore.IsKnown(peerId)
+	if peerData == nil || p.isClosing() {
+		return false
 	}
+	return p.pingNow(peerData)
+}
 
-	if commands[0] == "hello" {
+// handle messages of the control channel. Return false if the message doesn't belong to it
+func (p *Peer) dispatchControl(msg *inboundMessage) bool {
+	remotePeer := msg.peerData.PeerID
+
+	switch msg.commands[0] {
+	case "hello":
 		fmt.Println("[", remotePeer, "] New peer says hello to me")
-		p.handleHello(remotePeerData, stream, &commands)
-		return
-	} else if str == "ping" {
+		p.handleHello(msg.peerData, msg.stream, &msg.commands)
+		go p.announceRotation(msg.peerData)
+	case "rotate":
+		fmt.Println("[", remotePeer, "] announces a key rotation")
+		p.handleRotation(msg.peerData, &msg.commands)
+	case "capabilities":
+		p.handleCapabilities(msg.peerData, msg.stream, &msg.commands)
+	case "ping":
 		dt := time.Now()
-		//fmt.Println("[", remotePeer, "] says ping at ", dt.Format(time.UnixDate))
 		fmt.Printf("[ %s ] says ping at %s \n", remotePeer, dt.Format(time.UnixDate))
-		p.handlePing(remotePeerData, stream)
-		return
-	} else if str == "goodbye" {
+		p.handlePing(msg.peerData, msg.stream)
+	case "goodbye":
 		fmt.Println("[", remotePeer, "] says goodbye")
-		p.handleGoodbye(remotePeerData)
-		return
-	} else {
-		//fmt.Println("[", remotePeer, "] sent an unknown message:", str)
+		p.handleGoodbye(msg.peerData)
+	default:
+		return false
+	}
+	return true
+}
 
-		// log the received msg
-		rawDecodedText, err := base64.StdEncoding.DecodeString(str)
-		if err == nil {
-			fmt.Printf("Received from [ %s ] : %s\n", remotePeer, rawDecodedText)
-		}
+// handle messages of the data channel. Anything that isn't a signed message is forwarded to slips as it is
+func (p *Peer) dispatchData(msg *inboundMessage) bool {
+	if msg.commands[0] == "signed" {
+		p.handleSignedMessage(msg.peerData, &msg.commands)
+		return true
+	}
+	if msg.commands[0] == "compressed" {
+		p.handleCompressedMessage(msg)
+		return true
+	}
 
-		//now forward this msg to slips p2p module to deal with it
-		p.handleGenericMessage(remotePeerStr, str)
+	// log the received msg
+	rawDecodedText, err := base64.StdEncoding.DecodeString(msg.text)
+	if err == nil {
+		fmt.Printf("Received from [ %s ] : %s\n", msg.peerData.PeerID, rawDecodedText)
 	}
+
+	//now forward this msg to slips p2p module to deal with it
+	p.handleGenericMessage(msg.peerData.PeerID, msg.text)
+	return true
 }
 
-func (p *Peer) sayHello(peerData *PeerData) {
-	if p.closing {
-		return
+func (p *Peer) sayHello(peerData *PeerData) bool {
+	if p.isClosing() {
+		return false
 	}
 
-	response, ok := p.sendMessageToPeerData(peerData, "hello version1\n", 10*time.Second)
+	response, ok := p.sendMessageToPeerData(peerData, ControlChannel, "hello "+helloVersion+"\n", 10*time.Second)
 
 	if !ok {
-		return
+		return false
 	}
 
 	fmt.Println("text:", response)
@@ -237,19 +384,23 @@ func (p *Peer) sayHello(peerData *PeerData) {
 
 	if len(command) != 2 || command[0] != "hello" {
 		fmt.Println("Peer sent invalid hello reply")
-		peerData.AddBasicInteraction(0)
-		return
+		peerData.AddInteraction(InteractionHello, OutcomeInvalid, 0, "invalid hello reply")
+		return false
 	} else {
 		remoteVersion = command[1]
 	}
 
 	fmt.Println("PeerOld response ok, updating reputation")
-	peerData.AddBasicInteraction(1)
+	peerData.AddInteraction(InteractionHello, OutcomeSuccess, 1, "")
 	peerData.SetVersion(remoteVersion)
+	p.exchangeCapabilities(peerData, remoteVersion)
+
+	p.announceRotation(peerData)
+	return true
 }
 
 func (p *Peer) handleHello(remotePeerData *PeerData, stream network.Stream, command *[]string) {
-	if p.closing {
+	if p.isClosing() {
 		return
 	}
 
@@ -257,7 +408,7 @@ func (p *Peer) handleHello(remotePeerData *PeerData, stream network.Stream, comm
 	var remoteVersion string
 	if len(*command) != 2 {
 		fmt.Println("Invalid Hello format")
-		remotePeerData.AddBasicInteraction(0)
+		remotePeerData.AddInteraction(InteractionHello, OutcomeInvalid, 0, "invalid hello format")
 		return
 	} else {
 		remoteVersion = (*command)[1]
@@ -266,62 +417,85 @@ func (p *Peer) handleHello(remotePeerData *PeerData, stream network.Stream, comm
 	if !remotePeerData.SetVersion(remoteVersion) {
 		// hello message should not be sent unless the version changed or the peer is unknown (changes version as well)
 		fmt.Println("Peer sent unsolicited hello")
-		remotePeerData.AddBasicInteraction(0)
+		remotePeerData.AddInteraction(InteractionHello, OutcomeInvalid, 0, "unsolicited hello")
 	}
 
-	_, ok := p.sendMessageToStream(stream, "hello version1\n", 0)
+	_, ok := p.sendMessageToStream(stream, "hello "+helloVersion+"\n", 0)
 
 	if !ok {
 		fmt.Println("Something went wrong when sending hello reply")
-		remotePeerData.AddBasicInteraction(0)
+		remotePeerData.AddInteraction(InteractionHello, OutcomeFailure, 0, "sending hello reply failed")
 		return
 	}
 
-	remotePeerData.AddBasicInteraction(1)
+	remotePeerData.AddInteraction(InteractionHello, OutcomeSuccess, 1, "")
+
+	// newer peers send their capabilities in a separate message right after the hello
+	if version, ok := parseVersion(remoteVersion); ok && version < 2 {
+		remotePeerData.SetCapabilities(&legacyCapabilities, negotiateVersion(localCapabilities, legacyCapabilities))
+	}
 }
 
-func (p *Peer) sendPing(remotePeerData *PeerData) {
-	if p.closing {
-		return
+// Ping the peer and rate the reply. Return true if the peer is responsive (it answered, or was contacted recently)
+func (p *Peer) sendPing(remotePeerData *PeerData) bool {
+	if p.isClosing() {
+		return false
 	}
 	//fmt.Println("[PEER PING]")
 
 	// check last ping time, if it was recently, do not ping at all
-	if !remotePeerData.ShouldIPingPeer() {
+	if !PingDue(p.pingConfig, remotePeerData.GetLastGoodPing(), time.Now()) {
 		//fmt.Printf("[PEER PING] Peer %s was contacted recently, no need for ping\n", remotePeerData.PeerID)
-		return
+		return true
 	}
+	return p.pingNow(remotePeerData)
+}
+
+// Ping the peer and rate the reply, without checking when it was contacted last
+func (p *Peer) pingNow(remotePeerData *PeerData) bool {
 	dt := time.Now()
 	fmt.Printf("[PEER PING] Sending ping to [ %s ] at %s \n", remotePeerData.PeerID, dt.Format(time.UnixDate))
-	response, ok := p.sendMessageToPeerData(remotePeerData, "ping\n", 10*time.Second)
-
-	if response == "pong\n" && ok {
-		remotePeerData.AddBasicInteraction(1)
-		remotePeerData.LastGoodPing = time.Now()
-		fmt.Printf("[PEER PING] Peer %s sent pong reply\n", remotePeerData.PeerID)
-	} else {
-		fmt.Printf("[PEER PING] Peer %s sent wrong pong reply (or none at all)\n", remotePeerData.PeerID)
-		remotePeerData.AddBasicInteraction(0)
-		if remotePeerData.ShouldIDeactivatePeer() {
-			fmt.Printf("[PEER PING] It's been to long since the peer %s has been online, deactivating him\n", remotePeerData.PeerID)
-			p.peerstore.DeactivatePeer(remotePeerData.PeerID)
-		}
-	}
+	timeout := p.pingConfig.Timeout
+	// a failed ping is rated once, with the reason of the failure
+	response, failure := p.exchangeMessage(remotePeerData, ControlChannel, "ping\n", timeout)
+	// the round trip time includes opening the stream
+	rtt := time.Since(dt)
+
+	rating, outcome := RatePing(p.pingConfig, rtt, response == "pong\n" && failure == "")
+	if outcome == OutcomeSuccess {
+		remotePeerData.AddRttSample(rtt)
+		remotePeerData.AddInteraction(InteractionPing, outcome, rating, "rtt "+rtt.String())
+		remotePeerData.SetLastGoodPing(time.Now())
+		fmt.Printf("[PEER PING] Peer %s sent pong reply in %s\n", remotePeerData.PeerID, rtt)
+		return true
+	}
+
+	fmt.Printf("[PEER PING] Peer %s sent wrong pong reply (or none at all)\n", remotePeerData.PeerID)
+	if failure == "" {
+		failure = "no pong reply"
+	}
+	remotePeerData.AddInteraction(InteractionPing, outcome, rating, failure)
+	if DeactivationDue(p.pingConfig, remotePeerData.GetLastGoodPing(), time.Now()) {
+		fmt.Printf("[PEER PING] It's been to long since the peer %s has been online, deactivating him\n", remotePeerData.PeerID)
+		p.peerstore.DeactivatePeer(remotePeerData.PeerID)
+	}
+	return false
 }
 
 func (p *Peer) handlePing(remotePeerData *PeerData, stream network.Stream) {
-	if p.closing {
+	if p.isClosing() {
 		return
 	}
 	//fmt.Println("[PEER PING] Received ping at \n", time.Now())
 	//fmt.Println("[PEER PING] from %s\n ", remotePeerData.PeerID)
 
-	rating := 1.0
+	details := ""
 
 	// is he not pinging me too early?
-	if !remotePeerData.CanHePingMe() {
+	rating, outcome := RateReceivedPing(p.pingConfig, remotePeerData.GetLastGoodPing(), time.Now())
+	if outcome == OutcomeFlood {
 		fmt.Printf("[PEER PING REPLY] Peer %s is sending pings too often\n", remotePeerData.PeerID)
-		rating = 0
+		details = "pinged within " + p.pingConfig.MinPingGap.String()
 	}
 
 	// reply to ping
@@ -329,40 +503,51 @@ func (p *Peer) handlePing(remotePeerData *PeerData, stream network.Stream) {
 	_, ok := p.sendMessageToStream(stream, "pong\n", 0)
 	if !ok {
 		fmt.Printf("[PEER PING REPLY] Something went wrong when sending ping reply to %s\n", remotePeerData.PeerID)
-		rating = 0
+		rating, outcome, details = 0, OutcomeFailure, "sending pong failed"
 	} else {
-		remotePeerData.LastGoodPing = time.Now()
+		remotePeerData.SetLastGoodPing(time.Now())
 		fmt.Printf("[PEER PING REPLY] Ping reply successfully sent to %s\n", remotePeerData.PeerID)
 	}
 
-	remotePeerData.AddBasicInteraction(rating)
+	remotePeerData.AddInteraction(InteractionPingReply, outcome, rating, details)
 }
 
 func (p *Peer) handleGoodbye(remotePeerData *PeerData) {
 	p.peerstore.DeactivatePeer(remotePeerData.PeerID)
 }
 
+// forward a message from a peer that doesn't sign its messages (older versions of the pigeon)
 func (p *Peer) handleGenericMessage(peerID string, message string) {
-	report := &ReportStruct{
-		Reporter:  peerID,
-		ReportTme: time.Now().Unix(),
-		Message:   message,
+	report := &schema.Report{
+		Reporter:   peerID,
+		ReportTime: time.Now().Unix(),
+		Message:    message,
+		Signature:  schema.SignatureUnsigned,
 	}
 
-	ShareReport(report)
+	p.shareReport(report)
+}
+
+// true once the node started shutting down, safe to call from any goroutine
+func (p *Peer) isClosing() bool {
+	return atomic.LoadInt32(&p.closing) == 1
 }
 
 func (p *Peer) Close() {
-	// set closing to true, to stop all outgoing communication, wait till everything is sent
-	p.closing = true
+	// mark the node as closing, to stop all outgoing communication, wait till everything is sent
+	atomic.StoreInt32(&p.closing, 1)
 	time.Sleep(1 * time.Second)
 
 	// tell peers that this node is shutting down
-	p.SendMessageToPeerId("goodbye\n", "*")
+	p.SendMessageToPeers(ControlChannel, "goodbye\n", []string{"*"}, nil, &schema.Strategy{Mode: schema.StrategyAll})
 	// wait till the message is sent, otherwise the host is closed too early and sending fails
 	time.Sleep(1 * time.Second)
 
+	close(p.stopped)
 	p.peerstore.SaveToFile(p.privKey)
+	if p.peerstore.DB != nil {
+		_ = p.peerstore.DB.Close()
+	}
 
 	// shut the node down
 	if err := p.host.Close(); err != nil {
@@ -370,33 +555,29 @@ func (p *Peer) Close() {
 	}
 }
 
-func (p *Peer) pingLoop() {
-	for {
-		//fmt.Println("[LOOP] printing active peers:")
-		for peerID := range p.peerstore.ActivePeers {
-			peerData := p.peerstore.ActivePeers[peerID]
-			fmt.Printf("[LOOP] Listing active peer: %s\n", peerID)
-			p.sendPing(peerData)
-		}
-		//fmt.Println("[LOOP] printing all peers:")
-		//for peerID := range p.peerstore.AllPeers {
-		// 			peerData := p.peerstore.AllPeers[peerID]
-		//fmt.Printf("[LOOP] Listing all peers %s\n", peerID)
-		//}
-		//fmt.Println("[LOOP] done, sleeping 10s")
-		time.Sleep(10 * time.Second)
-	}
-}
-
 // Send specified message to the provided peer. Return the peer's reply (string) and success (bool)
 // All connection errors affect the peer's reliability, there is no need to update it based on the success bool
 // peerData: data of the target peer
+// channel: the kind of the message, it decides the protocol of the stream
 // message: the string to send to the target peer
 // timeout: timeout to wait for reply. If timeout is set to 0, the stream is closed right after sending,
 // without reading any replies.
 // return response string: the response sent by the peer. Empty string if timeout is zero or if there were errors
 // return success bool: true if everything went smoothly, false in case of errors (or no reply from peer)
-func (p *Peer) sendMessageToPeerData(peerData *PeerData, message string, timeout time.Duration) (string, bool) {
+func (p *Peer) sendMessageToPeerData(peerData *PeerData, channel Channel, message string, timeout time.Duration) (string, bool) {
+	response, failure := p.exchangeMessage(peerData, channel, message, timeout)
+	// lower peer's reputation in case of errors
+	if failure != "" {
+		peerData.AddInteraction(InteractionStream, OutcomeFailure, 0, failure)
+		return response, false
+	}
+	return response, true
+}
+
+// Send the message like sendMessageToPeerData, without rating the peer. Callers that rate the exchange themselves
+// use this, so one failure is not rated twice
+// return failure string: what went wrong, empty if everything went smoothly
+func (p *Peer) exchangeMessage(peerData *PeerData, channel Channel, message string, timeout time.Duration) (string, string) {
 
 	// log the sent msg
 	rawDecodedText, err := base64.StdEncoding.DecodeString(message)
@@ -405,34 +586,42 @@ func (p *Peer) sendMessageToPeerData(peerData *PeerData, message string, timeout
 	}
 	//fmt.Println("sending ", message, " to:", peerData.PeerID)
 
+	// data messages are compressed for peers that agreed on it
+	if channel == DataChannel {
+		original := len(message)
+		if caps, _ := peerData.GetCapabilities(); p.compression && caps.Has(FeatureCompression) {
+			message = compressLine(message)
+		}
+		metrics.RecordSentMessage(original, len(message), len(message) != original)
+	}
+
 	// open stream
-	stream := p.openStreamFromPeerData(peerData)
+	stream := p.openStreamFromPeerData(peerData, channel)
 	// close stream when this function exits (useful to have it here, since there are multiple returns)
 	defer p.closeStream(stream)
 
-	// give up if stream opening failed, lower peer's reliability
+	// give up if stream opening failed
 	if stream == nil {
 		fmt.Println("Couldn't open the stream")
-		peerData.AddBasicInteraction(0)
-		return "", false
+		return "", "opening stream failed"
 	}
 
 	// send message to the stream, read response
 	response, ok := p.sendMessageToStream(stream, message, timeout)
 
-	// lower peer's reputation in case of errors
 	if !ok {
 		fmt.Println("Couldn't send the message")
-		peerData.AddBasicInteraction(0)
+		return response, "sending message failed"
 	}
-
-	return response, ok
+	return response, ""
 }
 
 // Open a stream to the remote peer. Return the stream, or nil in case of errors. Peer reliability is not modified.
+// The newest protocol version of the channel known to the peer is used, the legacy protocol as the last resort.
 // peerData: data of the target peer
+// channel: the kind of traffic sent over the stream
 // return stream network.Stream: a stream with the given peer, or nil in case of errors
-func (p *Peer) openStreamFromPeerData(peerData *PeerData) network.Stream {
+func (p *Peer) openStreamFromPeerData(peerData *PeerData, channel Channel) network.Stream {
 	//fmt.Printf("DEBUGGINGGG %+v\n", peerData)
 	remoteMA := peerData.LastMultiAddress
 
@@ -451,7 +640,7 @@ func (p *Peer) openStreamFromPeerData(peerData *PeerData) network.Stream {
 	}
 
 	// open stream
-	stream, err := p.host.NewStream(p.ctx, remotePeer.ID, protocol.ID(p.protocol))
+	stream, err := p.host.NewStream(p.ctx, remotePeer.ID, p.protocolIDs(channel)...)
 	if err != nil {
 		fmt.Println("[OPEN STREAM] Opening stream failed")
 		return nil
@@ -552,29 +741,89 @@ func (p *Peer) closeStream(stream network.Stream) {
 // message: the string to send
 // peerid: the peerid of the peer. Or * to broadcast to multiple peers
 func (p *Peer) SendMessageToPeerId(message string, peerId string) {
-	// the functions should:
-	var contactList map[string]*PeerData
-
-	// handle * as recipient
-	if peerId == "*" {
-		contactList = p.peerstore.ActivePeers
-		// TODO: choose 50 peers
-		// TODO: consider broadcasting
-	} else {
-		contactList = make(map[string]*PeerData)
-		peerData := p.peerstore.IsActivePeer(peerId)
+	p.SendMessageToPeers(DataChannel, message, []string{peerId}, nil, nil)
+}
+
+// sign the message from slips and send it to the peers requested in the scroll
+// If the scroll asks for encryption, the message is encrypted separately to the public key of each recipient
+func (p *Peer) SendSlipsMessage(ps *schema.PigeonScroll) {
+	if ps.Bulk != nil {
+		p.sendBulkMessage(ps)
+		return
+	}
 
-		if peerData == nil {
-			fmt.Println("[PEER] peerid doesn't belong to any active peer: ", peerId)
+	payload := strings.TrimSuffix(ps.Message, "\n")
+	contactList := p.selectContacts(ps.AllRecipients(), ps.Selector, ps.Strategy)
+
+	if !ps.Encrypt {
+		signed, err := p.signMessage(payload, false)
+		if err != nil {
+			fmt.Println("[SIGNING] Signing message failed, not sending it -", err)
 			return
 		}
+		for _, peerData := range contactList {
+			// the message format depends on what the peer understands
+			caps, compatible := peerData.GetCapabilities()
+			if !compatible {
+				fmt.Printf("[PEER] Peer %s is incompatible, not sending the message to it\n", peerData.PeerID)
+				continue
+			}
+			message := payload + "\n"
+			if caps.Has(FeatureSigning) {
+				message = signed
+			}
+			go p.sendMessageToPeerData(peerData, DataChannel, message, 0)
+		}
+		return
+	}
+
+	for _, peerData := range contactList {
+		if caps, compatible := peerData.GetCapabilities(); !compatible || !caps.Has(FeatureEncryption) {
+			fmt.Printf("[ENCRYPTION] Peer %s doesn't support encryption, not sending the message to it\n",
+				peerData.PeerID)
+			continue
+		}
+
+		peerId, err := libp2ppeer.Decode(peerData.PeerID)
+		var recipientKey crypto.PubKey
+		if err == nil {
+			recipientKey = p.host.Peerstore().PubKey(peerId)
+		}
+		if recipientKey == nil {
+			fmt.Printf("[ENCRYPTION] Public key of %s is unknown, not sending the message to it\n", peerData.PeerID)
+			continue
+		}
 
-		contactList[peerId] = peerData
+		encrypted, err := encryptPayload(payload, recipientKey)
+		if err != nil {
+			fmt.Printf("[ENCRYPTION] Encrypting message for %s failed - %s\n", peerData.PeerID, err)
+			continue
+		}
+		message, err := p.signMessage(encrypted, true)
+		if err != nil {
+			fmt.Println("[SIGNING] Signing message failed, not sending it -", err)
+			continue
+		}
+		go p.sendMessageToPeerData(peerData, DataChannel, message, 0)
 	}
+}
 
-	for peerID := range contactList {
-		peerData := contactList[peerID]
+// send a string message to all active peers matching the recipient list and the selector
+// channel: the kind of the message, it decides the protocol of the streams
+// message: the string to send
+// recipients: peer ids of the recipients, * to broadcast to all active peers
+// selector: filter narrowing down the recipients (nil to send to all recipients)
+// strategy: how the message is spread among the recipients (nil to use the configured default)
+func (p *Peer) SendMessageToPeers(channel Channel, message string, recipients []string, selector *schema.Selector, strategy *schema.Strategy) {
+	contactList := p.selectContacts(recipients, selector, strategy)
 
-		go p.sendMessageToPeerData(peerData, message, 0)
+	for _, peerData := range contactList {
+		go p.sendMessageToPeerData(peerData, channel, message, 0)
 	}
 }
+
+// resolve recipients and the selector, then sample the result according to the strategy
+func (p *Peer) selectContacts(recipients []string, selector *schema.Selector, strategy *schema.Strategy) []*PeerData {
+	candidates := p.peerstore.SelectRecipients(recipients, selector)
+	return SelectPeers(candidates, strategy, p.strategy)
+}
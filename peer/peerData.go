@@ -1,9 +1,16 @@
 package peer
 
 import (
+	"encoding/json"
 	"fmt"
+	"sort"
 	"strings"
+	"sync"
 	"time"
+
+	"github.com/stratosphereips/p2p4slips/database"
+	"github.com/stratosphereips/p2p4slips/peerdb"
+	"github.com/stratosphereips/p2p4slips/schema"
 )
 
 type PeerData struct {
@@ -16,8 +23,143 @@ type PeerData struct {
 	LastMultiAddress      string
 	BasicInteractions     []float64
 	BasicInteractionTimes []time.Time
+	InteractionEvents     []InteractionEvent // what each of the BasicInteractions was for
+	RttSamples            []float64          // round trip times of the last pings, in milliseconds
+	Capabilities          *Capabilities
+	ProtocolVersion       int         // highest protocol version supported by both sides, 0 if there is none
+	ReportQuality         float64     // average of ReportRatings
+	ReportRatings         []float64   // ratings of reports of the peer, sent by slips
+	ReportRatingTimes     []time.Time // when each of the ReportRatings was received
 	// TODO: move all manipulation to getters and setters, which notify slips
 
+	// guards the interaction history, which grows while the peerstore is being saved
+	mutex sync.Mutex
+	// database where new interactions are written as they happen, nil if the peerstore is saved to a file
+	history *peerdb.DB
+	// where updates of the peer are sent
+	bus database.Bus
+	// which interactions are sent to slips
+	shareInteractions string
+	// weight of the report quality in the trust, the rest is reliability
+	qualityWeight float64
+}
+
+// Marshal the peer data without the interaction history, which the database stores separately
+func (pd *PeerData) recordJSON() ([]byte, error) {
+	pd.mutex.Lock()
+	defer pd.mutex.Unlock()
+
+	type plainPeerData PeerData
+	record := plainPeerData{
+		PeerID:            pd.PeerID,
+		LastUsedIP:        pd.LastUsedIP,
+		Version:           pd.Version,
+		Reliability:       pd.Reliability,
+		LastInteraction:   pd.LastInteraction,
+		LastGoodPing:      pd.LastGoodPing,
+		LastMultiAddress:  pd.LastMultiAddress,
+		RttSamples:        pd.RttSamples,
+		Capabilities:      pd.Capabilities,
+		ProtocolVersion:   pd.ProtocolVersion,
+		ReportQuality:     pd.ReportQuality,
+		ReportRatings:     pd.ReportRatings,
+		ReportRatingTimes: pd.ReportRatingTimes,
+	}
+	return json.Marshal(&record)
+}
+
+// Forget interactions and report ratings older than the cutoff
+// return bool: true if anything was removed
+func (pd *PeerData) dropInteractionsBefore(cutoff time.Time) bool {
+	pd.mutex.Lock()
+	defer pd.mutex.Unlock()
+
+	removed := false
+	keep := sort.Search(len(pd.BasicInteractionTimes), func(i int) bool {
+		return !pd.BasicInteractionTimes[i].Before(cutoff)
+	})
+	if keep > 0 {
+		pd.alignEvents()
+		pd.BasicInteractions = append([]float64(nil), pd.BasicInteractions[keep:]...)
+		pd.BasicInteractionTimes = append([]time.Time(nil), pd.BasicInteractionTimes[keep:]...)
+		pd.InteractionEvents = append([]InteractionEvent(nil), pd.InteractionEvents[keep:]...)
+		if len(pd.BasicInteractions) > 0 {
+			pd.Reliability = pd.computeReliability()
+		}
+		removed = true
+	}
+
+	keep = sort.Search(len(pd.ReportRatingTimes), func(i int) bool {
+		return !pd.ReportRatingTimes[i].Before(cutoff)
+	})
+	if keep > 0 {
+		pd.ReportRatings = append([]float64(nil), pd.ReportRatings[keep:]...)
+		pd.ReportRatingTimes = append([]time.Time(nil), pd.ReportRatingTimes[keep:]...)
+		if len(pd.ReportRatings) == 0 {
+			pd.ReportQuality = 0
+		}
+		pd.updateReportQuality()
+		removed = true
+	}
+	return removed
+}
+
+// Cut the history lists of a peer read from a file to the same length, so every rating has its time (and its event).
+// A hand edited or truncated file can have lists of different lengths, the oldest entries of the longer list are
+// dropped then. Must be called before the peer data is shared
+// return bool: true if any list was cut
+func (pd *PeerData) repairHistory() bool {
+	repaired := false
+	if n := len(pd.BasicInteractions); len(pd.BasicInteractionTimes) != n {
+		if len(pd.BasicInteractionTimes) < n {
+			n = len(pd.BasicInteractionTimes)
+		}
+		pd.BasicInteractions = pd.BasicInteractions[len(pd.BasicInteractions)-n:]
+		pd.BasicInteractionTimes = pd.BasicInteractionTimes[len(pd.BasicInteractionTimes)-n:]
+		repaired = true
+	}
+	// events may be missing for old interactions, but there can't be more events than interactions
+	if len(pd.InteractionEvents) > len(pd.BasicInteractions) {
+		pd.InteractionEvents = pd.InteractionEvents[len(pd.InteractionEvents)-len(pd.BasicInteractions):]
+		repaired = true
+	}
+	if repaired && len(pd.BasicInteractions) > 0 {
+		pd.Reliability = pd.computeReliability()
+	}
+	if n := len(pd.ReportRatings); len(pd.ReportRatingTimes) != n {
+		if len(pd.ReportRatingTimes) < n {
+			n = len(pd.ReportRatingTimes)
+		}
+		pd.ReportRatings = pd.ReportRatings[len(pd.ReportRatings)-n:]
+		pd.ReportRatingTimes = pd.ReportRatingTimes[len(pd.ReportRatingTimes)-n:]
+		pd.updateReportQuality()
+		repaired = true
+	}
+	return repaired
+}
+
+// Marshal the peer data, without interactions being added in the middle
+func (pd *PeerData) MarshalJSON() ([]byte, error) {
+	pd.mutex.Lock()
+	defer pd.mutex.Unlock()
+
+	// the conversion drops the methods of PeerData, so this doesn't call MarshalJSON again
+	type plainPeerData PeerData
+	return json.Marshal((*plainPeerData)(pd))
+}
+
+// Return when the peer last answered a ping or was pinged by it
+func (pd *PeerData) GetLastGoodPing() time.Time {
+	pd.mutex.Lock()
+	defer pd.mutex.Unlock()
+	return pd.LastGoodPing
+}
+
+// Remember that the peer answered a ping or was pinged by it
+func (pd *PeerData) SetLastGoodPing(t time.Time) {
+	pd.mutex.Lock()
+	pd.LastGoodPing = t
+	pd.mutex.Unlock()
 }
 
 func (pd *PeerData) SetMultiaddr(multiAddress string) {
@@ -44,69 +186,131 @@ func (pd *PeerData) SetVersion(value string) bool {
 	return true
 }
 
-func (pd *PeerData) ShouldIPingPeer() bool {
-	lastPing := pd.LastGoodPing
-
-	//fmt.Println("[PEER PING] last contact was ", lastPing)
+// Store the capabilities of the peer and the negotiated protocol version, and let slips know
+func (pd *PeerData) SetCapabilities(caps *Capabilities, protocolVersion int) {
+	pd.mutex.Lock()
+	pd.Capabilities = caps
+	pd.ProtocolVersion = protocolVersion
+	pd.mutex.Unlock()
+	SharePeerDataUpdate(pd)
+}
 
-	if lastPing.IsZero() {
-		return true
+// Return the capabilities of the peer, and false if the peer is incompatible with this node
+// Peers that haven't completed the handshake yet are treated as version 1 peers
+func (pd *PeerData) GetCapabilities() (*Capabilities, bool) {
+	pd.mutex.Lock()
+	defer pd.mutex.Unlock()
+	if pd.Capabilities == nil {
+		return &legacyCapabilities, true
 	}
-
-	timeSinceLastPing := time.Since(lastPing)
-	//fmt.Println("[PEER PING] time since last contact is ", timeSinceLastPing)
-
-	// TODO: justify the constant
-	// do not ping a peer that has been contacted less than five minutes ago
-	return timeSinceLastPing >= 15*time.Second
+	return pd.Capabilities, pd.ProtocolVersion > 0
 }
 
-func (pd *PeerData) ShouldIDeactivatePeer() bool {
-	lastPing := pd.LastGoodPing
-
-	if lastPing.IsZero() {
-		// if no ping ever happened, do not deactivate
-		return false
+// fill in the result of the capability handshake, if it happened
+func (pd *PeerData) addCapabilities(update *schema.PeerUpdate) {
+	pd.mutex.Lock()
+	defer pd.mutex.Unlock()
+	if pd.Capabilities == nil {
+		return
 	}
-
-	timeSinceLastPing := time.Since(lastPing)
-	//fmt.Println("[PEER PING] time since last contact is ", timeSinceLastPing)
-
-	// TODO: justify the constant
-	// if last contact was less than a minute ago, the peer should be considered active (return false)
-	// deactivate only if time since last (successful) ping is more than one minute (return false)
-	return timeSinceLastPing >= 60*time.Second
+	compatible := pd.ProtocolVersion > 0
+	update.Compatible = &compatible
+	update.ProtocolVersion = pd.ProtocolVersion
+	update.Features = pd.Capabilities.Features
 }
 
-func (pd *PeerData) CanHePingMe() bool {
+// Rate an interaction with the peer and update its reliability
+// kind: what the interaction was, one of the Interaction constants
+// outcome: how it ended, one of the Outcome constants
+// rating: between 0 (bad) and 1 (good)
+// details: optional description, for example the error
+func (pd *PeerData) AddInteraction(kind string, outcome string, rating float64, details string) {
+	interaction := peerdb.Interaction{Time: time.Now(), Rating: rating, Kind: kind, Outcome: outcome,
+		Details: details}
+	pd.mutex.Lock()
+	pd.alignEvents()
+	pd.BasicInteractions = append(pd.BasicInteractions, rating)
+	pd.BasicInteractionTimes = append(pd.BasicInteractionTimes, interaction.Time)
+	pd.InteractionEvents = append(pd.InteractionEvents, InteractionEvent{Kind: kind, Outcome: outcome,
+		Details: details})
+	pd.trimHistory()
+
+	reliability := pd.computeReliability()
+	changed := reliability != pd.Reliability
+	pd.Reliability = reliability
+	pd.mutex.Unlock()
 
-	lastPing := pd.LastGoodPing
+	if pd.history != nil {
+		if err := pd.history.AddInteractions(pd.PeerID, interaction); err != nil {
+			fmt.Println("[PEERDB] Saving interaction failed:", err)
+		}
+	}
 
-	//fmt.Println("[PEER PING] last contact was ", lastPing)
+	pd.shareInteraction(interaction, reliability)
+	if changed {
+		SharePeerDataUpdate(pd)
+	}
+}
 
-	if lastPing.IsZero() {
-		return true
+// Remember the round trip time of a ping. Only the last rttWindow samples are kept
+func (pd *PeerData) AddRttSample(rtt time.Duration) {
+	pd.mutex.Lock()
+	defer pd.mutex.Unlock()
+	pd.RttSamples = append(pd.RttSamples, float64(rtt)/float64(time.Millisecond))
+	if len(pd.RttSamples) > rttWindow {
+		pd.RttSamples = pd.RttSamples[len(pd.RttSamples)-rttWindow:]
 	}
+}
 
-	timeSinceLastPing := time.Since(lastPing)
-	//fmt.Println("[PEER PING] time since last contact is ", timeSinceLastPing)
+// Return the given percentile (0-100) of the recent round trip times in milliseconds, and false if there are no samples
+func (pd *PeerData) RttPercentile(percentile float64) (float64, bool) {
+	pd.mutex.Lock()
+	defer pd.mutex.Unlock()
+	if len(pd.RttSamples) == 0 {
+		return 0, false
+	}
+	return percentileOf(pd.RttSamples, percentile), true
+}
 
-	// TODO: justify the constant
-	// if this is less than five seconds, he should not be pinging me (return false)
-	// if he has pinged me already, and it has been more than 5s ago, he can ping me (return true)
-	return timeSinceLastPing >= 5*time.Second
+// summarize the recent round trip times for slips, nil if the peer was never pinged
+func (pd *PeerData) latencySummary() *schema.Latency {
+	pd.mutex.Lock()
+	defer pd.mutex.Unlock()
+	if len(pd.RttSamples) == 0 {
+		return nil
+	}
+	return &schema.Latency{
+		P50:     percentileOf(pd.RttSamples, 50),
+		P90:     percentileOf(pd.RttSamples, 90),
+		P99:     percentileOf(pd.RttSamples, 99),
+		Samples: len(pd.RttSamples),
+	}
 }
 
-func (pd *PeerData) AddBasicInteraction(rating float64) {
-	// TODO change ping to include latency in score
-	timestamp := time.Now()
-	pd.BasicInteractions = append(pd.BasicInteractions, rating)
-	pd.BasicInteractionTimes = append(pd.BasicInteractionTimes, timestamp)
+// Take over the interactions of the peer's previous identity. Older interactions go first, so the history stays ordered
+func (pd *PeerData) inheritHistory(old *PeerData) {
+	old.mutex.Lock()
+	defer old.mutex.Unlock()
+	pd.mutex.Lock()
+	defer pd.mutex.Unlock()
 
-	reliability := ComputeReliability(pd.BasicInteractions)
-	if reliability == pd.Reliability {
-		return
+	old.alignEvents()
+	pd.alignEvents()
+	pd.BasicInteractions = append(append([]float64(nil), old.BasicInteractions...), pd.BasicInteractions...)
+	pd.BasicInteractionTimes = append(append([]time.Time(nil), old.BasicInteractionTimes...), pd.BasicInteractionTimes...)
+	pd.InteractionEvents = append(append([]InteractionEvent(nil), old.InteractionEvents...), pd.InteractionEvents...)
+	pd.RttSamples = append(append([]float64(nil), old.RttSamples...), pd.RttSamples...)
+	if len(pd.RttSamples) > rttWindow {
+		pd.RttSamples = pd.RttSamples[len(pd.RttSamples)-rttWindow:]
 	}
-	pd.Reliability = reliability
-	SharePeerDataUpdate(pd)
+	if pd.Version == "" {
+		pd.Version = old.Version
+	}
+	pd.ReportRatings = append(append([]float64(nil), old.ReportRatings...), pd.ReportRatings...)
+	pd.ReportRatingTimes = append(append([]time.Time(nil), old.ReportRatingTimes...), pd.ReportRatingTimes...)
+	pd.updateReportQuality()
+	if len(pd.BasicInteractions) > 0 {
+		pd.Reliability = pd.computeReliability()
+	}
+	pd.trimHistory()
 }
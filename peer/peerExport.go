@@ -0,0 +1,246 @@
+package peer
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/crypto"
+	libp2ppeer "github.com/libp2p/go-libp2p-core/peer"
+	"github.com/stratosphereips/p2p4slips/peerdb"
+)
+
+// identifies files created by Export
+const (
+	exportFormat        = "p2p4slips-peers"
+	exportFormatVersion = 1
+)
+
+// PeerExport is the portable form of a peerstore. The payload (a marshaled ExportPayload) is signed by the key of the
+// exporting node, so the importer can check who created the file and that it was not changed since.
+type PeerExport struct {
+	Format    string `json:"format"`
+	Version   int    `json:"version"`
+	PublicKey []byte `json:"public_key"`
+	Payload   []byte `json:"payload"`
+	Signature []byte `json:"signature"`
+}
+
+type ExportPayload struct {
+	Exporter string         `json:"exporter"`
+	Created  time.Time      `json:"created"`
+	Peers    []ExportedPeer `json:"peers"`
+}
+
+type ExportedPeer struct {
+	PeerID          string                `json:"peerid"`
+	Ip              string                `json:"ip,omitempty"`
+	MultiAddress    string                `json:"multiaddress,omitempty"`
+	Version         string                `json:"version,omitempty"`
+	Reliability     float64               `json:"reliability"`
+	LastInteraction time.Time             `json:"last_interaction"`
+	Interactions    []ExportedInteraction `json:"interactions,omitempty"`
+}
+
+type ExportedInteraction struct {
+	Time    time.Time `json:"time"`
+	Rating  float64   `json:"rating"`
+	Kind    string    `json:"kind,omitempty"`
+	Outcome string    `json:"outcome,omitempty"`
+	Details string    `json:"details,omitempty"`
+}
+
+// Export all known peers, signed by the given key
+func (ps *PeerStore) Export(key crypto.PrivKey) ([]byte, error) {
+	exporter, err := libp2ppeer.IDFromPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	payload := ExportPayload{Exporter: exporter.Pretty(), Created: time.Now().UTC()}
+	for _, peerData := range ps.allPeerList() {
+		exported := peerData.export()
+		// with a database, memory only holds the latest part of the history
+		if ps.DB != nil {
+			interactions, err := ps.DB.Interactions(peerData.PeerID, time.Time{})
+			if err != nil {
+				return nil, err
+			}
+			exported.Interactions = nil
+			for _, interaction := range interactions {
+				exported.Interactions = append(exported.Interactions, exportedInteraction(interaction))
+			}
+		}
+		payload.Peers = append(payload.Peers, exported)
+	}
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := key.Sign(data)
+	if err != nil {
+		return nil, err
+	}
+	publicKey, err := crypto.MarshalPublicKey(key.GetPublic())
+	if err != nil {
+		return nil, err
+	}
+
+	return json.MarshalIndent(PeerExport{Format: exportFormat, Version: exportFormatVersion, PublicKey: publicKey,
+		Payload: data, Signature: signature}, "", "  ")
+}
+
+// Check the format and the signature of an exported peerstore and return its content
+func VerifyExport(data []byte) (*ExportPayload, error) {
+	export := &PeerExport{}
+	if err := json.Unmarshal(data, export); err != nil {
+		return nil, err
+	}
+	if export.Format != exportFormat {
+		return nil, errors.New("not an exported peerstore")
+	}
+	if export.Version != exportFormatVersion {
+		return nil, fmt.Errorf("unsupported export version %d", export.Version)
+	}
+
+	publicKey, err := crypto.UnmarshalPublicKey(export.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	if ok, err := publicKey.Verify(export.Payload, export.Signature); err != nil || !ok {
+		return nil, errors.New("invalid signature")
+	}
+
+	payload := &ExportPayload{}
+	if err = json.Unmarshal(export.Payload, payload); err != nil {
+		return nil, err
+	}
+
+	// the claimed exporter must own the key that signed the file
+	signer, err := libp2ppeer.IDFromPublicKey(publicKey)
+	if err != nil {
+		return nil, err
+	}
+	if signer.Pretty() != payload.Exporter {
+		return nil, errors.New("export was signed by a different peer than the exporter")
+	}
+	return payload, nil
+}
+
+// Merge imported peers into the peerstore
+// For peers known on both sides, the record with the latest interaction wins.
+// keepReliability: take over the interaction history (and so the reliability) from the winning record. If false,
+// imported peers start with no history, and known peers keep their local history.
+// return added, updated: number of new peers and number of known peers replaced by the imported record
+func (ps *PeerStore) MergePeers(peers []ExportedPeer, keepReliability bool) (added int, updated int) {
+	for _, imported := range peers {
+		if imported.PeerID == "" {
+			continue
+		}
+		// the history must be oldest first, but the file may have been edited or created by another tool
+		imported.Interactions = sortedInteractions(imported.Interactions)
+
+		ps.mutex.Lock()
+		local, known := ps.AllPeers[imported.PeerID]
+		if !known {
+			local = &PeerData{PeerID: imported.PeerID}
+			ps.adopt(local)
+			ps.AllPeers[imported.PeerID] = local
+		}
+		ps.mutex.Unlock()
+
+		if known && !imported.LastInteraction.After(local.LastInteraction) {
+			// local record is newer, nothing to merge
+			continue
+		}
+
+		local.mutex.Lock()
+		local.LastUsedIP = imported.Ip
+		local.LastMultiAddress = imported.MultiAddress
+		local.Version = imported.Version
+		local.LastInteraction = imported.LastInteraction
+		if keepReliability {
+			local.BasicInteractions = nil
+			local.BasicInteractionTimes = nil
+			local.InteractionEvents = nil
+			for _, interaction := range imported.Interactions {
+				local.appendInteraction(interaction.stored())
+			}
+			local.Reliability = imported.Reliability
+			if len(local.BasicInteractions) > 0 {
+				local.Reliability = local.computeReliability()
+			}
+			local.trimHistory()
+		}
+		local.mutex.Unlock()
+
+		if keepReliability && ps.DB != nil {
+			ps.replaceHistoryInDB(imported)
+		}
+
+		if known {
+			updated++
+		} else {
+			added++
+		}
+	}
+	return added, updated
+}
+
+// copy of the interactions, ordered by time
+func sortedInteractions(interactions []ExportedInteraction) []ExportedInteraction {
+	sorted := append([]ExportedInteraction(nil), interactions...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Time.Before(sorted[j].Time)
+	})
+	return sorted
+}
+
+// replace the stored history of the peer with the imported one
+func (ps *PeerStore) replaceHistoryInDB(imported ExportedPeer) {
+	interactions := make([]peerdb.Interaction, len(imported.Interactions))
+	for i, interaction := range imported.Interactions {
+		interactions[i] = interaction.stored()
+	}
+
+	err := ps.DB.DeletePeer(imported.PeerID)
+	if err == nil {
+		err = ps.DB.AddInteractions(imported.PeerID, interactions...)
+	}
+	if err != nil {
+		fmt.Printf("[PEERDB] Importing history of peer %s failed: %s\n", imported.PeerID, err)
+	}
+}
+
+func (pd *PeerData) export() ExportedPeer {
+	pd.mutex.Lock()
+	defer pd.mutex.Unlock()
+
+	exported := ExportedPeer{
+		PeerID:          pd.PeerID,
+		Ip:              pd.LastUsedIP,
+		MultiAddress:    pd.LastMultiAddress,
+		Version:         pd.Version,
+		Reliability:     pd.Reliability,
+		LastInteraction: pd.LastInteraction.UTC(),
+	}
+	for i := range pd.BasicInteractions {
+		exported.Interactions = append(exported.Interactions, exportedInteraction(pd.interactionAt(i)))
+	}
+	return exported
+}
+
+// the portable form of a stored interaction
+func exportedInteraction(interaction peerdb.Interaction) ExportedInteraction {
+	return ExportedInteraction{Time: interaction.Time.UTC(), Rating: interaction.Rating, Kind: interaction.Kind,
+		Outcome: interaction.Outcome, Details: interaction.Details}
+}
+
+// the interaction as it is stored in the history
+func (ei ExportedInteraction) stored() peerdb.Interaction {
+	return peerdb.Interaction{Time: ei.Time, Rating: ei.Rating, Kind: ei.Kind, Outcome: ei.Outcome,
+		Details: ei.Details}
+}
@@ -4,28 +4,59 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"sync"
 	"time"
 
 	"github.com/libp2p/go-libp2p-core/crypto"
 	"github.com/libp2p/go-libp2p-core/peerstore"
+	"github.com/stratosphereips/p2p4slips/database"
+	"github.com/stratosphereips/p2p4slips/peerdb"
+	"github.com/stratosphereips/p2p4slips/utils"
 )
 
 type PeerStore struct {
-	Store       peerstore.Peerstore
-	SaveFile    string
+	Store    peerstore.Peerstore
+	SaveFile string
+	// if set, peers are stored in this database instead of the save file
+	DB *peerdb.DB
+	// updates of peers are sent to slips over the bus, nil to not send them
+	Bus database.Bus
+	// which interactions with peers are sent to slips: none, failures or all
+	ShareInteractions string
+	// weight of the report quality in the trust of peers, between 0 and 1
+	ReportQualityWeight float64
+	// interactions older than this are forgotten, zero keeps the whole history
+	Retention   time.Duration
 	AllPeers    map[string]*PeerData
 	ActivePeers map[string]*PeerData
+	// guards both peer maps, they are used by the listener, the ping scheduler and the slips listener at once
+	mutex     sync.RWMutex
+	saveMutex sync.Mutex
 }
 
+// the previous snapshot of the peerstore is kept in a file with this suffix
+const backupSuffix = ".bak"
+
+// Save all peers to the save file. The file is replaced atomically, and the previous snapshot is kept as a backup
 func (ps *PeerStore) SaveToFile(key crypto.PrivKey) error {
+	if ps.DB != nil {
+		return ps.saveToDB()
+	}
+
 	if ps.SaveFile == "" {
 		fmt.Println("[PEERSTORE] No save file provided, data is not saved.")
 		return nil
 	}
 
+	// periodic saves and the final save on shutdown must not interleave
+	ps.saveMutex.Lock()
+	defer ps.saveMutex.Unlock()
+
 	// save all data from peerstore to file, encrypted by private key
 
+	ps.mutex.RLock()
 	marshaledPeerData, err := json.Marshal(ps.AllPeers)
+	ps.mutex.RUnlock()
 	if err != nil {
 		fmt.Println("[PEERSTORE] PeerStore saving failed:", err)
 		return err
@@ -36,7 +67,14 @@ func (ps *PeerStore) SaveToFile(key crypto.PrivKey) error {
 	//encryptedData, err := rsa.EncryptPKCS1v15(r, &key, marshaledPeerData)
 	encryptedData := marshaledPeerData
 
-	err = ioutil.WriteFile(ps.SaveFile, encryptedData, 0600)
+	// keep the previous snapshot, but only if it is readable - a corrupt file would replace a good backup
+	if previous, err := ioutil.ReadFile(ps.SaveFile); err == nil && parsePeers(previous) == nil {
+		if err = utils.WriteFileAtomic(ps.SaveFile+backupSuffix, previous, 0600); err != nil {
+			fmt.Println("[PEERSTORE] PeerStore backup failed:", err)
+		}
+	}
+
+	err = utils.WriteFileAtomic(ps.SaveFile, encryptedData, 0600)
 	if err != nil {
 		fmt.Println("[PEERSTORE] PeerStore saving failed:", err)
 		return err
@@ -45,46 +83,256 @@ func (ps *PeerStore) SaveToFile(key crypto.PrivKey) error {
 	return nil
 }
 
+// Save the peerstore periodically until the stop channel is closed
+// interval: time between two snapshots, zero disables periodic saving
+func (ps *PeerStore) AutoSave(key crypto.PrivKey, interval time.Duration, stop <-chan struct{}) {
+	if interval <= 0 || (ps.SaveFile == "" && ps.DB == nil) {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			ps.Prune()
+			if err := ps.SaveToFile(key); err == nil {
+				fmt.Println("[PEERSTORE] Saved peerstore snapshot")
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Load peers from the save file. If it is missing or corrupt, the backup of the previous snapshot is used instead
 func (ps *PeerStore) ReadFromFile(privateKey crypto.PrivKey) {
 	ps.AllPeers = make(map[string]*PeerData)
 	ps.ActivePeers = make(map[string]*PeerData)
 
+	if ps.DB != nil {
+		ps.readFromDB()
+		return
+	}
+
 	if ps.SaveFile == "" {
 		fmt.Println("[PEERSTORE] Using empty peerstore")
 		return
 	}
 
-	encryptedData, err := ioutil.ReadFile(ps.SaveFile)
+	for _, file := range []string{ps.SaveFile, ps.SaveFile + backupSuffix} {
+		peers, err := readPeersFile(file)
+		if err != nil {
+			fmt.Printf("[PEERSTORE] PeerStore loading from '%s' failed: %s\n", file, err)
+			continue
+		}
+
+		for _, peerData := range peers {
+			ps.adopt(peerData)
+		}
+		ps.AllPeers = peers
+		fmt.Printf("[PEERSTORE] Loaded peerstore from '%s'\n", file)
+		fmt.Println(ps.AllPeers)
+		fmt.Println("[PEERSTORE] --- END OF PEERSTORE DATA ---")
+		return
+	}
+
+	fmt.Println("[PEERSTORE] Using empty peerstore")
+}
 
+// save the records of all peers to the database. Interactions are not included, they are written as they happen
+func (ps *PeerStore) saveToDB() error {
+	ps.saveMutex.Lock()
+	defer ps.saveMutex.Unlock()
+
+	records := make(map[string][]byte)
+	ps.mutex.RLock()
+	for peerId, peerData := range ps.AllPeers {
+		record, err := peerData.recordJSON()
+		if err != nil {
+			ps.mutex.RUnlock()
+			fmt.Println("[PEERDB] Saving peers failed:", err)
+			return err
+		}
+		records[peerId] = record
+	}
+	ps.mutex.RUnlock()
+
+	if err := ps.DB.PutPeers(records); err != nil {
+		fmt.Println("[PEERDB] Saving peers failed:", err)
+		return err
+	}
+	return nil
+}
+
+// load peers and the part of their history the reliability is computed from from the database
+// If the database is empty, peers are imported from the save file (if there is one)
+func (ps *PeerStore) readFromDB() {
+	records, err := ps.DB.Peers()
 	if err != nil {
-		fmt.Println("[PEERSTORE] PeerStore loading failed:", err)
+		fmt.Println("[PEERDB] Loading peers failed:", err)
 		fmt.Println("[PEERSTORE] Using empty peerstore")
 		return
 	}
 
-	// TODO: implement verification/decryption
-	marshaledData := encryptedData
+	if len(records) == 0 {
+		ps.importFileToDB()
+		return
+	}
 
-	err = json.Unmarshal(marshaledData, &ps.AllPeers)
+	since := ps.retentionCutoff()
+	for peerId, record := range records {
+		peerData := &PeerData{}
+		if err = json.Unmarshal(record, peerData); err != nil {
+			fmt.Printf("[PEERDB] Skipping peer %s, its record is corrupt: %s\n", peerId, err)
+			continue
+		}
 
-	if err != nil {
-		fmt.Println("[PEERSTORE] PeerStore loading failed:", err)
+		// the rest of the history is read from the database when it is queried or exported
+		interactions, err := ps.DB.LastInteractions(peerId, since, reliabilityWindow)
+		if err != nil {
+			fmt.Printf("[PEERDB] Loading history of peer %s failed: %s\n", peerId, err)
+		}
+		for _, interaction := range interactions {
+			peerData.appendInteraction(interaction)
+		}
+		if len(peerData.BasicInteractions) > 0 {
+			peerData.Reliability = peerData.computeReliability()
+		}
+
+		ps.adopt(peerData)
+		ps.AllPeers[peerId] = peerData
+	}
+	fmt.Printf("[PEERDB] Loaded %d peers from the database\n", len(ps.AllPeers))
+}
+
+// move the peers from the save file to the empty database, including their whole history
+func (ps *PeerStore) importFileToDB() {
+	if ps.SaveFile == "" {
 		fmt.Println("[PEERSTORE] Using empty peerstore")
 		return
 	}
 
-	fmt.Println("[PEERSTORE] Loaded peerstore")
-	fmt.Println(ps.AllPeers)
-	fmt.Println("[PEERSTORE] --- END OF PEERSTORE DATA ---")
+	for _, file := range []string{ps.SaveFile, ps.SaveFile + backupSuffix} {
+		peers, err := readPeersFile(file)
+		if err != nil {
+			continue
+		}
+
+		for peerId, peerData := range peers {
+			interactions := make([]peerdb.Interaction, len(peerData.BasicInteractions))
+			for i := range interactions {
+				interactions[i] = peerData.interactionAt(i)
+			}
+			if err = ps.DB.AddInteractions(peerId, interactions...); err != nil {
+				fmt.Printf("[PEERDB] Importing history of peer %s failed: %s\n", peerId, err)
+			}
+			ps.adopt(peerData)
+		}
+		ps.AllPeers = peers
+		fmt.Printf("[PEERDB] Imported %d peers from '%s'\n", len(peers), file)
+		_ = ps.saveToDB()
+		return
+	}
+	fmt.Println("[PEERSTORE] Using empty peerstore")
+}
+
+// Forget interactions and report ratings older than the retention period, both in memory and in the database
+func (ps *PeerStore) Prune() {
+	if ps.Retention <= 0 {
+		return
+	}
+	cutoff := ps.retentionCutoff()
+
+	for _, peerData := range ps.allPeerList() {
+		peerData.dropInteractionsBefore(cutoff)
+	}
+
+	if ps.DB != nil {
+		deleted, err := ps.DB.Prune(cutoff)
+		if err != nil {
+			fmt.Println("[PEERDB] Pruning old interactions failed:", err)
+		} else if deleted > 0 {
+			fmt.Printf("[PEERDB] Pruned %d old interactions\n", deleted)
+		}
+	}
+}
+
+// Return interactions of the peer since the given time, oldest first
+// With a database, the whole stored history is searched, otherwise only interactions kept in memory
+func (ps *PeerStore) InteractionsSince(peerId string, since time.Time) ([]peerdb.Interaction, error) {
+	if ps.DB != nil {
+		return ps.DB.Interactions(peerId, since)
+	}
+
+	peerData := ps.IsKnown(peerId)
+	if peerData == nil {
+		return nil, nil
+	}
+
+	peerData.mutex.Lock()
+	defer peerData.mutex.Unlock()
+	var interactions []peerdb.Interaction
+	for i, t := range peerData.BasicInteractionTimes {
+		if !t.Before(since) {
+			interactions = append(interactions, peerData.interactionAt(i))
+		}
+	}
+	return interactions, nil
+}
+
+// the oldest time that is kept, zero time if the whole history is kept
+func (ps *PeerStore) retentionCutoff() time.Time {
+	if ps.Retention <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(-ps.Retention)
+}
+
+func readPeersFile(file string) (map[string]*PeerData, error) {
+	encryptedData, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	// TODO: implement verification/decryption
+	marshaledData := encryptedData
+
+	peers := make(map[string]*PeerData)
+	if err = json.Unmarshal(marshaledData, &peers); err != nil {
+		return nil, err
+	}
+	for peerId, peerData := range peers {
+		if peerData.repairHistory() {
+			fmt.Printf("[PEERSTORE] History of peer %s in '%s' has lists of different lengths, keeping the %d "+
+				"latest interactions and %d latest report ratings\n", peerId, file, len(peerData.BasicInteractions),
+				len(peerData.ReportRatings))
+		}
+	}
+	return peers, nil
+}
+
+// check that the data is a valid peerstore snapshot
+func parsePeers(data []byte) error {
+	peers := make(map[string]*PeerData)
+	return json.Unmarshal(data, &peers)
 }
 
 func (ps *PeerStore) ActivatePeer(peerId string) (peerData *PeerData, isNew bool) {
+	ps.mutex.Lock()
+	peerData, isNew = ps.activatePeer(peerId)
+	ps.mutex.Unlock()
+
+	SharePeerDataUpdate(peerData)
+	return peerData, isNew
+}
+
+func (ps *PeerStore) activatePeer(peerId string) (peerData *PeerData, isNew bool) {
 
 	// check if he is active already
 	peerData, ok := ps.ActivePeers[peerId]
 	if ok {
 		peerData.LastInteraction = time.Now()
-		SharePeerDataUpdate(peerData)
 		return peerData, false
 	}
 
@@ -93,32 +341,51 @@ func (ps *PeerStore) ActivatePeer(peerId string) (peerData *PeerData, isNew bool
 	if ok {
 		// if yes, update his info and move him to active peer list
 		peerData.LastInteraction = time.Now()
-		SharePeerDataUpdate(peerData)
 		ps.ActivePeers[peerId] = peerData
 		return peerData, false
 	}
 
 	// the peer is completely new, he should be created...
-	peerData = ps.CreateNewPeer(peerId)
-	SharePeerDataUpdate(peerData)
-
-	return peerData, true
+	return ps.createNewPeer(peerId), true
 }
 
 func (ps *PeerStore) DeactivatePeer(peerId string) {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
 	delete(ps.ActivePeers, peerId)
 }
 
 func (ps *PeerStore) CreateNewPeer(peerId string) *PeerData {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+	return ps.createNewPeer(peerId)
+}
+
+func (ps *PeerStore) createNewPeer(peerId string) *PeerData {
 
 	peerData := &PeerData{PeerID: peerId, LastInteraction: time.Now()}
+	ps.adopt(peerData)
 	ps.ActivePeers[peerId] = peerData
 	ps.AllPeers[peerId] = peerData
 
 	return peerData
 }
 
+// link the peer to the database and the bus of the store
+func (ps *PeerStore) adopt(peerData *PeerData) {
+	peerData.history = ps.DB
+	peerData.bus = ps.Bus
+	peerData.shareInteractions = ps.ShareInteractions
+	peerData.qualityWeight = ps.ReportQualityWeight
+	peerData.mutex.Lock()
+	peerData.alignEvents()
+	peerData.trimHistory()
+	peerData.mutex.Unlock()
+}
+
 func (ps *PeerStore) IsActivePeer(peerId string) *PeerData {
+	ps.mutex.RLock()
+	defer ps.mutex.RUnlock()
 	peerData, ok := ps.ActivePeers[peerId]
 	if ok {
 		return peerData
@@ -127,6 +394,8 @@ func (ps *PeerStore) IsActivePeer(peerId string) *PeerData {
 }
 
 func (ps *PeerStore) IsKnown(peerId string) *PeerData {
+	ps.mutex.RLock()
+	defer ps.mutex.RUnlock()
 	peerData, ok := ps.ActivePeers[peerId]
 	if ok {
 		return peerData
@@ -137,3 +406,67 @@ func (ps *PeerStore) IsKnown(peerId string) *PeerData {
 	}
 	return nil
 }
+
+// Return a snapshot of all known peers
+func (ps *PeerStore) allPeerList() []*PeerData {
+	ps.mutex.RLock()
+	defer ps.mutex.RUnlock()
+	peers := make([]*PeerData, 0, len(ps.AllPeers))
+	for _, peerData := range ps.AllPeers {
+		peers = append(peers, peerData)
+	}
+	return peers
+}
+
+// Return a snapshot of the active peers, which is safe to iterate while peers are (de)activated
+func (ps *PeerStore) ActivePeerList() []*PeerData {
+	ps.mutex.RLock()
+	defer ps.mutex.RUnlock()
+	peers := make([]*PeerData, 0, len(ps.ActivePeers))
+	for _, peerData := range ps.ActivePeers {
+		peers = append(peers, peerData)
+	}
+	return peers
+}
+
+// Move the history of a peer that rotated its key to its new identity, and forget the old identity
+// return bool: true if the old identity was known and its history was moved
+func (ps *PeerStore) CarryOverReputation(oldId string, newId string) bool {
+	ps.mutex.Lock()
+	oldData, ok := ps.AllPeers[oldId]
+	if !ok || oldId == newId {
+		ps.mutex.Unlock()
+		return false
+	}
+
+	newData, ok := ps.AllPeers[newId]
+	if !ok {
+		newData = ps.createNewPeer(newId)
+	}
+	newData.inheritHistory(oldData)
+
+	delete(ps.AllPeers, oldId)
+	delete(ps.ActivePeers, oldId)
+	ps.mutex.Unlock()
+
+	if ps.DB != nil {
+		ps.moveHistoryInDB(oldId, newId)
+	}
+
+	SharePeerDataUpdate(newData)
+	return true
+}
+
+// move the stored interactions of the old identity to the new one
+func (ps *PeerStore) moveHistoryInDB(oldId string, newId string) {
+	interactions, err := ps.DB.Interactions(oldId, time.Time{})
+	if err == nil {
+		err = ps.DB.AddInteractions(newId, interactions...)
+	}
+	if err == nil {
+		err = ps.DB.DeletePeer(oldId)
+	}
+	if err != nil {
+		fmt.Printf("[PEERDB] Moving history of %s to %s failed: %s\n", oldId, newId, err)
+	}
+}
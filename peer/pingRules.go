@@ -0,0 +1,64 @@
+package peer
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Decisions about pings that don't depend on the network. The simulator (package sim) makes its decisions with the
+// same functions, so changes here show up in its results.
+
+// NextPingInterval returns the interval until the next ping of a peer. Responsive peers are pinged less and less
+// often, up to the maximum interval. Unresponsive peers are checked at the base interval, so they are deactivated soon
+// interval: the current interval of the peer
+// ok: true if the ping succeeded, or was skipped since the peer was contacted recently
+func NextPingInterval(cfg PingConfig, interval time.Duration, ok bool) time.Duration {
+	if !ok {
+		return cfg.Interval
+	}
+	interval = time.Duration(float64(interval) * intervalBackoff)
+	if interval > cfg.MaxInterval {
+		interval = cfg.MaxInterval
+	}
+	return interval
+}
+
+// JitterInterval randomly shifts the interval by up to the configured jitter fraction, in both directions, so pings
+// to all peers are not sent at once
+func JitterInterval(cfg PingConfig, interval time.Duration, rnd *rand.Rand) time.Duration {
+	shift := cfg.Jitter * (2*rnd.Float64() - 1)
+	return time.Duration(float64(interval) * (1 + shift))
+}
+
+// PingDue says if the peer needs a ping. Peers that sent or answered a ping within the base interval are not pinged
+// lastGoodPing: last successful ping in either direction, zero if there was none
+func PingDue(cfg PingConfig, lastGoodPing time.Time, now time.Time) bool {
+	return lastGoodPing.IsZero() || now.Sub(lastGoodPing) >= cfg.Interval
+}
+
+// DeactivationDue says if the peer should be deactivated after a failed ping. Peers without a successful ping for
+// DeactivateAfter are deactivated, peers that never had a successful ping are kept
+func DeactivationDue(cfg PingConfig, lastGoodPing time.Time, now time.Time) bool {
+	return !lastGoodPing.IsZero() && now.Sub(lastGoodPing) >= cfg.DeactivateAfter
+}
+
+// RatePing rates a ping sent to the peer. A pong is rated by its round trip time, no pong at all is a failure
+// return float64: the rating
+// return string: the outcome
+func RatePing(cfg PingConfig, rtt time.Duration, replied bool) (float64, string) {
+	if !replied {
+		return 0, OutcomeFailure
+	}
+	return PingRating(rtt, cfg.Timeout), OutcomeSuccess
+}
+
+// RateReceivedPing rates a ping received from the peer. Pings within MinPingGap of the last successful ping (in
+// either direction) are floods
+// return float64: the rating
+// return string: the outcome
+func RateReceivedPing(cfg PingConfig, lastGoodPing time.Time, now time.Time) (float64, string) {
+	if !lastGoodPing.IsZero() && now.Sub(lastGoodPing) < cfg.MinPingGap {
+		return 0, OutcomeFlood
+	}
+	return 1, OutcomeSuccess
+}
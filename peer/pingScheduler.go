@@ -0,0 +1,169 @@
+package peer
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/stratosphereips/p2p4slips/utils"
+)
+
+// PingConfig holds the thresholds used for pinging peers
+type PingConfig struct {
+	// base interval between two pings of the same peer, also used to skip peers contacted recently
+	Interval time.Duration
+	// responsive peers are pinged less and less often, up to this interval
+	MaxInterval time.Duration
+	// the interval is randomly changed by up to this fraction, so pings to all peers are not sent at once
+	Jitter float64
+	// time to wait for a pong
+	Timeout time.Duration
+	// peers without a successful ping for this long are deactivated
+	DeactivateAfter time.Duration
+	// peers pinging this node more often than this are penalized
+	MinPingGap time.Duration
+	// maximum number of pings running at the same time
+	Parallelism int
+}
+
+// NewPingConfig takes the ping settings from the flags
+func NewPingConfig(cfg *utils.Config) PingConfig {
+	return PingConfig{
+		Interval:        cfg.PingInterval,
+		MaxInterval:     cfg.PingMaxInterval,
+		Jitter:          cfg.PingJitter,
+		Timeout:         cfg.PingTimeout,
+		DeactivateAfter: cfg.PingDeactivateAfter,
+		MinPingGap:      cfg.PingMinGap,
+		Parallelism:     cfg.PingParallelism,
+	}
+}
+
+// Validate checks that the intervals work together. The longest wait for a reply of a responsive peer (the maximum
+// interval with jitter, and the timeout) must be shorter than the time after which the peer is deactivated
+func (c PingConfig) Validate() error {
+	if c.Interval <= 0 || c.Timeout <= 0 {
+		return errors.New("ping interval and timeout must be positive")
+	}
+	if c.Jitter < 0 || c.Jitter >= 1 {
+		return errors.New("ping jitter must be at least 0 and less than 1")
+	}
+	if c.MaxInterval < c.Interval {
+		return errors.New("maximum ping interval must not be shorter than the ping interval")
+	}
+	if time.Duration(float64(c.MaxInterval)*(1+c.Jitter))+c.Timeout >= c.DeactivateAfter {
+		return errors.New("maximum ping interval with jitter, plus the ping timeout, must be shorter than the " +
+			"time after which peers are deactivated")
+	}
+	return nil
+}
+
+// how often the scheduler checks which peers are due for a ping
+const schedulerTick = time.Second
+
+// each successful ping multiplies the interval of the peer by this factor (up to MaxInterval)
+const intervalBackoff = 1.5
+
+type pingSchedule struct {
+	next     time.Time
+	interval time.Duration
+	inFlight bool
+}
+
+// pingScheduler pings active peers concurrently, each peer on its own adaptive interval
+type pingScheduler struct {
+	peer      *Peer
+	config    PingConfig
+	schedules map[string]*pingSchedule
+	mutex     sync.Mutex
+	slots     chan struct{}
+	rnd       *rand.Rand
+}
+
+func newPingScheduler(p *Peer, config PingConfig) *pingScheduler {
+	parallelism := config.Parallelism
+	if parallelism < 1 {
+		parallelism = 1
+	}
+	return &pingScheduler{
+		peer:      p,
+		config:    config,
+		schedules: make(map[string]*pingSchedule),
+		slots:     make(chan struct{}, parallelism),
+		rnd:       rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// run the scheduler until the peer is closing
+func (s *pingScheduler) run() {
+	ticker := time.NewTicker(schedulerTick)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.peer.stopped:
+			return
+		case <-ticker.C:
+			if s.peer.isClosing() {
+				return
+			}
+			s.pingDuePeers(time.Now())
+		}
+	}
+}
+
+// start a ping for every active peer whose time has come, and forget peers that are no longer active
+func (s *pingScheduler) pingDuePeers(now time.Time) {
+	activePeers := s.peer.peerstore.ActivePeerList()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	active := make(map[string]bool, len(activePeers))
+	for _, peerData := range activePeers {
+		active[peerData.PeerID] = true
+
+		schedule, ok := s.schedules[peerData.PeerID]
+		if !ok {
+			// spread the first pings of new peers over the base interval
+			schedule = &pingSchedule{interval: s.config.Interval}
+			schedule.next = now.Add(s.jitter(schedule.interval))
+			s.schedules[peerData.PeerID] = schedule
+			continue
+		}
+
+		if schedule.inFlight || now.Before(schedule.next) {
+			continue
+		}
+
+		schedule.inFlight = true
+		go s.ping(peerData, schedule)
+	}
+
+	for peerID, schedule := range s.schedules {
+		if !active[peerID] && !schedule.inFlight {
+			delete(s.schedules, peerID)
+		}
+	}
+}
+
+// ping one peer (waiting for a free slot first) and plan the next ping based on the result
+func (s *pingScheduler) ping(peerData *PeerData, schedule *pingSchedule) {
+	s.slots <- struct{}{}
+	ok := s.peer.sendPing(peerData)
+	<-s.slots
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	schedule.interval = NextPingInterval(s.config, schedule.interval, ok)
+	schedule.next = time.Now().Add(s.jitter(schedule.interval))
+	schedule.inFlight = false
+}
+
+// randomly shift the interval by up to the configured jitter fraction, in both directions
+// must be called with the mutex locked, since it uses the random source
+func (s *pingScheduler) jitter(interval time.Duration) time.Duration {
+	return JitterInterval(s.config, interval, s.rnd)
+}
@@ -0,0 +1,189 @@
+package peer
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/protocol"
+)
+
+// Channel is a kind of traffic between peers. Each channel has its own stream protocol, handler and limits, so for
+// example a flood of data messages doesn't stop pings from being answered.
+type Channel int
+
+const (
+	ControlChannel Channel = iota // hello, capabilities, key rotation, ping and goodbye
+	DataChannel                   // messages from slips
+	BulkChannel                   // large content from slips, such as blocklists
+)
+
+// channelNames are used in protocol ids (<prefix>/<name>/<version>) and in logs
+var channelNames = map[Channel]string{
+	ControlChannel: "control",
+	DataChannel:    "data",
+	BulkChannel:    "bulk",
+}
+
+// Protocol versions registered for each channel, newest first. A stream is opened with the first version the remote
+// peer knows, so a new version can be added here while nodes with older versions are still running. Peers without
+// any of them are reached over the legacy protocol (-pid), which carries the control and data channels in one.
+var channelVersions = map[Channel][]string{
+	ControlChannel: {"2.0"},
+	DataChannel:    {"2.0"},
+	BulkChannel:    {"1.0"},
+}
+
+type channelLimits struct {
+	maxMessageSize int           // longest accepted line in bytes, including the newline
+	maxStreams     int           // streams handled at the same time, further streams are reset
+	readTimeout    time.Duration // time for the remote peer to send one line
+}
+
+var limits = map[Channel]channelLimits{
+	ControlChannel: {maxMessageSize: 16 * 1024, maxStreams: 64, readTimeout: 10 * time.Second},
+	DataChannel:    {maxMessageSize: 1024 * 1024, maxStreams: 32, readTimeout: 30 * time.Second},
+	BulkChannel:    {maxMessageSize: 1024 * 1024, maxStreams: 4, readTimeout: 60 * time.Second},
+}
+
+// the legacy protocol may carry anything, so it gets the limits of the data channel
+var legacyLimits = limits[DataChannel]
+
+var errLineTooLong = errors.New("line too long")
+
+// a message read from an incoming stream
+type inboundMessage struct {
+	stream   network.Stream
+	reader   *bufio.Reader // for channels where the message is followed by more lines
+	peerData *PeerData
+	text     string   // the message without the trailing newline
+	commands []string // the message split to fields, never empty
+}
+
+// ids of the protocols of the channel, in order of preference. The control and data channels end with the legacy
+// protocol.
+func (p *Peer) protocolIDs(channel Channel) []protocol.ID {
+	var ids []protocol.ID
+	for _, version := range channelVersions[channel] {
+		ids = append(ids, protocol.ID(fmt.Sprintf("%s/%s/%s", p.protocolPrefix, channelNames[channel], version)))
+	}
+	if channel == BulkChannel {
+		return ids
+	}
+	return append(ids, protocol.ID(p.protocol))
+}
+
+// register stream handlers for all channels and their versions, and for the legacy protocol
+func (p *Peer) registerProtocols() {
+	dispatchers := map[Channel]func(*inboundMessage) bool{
+		ControlChannel: p.dispatchControl,
+		DataChannel:    p.dispatchData,
+		BulkChannel:    p.dispatchBulk,
+	}
+
+	for channel, dispatch := range dispatchers {
+		handler := p.channelHandler(channelNames[channel], limits[channel], dispatch)
+		for _, id := range p.protocolIDs(channel) {
+			// the legacy protocol has its own handler
+			if id != protocol.ID(p.protocol) {
+				p.host.SetStreamHandler(id, handler)
+			}
+		}
+	}
+
+	p.host.SetStreamHandler(protocol.ID(p.protocol), p.channelHandler("legacy", legacyLimits,
+		func(msg *inboundMessage) bool {
+			return p.dispatchControl(msg) || p.dispatchData(msg)
+		}))
+}
+
+// wrap a dispatch function in a stream handler enforcing the limits. The dispatch function returns false if it
+// doesn't know the message, which is then counted as a bad interaction.
+func (p *Peer) channelHandler(name string, limits channelLimits, dispatch func(*inboundMessage) bool) network.StreamHandler {
+	slots := make(chan struct{}, limits.maxStreams)
+
+	return func(stream network.Stream) {
+		select {
+		case slots <- struct{}{}:
+			defer func() { <-slots }()
+		default:
+			fmt.Printf("[PROTOCOL] Too many %s streams, refusing stream from %s\n", name,
+				stream.Conn().RemotePeer().Pretty())
+			_ = stream.Reset()
+			return
+		}
+		defer p.closeStream(stream)
+
+		msg, ok := p.readInbound(stream, limits)
+		if !ok {
+			return
+		}
+		if !dispatch(msg) {
+			fmt.Printf("[PROTOCOL] [ %s ] sent an unknown %s message: %s\n", msg.peerData.PeerID, name, msg.commands[0])
+			msg.peerData.AddInteraction(InteractionMessage, OutcomeInvalid, 0, "unknown "+name+" message "+msg.commands[0])
+		}
+	}
+}
+
+// read one message from the stream. Errors, empty and oversized messages lower the peer's reliability.
+func (p *Peer) readInbound(stream network.Stream, limits channelLimits) (*inboundMessage, bool) {
+	remotePeerStr := stream.Conn().RemotePeer().Pretty()
+	remoteMA := fmt.Sprintf("%s/p2p/%s", stream.Conn().RemoteMultiaddr(), remotePeerStr)
+
+	remotePeerData, _ := p.peerstore.ActivatePeer(remotePeerStr)
+	remotePeerData.SetMultiaddr(remoteMA)
+
+	reader := bufio.NewReader(stream)
+	str, err := readLine(stream, reader, limits)
+
+	if err == errLineTooLong {
+		fmt.Printf("[PROTOCOL] [ %s ] sent a message longer than %d bytes\n", remotePeerStr, limits.maxMessageSize)
+		remotePeerData.AddInteraction(InteractionMessage, OutcomeInvalid, 0, "message too long")
+		return nil, false
+	}
+
+	if err != nil {
+		fmt.Println("Error reading from buffer")
+		remotePeerData.AddInteraction(InteractionMessage, OutcomeFailure, 0, "reading message failed")
+		return nil, false
+	}
+
+	commands := strings.Fields(str)
+
+	if len(commands) == 0 {
+		// peer sent empty message
+		fmt.Println("[", remotePeerStr, "] sent an empty string")
+		remotePeerData.AddInteraction(InteractionMessage, OutcomeInvalid, 0, "empty message")
+		return nil, false
+	}
+
+	return &inboundMessage{stream: stream, reader: reader, peerData: remotePeerData, text: str, commands: commands}, true
+}
+
+// read one line from the stream, within the limits of the channel
+// return string: the line without the trailing newline
+// return error: errLineTooLong if the line exceeds the limit, read errors otherwise
+func readLine(stream network.Stream, reader *bufio.Reader, limits channelLimits) (string, error) {
+	if err := stream.SetReadDeadline(time.Now().Add(limits.readTimeout)); err != nil {
+		fmt.Println("[PROTOCOL] Setting read deadline failed -", err)
+	}
+
+	var line []byte
+	for {
+		part, err := reader.ReadSlice('\n')
+		line = append(line, part...)
+		if len(line) > limits.maxMessageSize {
+			return "", errLineTooLong
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		return string(line[:len(line)-1]), nil
+	}
+}
@@ -0,0 +1,122 @@
+package peer
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/stratosphereips/p2p4slips/schema"
+)
+
+// Resolve the recipients requested by slips to a list of active peers
+// recipients: peer ids of the recipients, "*" stands for all active peers. If the list is empty, the selector is
+// applied to all active peers
+// selector: filter applied to the recipients, can be nil
+// return []*PeerData: active peers matching the request, sorted by reliability (most reliable first)
+func (ps *PeerStore) SelectRecipients(recipients []string, selector *schema.Selector) []*PeerData {
+	if len(recipients) == 0 && selector == nil {
+		return nil
+	}
+
+	candidates := make(map[string]*PeerData)
+	broadcast := len(recipients) == 0
+	for _, peerId := range recipients {
+		if peerId == "*" {
+			broadcast = true
+			break
+		}
+		peerData := ps.IsActivePeer(peerId)
+		if peerData == nil {
+			fmt.Println("[PEER] peerid doesn't belong to any active peer: ", peerId)
+			continue
+		}
+		candidates[peerId] = peerData
+	}
+	if broadcast {
+		for _, peerData := range ps.ActivePeerList() {
+			candidates[peerData.PeerID] = peerData
+		}
+	}
+
+	selected := make([]*PeerData, 0, len(candidates))
+	for _, peerData := range candidates {
+		if selector == nil || selectorMatches(selector, peerData) {
+			selected = append(selected, peerData)
+		}
+	}
+
+	sort.Slice(selected, func(i, j int) bool {
+		return selected[i].Trust() > selected[j].Trust()
+	})
+
+	if selector != nil && selector.Top > 0 && len(selected) > selector.Top {
+		selected = selected[:selector.Top]
+	}
+	return selected
+}
+
+// check if the peer passes all filters of the selector (except top-N, which is applied to the whole list)
+func selectorMatches(selector *schema.Selector, peerData *PeerData) bool {
+	for _, excluded := range selector.Exclude {
+		if excluded == peerData.PeerID {
+			return false
+		}
+	}
+
+	if peerData.Trust() < selector.MinReliability {
+		return false
+	}
+
+	if selector.Version != "" && !versionMatches(selector.Version, peerData.Version) {
+		return false
+	}
+
+	return true
+}
+
+// Check the version of a peer against a constraint, such as "version1", ">=1" or "!=version2"
+// Peers with unknown version never match a constraint
+func versionMatches(constraint string, version string) bool {
+	operator := "=="
+	for _, op := range []string{"==", "!=", ">=", "<=", ">", "<"} {
+		if strings.HasPrefix(constraint, op) {
+			operator = op
+			constraint = strings.TrimPrefix(constraint, op)
+			break
+		}
+	}
+
+	wanted, ok := parseVersion(constraint)
+	if !ok {
+		return false
+	}
+	actual, ok := parseVersion(version)
+	if !ok {
+		return false
+	}
+
+	switch operator {
+	case "!=":
+		return actual != wanted
+	case ">=":
+		return actual >= wanted
+	case "<=":
+		return actual <= wanted
+	case ">":
+		return actual > wanted
+	case "<":
+		return actual < wanted
+	default:
+		return actual == wanted
+	}
+}
+
+// parse version number from strings such as "version1" or "1"
+func parseVersion(version string) (int, bool) {
+	number, err := strconv.Atoi(strings.TrimPrefix(version, "version"))
+	if err != nil {
+		return 0, false
+	}
+	return number, true
+}
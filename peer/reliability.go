@@ -1,8 +1,54 @@
 package peer
 
-func ComputeReliability(interactions []float64) float64 {
-	// TODO: improve reliability computation
-	return average(interactions)
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+// number of round trip times kept for each peer
+const rttWindow = 100
+
+// number of the latest interactions the reliability of a peer is computed from. With a database, only these are
+// kept in memory (up to twice as many between trims), the whole history stays in the database
+const reliabilityWindow = 1000
+
+// pongs arriving faster than this get the full rating
+const goodRtt = 200 * time.Millisecond
+
+// rating of a pong that arrives just before the timeout. Slow replies are still better than no replies (rated 0)
+const slowPongRating = 0.5
+
+// weights of interactions in the reliability, by their outcome. Invalid messages are sent on purpose, so they weigh
+// more than failures, which can be caused by the network. Floods keep the weight 1, since an honest peer whose ping
+// arrives right after a ping of this node is counted as a flood too. Other outcomes have the weight 1
+var outcomeWeights = map[string]float64{
+	OutcomeInvalid: 3,
+}
+
+// OutcomeWeight returns how much an interaction with the outcome counts in the reliability
+func OutcomeWeight(outcome string) float64 {
+	if weight, ok := outcomeWeights[outcome]; ok {
+		return weight
+	}
+	return 1
+}
+
+// ComputeReliability is the average of the ratings, each weighted by the outcome of its interaction
+// ratings: ratings of the interactions, oldest first
+// outcomes: outcomes of the interactions, aligned with the end of the ratings. Old interactions may have none
+func ComputeReliability(ratings []float64, outcomes []string) float64 {
+	offset := len(ratings) - len(outcomes)
+	total, weights := 0.0, 0.0
+	for i, rating := range ratings {
+		weight := 1.0
+		if i >= offset {
+			weight = OutcomeWeight(outcomes[i-offset])
+		}
+		total += weight * rating
+		weights += weight
+	}
+	return total / weights
 }
 
 func average(xs []float64) float64 {
@@ -12,3 +58,30 @@ func average(xs []float64) float64 {
 	}
 	return total / float64(len(xs))
 }
+
+// Rate a successful ping based on its round trip time
+// rtt: the measured round trip time
+// timeout: the ping timeout, a reply arriving at the timeout gets slowPongRating
+// return float64: rating between slowPongRating and 1
+func PingRating(rtt time.Duration, timeout time.Duration) float64 {
+	if rtt <= goodRtt || timeout <= goodRtt {
+		return 1
+	}
+	slowness := math.Min(float64(rtt-goodRtt)/float64(timeout-goodRtt), 1)
+	return 1 - slowness*(1-slowPongRating)
+}
+
+// compute the percentile (0-100) of the values using the nearest rank method
+func percentileOf(values []float64, percentile float64) float64 {
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+
+	rank := int(math.Ceil(percentile/100*float64(len(sorted)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	if rank >= len(sorted) {
+		rank = len(sorted) - 1
+	}
+	return sorted[rank]
+}
@@ -0,0 +1,154 @@
+package peer
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/stratosphereips/p2p4slips/schema"
+)
+
+// number of report ratings kept for each peer, the quality is the average of them
+const reportRatingWindow = 1000
+
+// number of reports forwarded to slips that can still be rated, older reports are forgotten
+const issuedReportLimit = 10000
+
+// a report forwarded to slips, and the peers that slips already rated for it
+type issuedReport struct {
+	reporter string
+	origin   string
+	rated    map[string]bool
+}
+
+// issuedReports remembers the last reports forwarded to slips, so feedback can only rate the peers that sent them,
+// and only once per report
+type issuedReports struct {
+	mutex   sync.Mutex
+	reports map[string]*issuedReport
+	order   []string // report ids, oldest first
+}
+
+func newIssuedReports() *issuedReports {
+	return &issuedReports{reports: make(map[string]*issuedReport)}
+}
+
+// remember a report forwarded to slips, forgetting the oldest one when there are too many
+func (r *issuedReports) add(report *schema.Report) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if _, ok := r.reports[report.ReportID]; ok {
+		return
+	}
+	r.reports[report.ReportID] = &issuedReport{reporter: report.Reporter, origin: report.Origin,
+		rated: make(map[string]bool)}
+	r.order = append(r.order, report.ReportID)
+	if len(r.order) > issuedReportLimit {
+		delete(r.reports, r.order[0])
+		r.order = r.order[1:]
+	}
+}
+
+// check that the peer can be rated for the report, and mark it as rated
+// return string: reason to ignore the feedback, empty if the rating can be stored
+func (r *issuedReports) rate(reportId string, peerId string) string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	report, ok := r.reports[reportId]
+	if !ok {
+		return "unknown or expired report"
+	}
+	if peerId != report.reporter && peerId != report.origin {
+		return "peer is neither the reporter nor the origin of the report"
+	}
+	if report.rated[peerId] {
+		return "peer was already rated for this report"
+	}
+	report.rated[peerId] = true
+	return ""
+}
+
+// Rate a report of the peer, as judged by slips. This only affects the report quality, not the reliability
+// rating: between 0 (wrong report) and 1 (accurate report)
+func (pd *PeerData) AddReportRating(rating float64) {
+	pd.mutex.Lock()
+	pd.ReportRatings = append(pd.ReportRatings, rating)
+	pd.ReportRatingTimes = append(pd.ReportRatingTimes, time.Now())
+	pd.updateReportQuality()
+	pd.mutex.Unlock()
+
+	SharePeerDataUpdate(pd)
+}
+
+// keep the last reportRatingWindow ratings and compute the quality from them. Must be called with the mutex locked
+func (pd *PeerData) updateReportQuality() {
+	if len(pd.ReportRatings) > reportRatingWindow {
+		pd.ReportRatings = pd.ReportRatings[len(pd.ReportRatings)-reportRatingWindow:]
+		pd.ReportRatingTimes = pd.ReportRatingTimes[len(pd.ReportRatingTimes)-reportRatingWindow:]
+	}
+	if len(pd.ReportRatings) > 0 {
+		pd.ReportQuality = average(pd.ReportRatings)
+	}
+}
+
+// Trust combines the reliability of the peer on the network with the quality of its reports. Until slips rates a
+// report of the peer, it is the reliability alone.
+func (pd *PeerData) Trust() float64 {
+	pd.mutex.Lock()
+	defer pd.mutex.Unlock()
+	if len(pd.ReportRatings) == 0 {
+		return pd.Reliability
+	}
+	return (1-pd.qualityWeight)*pd.Reliability + pd.qualityWeight*pd.ReportQuality
+}
+
+// the report quality for slips, nil if no report of the peer was rated
+func (pd *PeerData) reportQuality() *float64 {
+	pd.mutex.Lock()
+	defer pd.mutex.Unlock()
+	if len(pd.ReportRatings) == 0 {
+		return nil
+	}
+	quality := pd.ReportQuality
+	return &quality
+}
+
+// forward a report to slips and remember it, so slips can rate it later
+func (p *Peer) shareReport(report *schema.Report) {
+	ShareReport(p.bus, report)
+	p.reports.add(report)
+}
+
+// HandleReportFeedback rates the report quality of a peer with the feedback from slips
+// Only the reporter and the origin of a recent report can be rated, each of them once
+// return bool: true if the peer is known and the rating was stored
+func (p *Peer) HandleReportFeedback(feedback *schema.ReportFeedback) bool {
+	peerData := p.peerstore.IsKnown(feedback.PeerID)
+	if peerData == nil {
+		fmt.Printf("[FEEDBACK] Feedback on report %s rates unknown peer %s\n", feedback.ReportID, feedback.PeerID)
+		return false
+	}
+	if reason := p.reports.rate(feedback.ReportID, feedback.PeerID); reason != "" {
+		fmt.Printf("[FEEDBACK] Ignoring feedback on report %s for %s - %s\n", feedback.ReportID, feedback.PeerID,
+			reason)
+		return false
+	}
+
+	fmt.Printf("[FEEDBACK] Report %s of %s rated %.2f\n", feedback.ReportID, feedback.PeerID, feedback.Rating)
+	peerData.AddReportRating(feedback.Rating)
+	return true
+}
+
+// random id of a report forwarded to slips, which slips uses when it sends feedback on the report
+func newReportID() string {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		// the id only has to be unique among recent reports
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(id)
+}
@@ -0,0 +1,109 @@
+package peer
+
+import (
+	"fmt"
+	"math"
+	"testing"
+
+	"github.com/stratosphereips/p2p4slips/schema"
+)
+
+// feedback rates only the reporter and the origin of a report forwarded to slips, each of them once
+func TestHandleReportFeedback(t *testing.T) {
+	p := &Peer{peerstore: PeerStore{AllPeers: map[string]*PeerData{}, ActivePeers: map[string]*PeerData{}},
+		reports: newIssuedReports()}
+	for _, peerId := range []string{"reporter", "origin", "bystander"} {
+		p.peerstore.createNewPeer(peerId)
+	}
+	report := &schema.Report{Reporter: "reporter", Origin: "origin", Message: "aGk=", Signature: schema.SignatureValid}
+	p.shareReport(report)
+
+	tests := []struct {
+		name     string
+		reportId string
+		peerId   string
+		stored   bool
+	}{
+		{"reporter", report.ReportID, "reporter", true},
+		{"origin", report.ReportID, "origin", true},
+		{"reporter again", report.ReportID, "reporter", false},
+		{"peer that didn't send the report", report.ReportID, "bystander", false},
+		{"unknown peer", report.ReportID, "stranger", false},
+		{"unknown report", "0000", "reporter", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			feedback := &schema.ReportFeedback{PeerID: test.peerId, ReportID: test.reportId, Rating: 1}
+			if stored := p.HandleReportFeedback(feedback); stored != test.stored {
+				t.Errorf("rating stored %v, expected %v", stored, test.stored)
+			}
+		})
+	}
+
+	for peerId, expected := range map[string]int{"reporter": 1, "origin": 1, "bystander": 0} {
+		if ratings := len(p.peerstore.IsKnown(peerId).ReportRatings); ratings != expected {
+			t.Errorf("%s has %d report ratings, expected %d", peerId, ratings, expected)
+		}
+	}
+}
+
+// reports beyond the limit push the oldest ones out
+func TestIssuedReportsLimit(t *testing.T) {
+	reports := newIssuedReports()
+	for i := 0; i <= issuedReportLimit; i++ {
+		reports.add(&schema.Report{ReportID: fmt.Sprint(i), Reporter: "reporter"})
+	}
+
+	if reason := reports.rate("0", "reporter"); reason == "" {
+		t.Error("the oldest report can still be rated")
+	}
+	if reason := reports.rate(fmt.Sprint(issuedReportLimit), "reporter"); reason != "" {
+		t.Error("the newest report can't be rated -", reason)
+	}
+	if len(reports.reports) != issuedReportLimit || len(reports.order) != issuedReportLimit {
+		t.Errorf("%d reports remembered, expected %d", len(reports.reports), issuedReportLimit)
+	}
+}
+
+func TestTrust(t *testing.T) {
+	tests := []struct {
+		name        string
+		reliability float64
+		weight      float64
+		ratings     []float64
+		trust       float64
+	}{
+		{"no ratings", 0.8, 0.5, nil, 0.8},
+		{"good reports", 0.4, 0.5, []float64{1, 1}, 0.7},
+		{"bad reports", 0.8, 0.5, []float64{0, 0, 1, 0}, 0.525},
+		{"weight 0", 0.8, 0, []float64{0}, 0.8},
+		{"weight 1", 0.8, 1, []float64{0.2}, 0.2},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pd := &PeerData{PeerID: "a", Reliability: test.reliability, qualityWeight: test.weight}
+			for _, rating := range test.ratings {
+				pd.AddReportRating(rating)
+			}
+			if trust := pd.Trust(); math.Abs(trust-test.trust) > 1e-9 {
+				t.Errorf("trust %v, expected %v", trust, test.trust)
+			}
+		})
+	}
+}
+
+// only the last ratings count, so a peer can't live forever on old good reports
+func TestReportRatingWindow(t *testing.T) {
+	pd := &PeerData{PeerID: "a", qualityWeight: 1}
+	for i := 0; i < reportRatingWindow; i++ {
+		pd.AddReportRating(1)
+	}
+	for i := 0; i < reportRatingWindow; i++ {
+		pd.AddReportRating(0)
+	}
+	if len(pd.ReportRatings) != reportRatingWindow || pd.ReportQuality != 0 {
+		t.Errorf("%d ratings kept with quality %v", len(pd.ReportRatings), pd.ReportQuality)
+	}
+}
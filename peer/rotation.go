@@ -0,0 +1,93 @@
+package peer
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/stratosphereips/p2p4slips/utils"
+)
+
+// announcements of key rotation are sent (and accepted) only for this long after the rotation
+const rotationLifetime = 30 * 24 * time.Hour
+
+// load the announcement created by the last key rotation, if it belongs to the current key and is still fresh
+func (p *Peer) loadRotationAnnouncement() {
+	announcement := utils.LoadRotationAnnouncement(p.keyFile)
+	if announcement == nil {
+		return
+	}
+
+	_, newId, err := announcement.Verify()
+	if err != nil {
+		fmt.Println("[ROTATION] Ignoring invalid rotation announcement -", err)
+		return
+	}
+	if newId != p.host.ID() {
+		fmt.Println("[ROTATION] Ignoring rotation announcement, it was made for a different key")
+		return
+	}
+	if time.Since(time.Unix(announcement.Timestamp, 0)) > rotationLifetime {
+		fmt.Println("[ROTATION] Rotation announcement expired, it will not be sent to peers")
+		return
+	}
+	p.rotation = announcement
+}
+
+// tell the peer that this node used to have a different identity
+func (p *Peer) announceRotation(peerData *PeerData) {
+	if p.rotation == nil || p.isClosing() {
+		return
+	}
+
+	data, err := json.Marshal(p.rotation)
+	if err != nil {
+		fmt.Println("[ROTATION] Error encoding rotation announcement -", err)
+		return
+	}
+	p.sendMessageToPeerData(peerData, ControlChannel, "rotate "+base64.StdEncoding.EncodeToString(data)+"\n", 0)
+}
+
+// verify the announcement of a key rotation, and if it is valid, move the reputation of the old identity to the sender
+func (p *Peer) handleRotation(remotePeerData *PeerData, command *[]string) {
+	if len(*command) != 2 {
+		fmt.Println("[ROTATION] Invalid rotation format")
+		remotePeerData.AddInteraction(InteractionRotation, OutcomeInvalid, 0, "invalid rotation format")
+		return
+	}
+
+	data, err := base64.StdEncoding.DecodeString((*command)[1])
+	announcement := &utils.RotationAnnouncement{}
+	if err == nil {
+		err = json.Unmarshal(data, announcement)
+	}
+	if err != nil {
+		fmt.Println("[ROTATION] Rotation announcement could not be decoded -", err)
+		remotePeerData.AddInteraction(InteractionRotation, OutcomeInvalid, 0, "announcement could not be decoded")
+		return
+	}
+
+	oldId, newId, err := announcement.Verify()
+	if err != nil {
+		fmt.Println("[ROTATION] Invalid rotation announcement -", err)
+		remotePeerData.AddInteraction(InteractionRotation, OutcomeInvalid, 0, "invalid announcement: "+err.Error())
+		return
+	}
+
+	// the announcement must be sent by the new identity, otherwise anyone could claim reputation of others
+	if newId.Pretty() != remotePeerData.PeerID {
+		fmt.Println("[ROTATION] Rotation announcement was sent by a different peer than the one it announces")
+		remotePeerData.AddInteraction(InteractionRotation, OutcomeInvalid, 0, "announcement sent by a different peer")
+		return
+	}
+
+	if time.Since(time.Unix(announcement.Timestamp, 0)) > rotationLifetime {
+		fmt.Println("[ROTATION] Rotation announcement is too old")
+		return
+	}
+
+	if p.peerstore.CarryOverReputation(oldId.Pretty(), newId.Pretty()) {
+		fmt.Printf("[ROTATION] Peer %s is now known as %s\n", oldId.Pretty(), newId.Pretty())
+	}
+}
@@ -0,0 +1,66 @@
+package peer
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+
+	"github.com/libp2p/go-libp2p-core/crypto"
+	libp2ppeer "github.com/libp2p/go-libp2p-core/peer"
+	"github.com/stratosphereips/p2p4slips/utils"
+)
+
+// the reputation of the old identity moves to the new one only if the new identity itself sends a valid announcement
+func TestHandleRotation(t *testing.T) {
+	oldKey, _, _ := crypto.GenerateEd25519Key(rand.Reader)
+	newKey, _, _ := crypto.GenerateEd25519Key(rand.Reader)
+	oldId, _ := libp2ppeer.IDFromPrivateKey(oldKey)
+	newId, _ := libp2ppeer.IDFromPrivateKey(newKey)
+	otherKey, _, _ := crypto.GenerateEd25519Key(rand.Reader)
+	otherId, _ := libp2ppeer.IDFromPrivateKey(otherKey)
+
+	// announcement of the rotation from the old to the new key, changed after signing
+	announce := func(modify func(a *utils.RotationAnnouncement)) string {
+		a, err := utils.NewRotationAnnouncement(oldKey, newKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		modify(a)
+		data, _ := json.Marshal(a)
+		return base64.StdEncoding.EncodeToString(data)
+	}
+
+	tests := []struct {
+		name    string
+		sender  string
+		message string
+		carried bool
+	}{
+		{"valid", newId.Pretty(), announce(func(a *utils.RotationAnnouncement) {}), true},
+		{"sent by the old identity", oldId.Pretty(), announce(func(a *utils.RotationAnnouncement) {}), false},
+		{"sent by another peer", otherId.Pretty(), announce(func(a *utils.RotationAnnouncement) {}), false},
+		{"tampered", newId.Pretty(), announce(func(a *utils.RotationAnnouncement) { a.Timestamp++ }), false},
+		{"garbage", newId.Pretty(), "not an announcement", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p := &Peer{peerstore: PeerStore{AllPeers: map[string]*PeerData{}, ActivePeers: map[string]*PeerData{}}}
+			old := p.peerstore.createNewPeer(oldId.Pretty())
+			old.AddInteraction(InteractionPing, OutcomeSuccess, 1, "")
+			sender := p.peerstore.createNewPeer(test.sender)
+
+			p.handleRotation(sender, &[]string{"rotate", test.message})
+
+			newData := p.peerstore.IsKnown(newId.Pretty())
+			carried := p.peerstore.IsKnown(oldId.Pretty()) == nil && newData != nil && len(newData.BasicInteractions) == 1
+			if carried != test.carried {
+				t.Errorf("reputation carried over %v, expected %v", carried, test.carried)
+			}
+			if !test.carried && p.peerstore.IsKnown(oldId.Pretty()) == nil {
+				t.Error("old identity was forgotten")
+			}
+		})
+	}
+}
@@ -0,0 +1,89 @@
+package peer
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/stratosphereips/p2p4slips/schema"
+)
+
+// peers with zero reliability still get a small chance to be selected by the weighted strategy
+const minSelectionWeight = 0.01
+
+// random source shared by all selections, math/rand.Rand is not safe for concurrent use
+var sampler = struct {
+	sync.Mutex
+	rnd *rand.Rand
+}{rnd: rand.New(rand.NewSource(time.Now().UnixNano()))}
+
+// Choose which of the candidate peers will receive a message
+// candidates: peers that may receive the message
+// strategy: mode and fanout limit. Missing mode or fanout are taken from the defaults, a fanout of 0 is not missing
+// defaults: the strategy configured for this node
+// return []*PeerData: the chosen peers, at most fanout of them (unless fanout is 0)
+func SelectPeers(candidates []*PeerData, strategy *schema.Strategy, defaults schema.Strategy) []*PeerData {
+	mode, fanout := defaults.Mode, 0
+	if defaults.Fanout != nil {
+		fanout = *defaults.Fanout
+	}
+	if strategy != nil {
+		if strategy.Mode != "" {
+			mode = strategy.Mode
+		}
+		if strategy.Fanout != nil {
+			fanout = *strategy.Fanout
+		}
+	}
+
+	if mode == schema.StrategyAll || fanout <= 0 || len(candidates) <= fanout {
+		return candidates
+	}
+
+	if mode == schema.StrategyRandom {
+		return randomSample(candidates, fanout)
+	}
+	return weightedSample(candidates, fanout)
+}
+
+// pick n peers uniformly at random
+func randomSample(candidates []*PeerData, n int) []*PeerData {
+	sampler.Lock()
+	order := sampler.rnd.Perm(len(candidates))
+	sampler.Unlock()
+
+	selected := make([]*PeerData, n)
+	for i := range selected {
+		selected[i] = candidates[order[i]]
+	}
+	return selected
+}
+
+// pick n peers without replacement, with probability proportional to their reliability
+// this uses the Efraimidis-Spirakis algorithm: each peer gets the key u^(1/weight), the n highest keys win
+func weightedSample(candidates []*PeerData, n int) []*PeerData {
+	type keyedPeer struct {
+		key      float64
+		peerData *PeerData
+	}
+
+	keyed := make([]keyedPeer, len(candidates))
+	sampler.Lock()
+	for i, peerData := range candidates {
+		weight := math.Max(peerData.Trust(), minSelectionWeight)
+		keyed[i] = keyedPeer{key: math.Pow(sampler.rnd.Float64(), 1/weight), peerData: peerData}
+	}
+	sampler.Unlock()
+
+	sort.Slice(keyed, func(i, j int) bool {
+		return keyed[i].key > keyed[j].key
+	})
+
+	selected := make([]*PeerData, n)
+	for i := range selected {
+		selected[i] = keyed[i].peerData
+	}
+	return selected
+}
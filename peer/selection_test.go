@@ -0,0 +1,80 @@
+package peer
+
+import (
+	"fmt"
+	"math"
+	"testing"
+
+	"github.com/stratosphereips/p2p4slips/schema"
+)
+
+// peers with the given reliabilities
+func candidatePeers(reliabilities ...float64) []*PeerData {
+	candidates := make([]*PeerData, len(reliabilities))
+	for i, reliability := range reliabilities {
+		candidates[i] = &PeerData{PeerID: fmt.Sprintf("peer%d", i), Reliability: reliability}
+	}
+	return candidates
+}
+
+func TestSelectPeers(t *testing.T) {
+	one, two, zero := 1, 2, 0
+	defaults := schema.Strategy{Mode: schema.StrategyWeighted, Fanout: &two}
+
+	tests := []struct {
+		name      string
+		peers     int
+		strategy  *schema.Strategy
+		defaults  schema.Strategy
+		different int
+	}{
+		{"defaults", 5, nil, defaults, 2},
+		{"fanout of the scroll", 5, &schema.Strategy{Fanout: &one}, defaults, 1},
+		{"fanout 0 of the scroll lifts the limit", 5, &schema.Strategy{Fanout: &zero}, defaults, 5},
+		{"mode all ignores the fanout", 5, &schema.Strategy{Mode: schema.StrategyAll}, defaults, 5},
+		{"random", 5, &schema.Strategy{Mode: schema.StrategyRandom}, defaults, 2},
+		{"fewer peers than the fanout", 1, nil, defaults, 1},
+		{"no peers", 0, nil, defaults, 0},
+		{"no default fanout", 5, nil, schema.Strategy{Mode: schema.StrategyRandom}, 5},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			candidates := candidatePeers(make([]float64, test.peers)...)
+			selected := SelectPeers(candidates, test.strategy, test.defaults)
+
+			different := map[string]bool{}
+			for _, peerData := range selected {
+				different[peerData.PeerID] = true
+			}
+			if len(selected) != test.different || len(different) != test.different {
+				t.Errorf("%d peers selected (%d different), expected %d", len(selected), len(different),
+					test.different)
+			}
+		})
+	}
+}
+
+// with fanout 1, the weighted strategy picks each peer with probability proportional to its reliability. Peers with
+// zero reliability still get a small chance
+func TestWeightedSample(t *testing.T) {
+	const rounds = 20000
+	candidates := candidatePeers(0.9, 0.1, 0)
+
+	counts := map[string]int{}
+	for i := 0; i < rounds; i++ {
+		counts[weightedSample(candidates, 1)[0].PeerID]++
+	}
+
+	weights := []float64{0.9, 0.1, minSelectionWeight}
+	total := weights[0] + weights[1] + weights[2]
+	for i, weight := range weights {
+		share := float64(counts[candidates[i].PeerID]) / rounds
+		if expected := weight / total; math.Abs(share-expected) > 0.02 {
+			t.Errorf("%s was selected in %.3f of the rounds, expected %.3f", candidates[i].PeerID, share, expected)
+		}
+	}
+	if counts[candidates[2].PeerID] == 0 {
+		t.Error("peer with zero reliability was never selected")
+	}
+}
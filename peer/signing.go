@@ -0,0 +1,211 @@
+package peer
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/crypto"
+	libp2ppeer "github.com/libp2p/go-libp2p-core/peer"
+	"github.com/stratosphereips/p2p4slips/schema"
+)
+
+// SignedEnvelope carries a slips payload together with the identity of the node that created it. The signature
+// covers the origin, the time and the payload, so the origin can be verified even if the message is relayed.
+type SignedEnvelope struct {
+	Origin    string `json:"origin"`
+	PublicKey []byte `json:"public_key"`
+	Timestamp int64  `json:"timestamp"`
+	Payload   string `json:"payload"`
+	Encrypted bool   `json:"encrypted,omitempty"`
+	Signature []byte `json:"signature"`
+}
+
+// how far the time of a signed message can be from the local time. Within this window, each envelope is accepted
+// only once, so a captured message can't be sent again
+const signedMessageWindow = 5 * time.Minute
+
+// number of recently received envelopes that are remembered, the oldest are forgotten when there are more
+const seenEnvelopeLimit = 100000
+
+// seenEnvelopes remembers the signatures of the envelopes received within the window, to reject replayed messages
+type seenEnvelopes struct {
+	mutex   sync.Mutex
+	expires map[string]time.Time // signature -> when the envelope falls out of the window
+	order   []string             // signatures, in the order they were received
+}
+
+func newSeenEnvelopes() *seenEnvelopes {
+	return &seenEnvelopes{expires: make(map[string]time.Time)}
+}
+
+// check that the envelope is recent and wasn't received before, and remember it
+// return string: reason to reject the envelope, empty if it is accepted
+func (s *seenEnvelopes) check(envelope *SignedEnvelope, now time.Time) string {
+	signedAt := time.Unix(envelope.Timestamp, 0)
+	if signedAt.Before(now.Add(-signedMessageWindow)) || signedAt.After(now.Add(signedMessageWindow)) {
+		return "message was signed at " + signedAt.Format(time.RFC3339) + ", outside of the accepted window"
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// forget envelopes that would be rejected by their time anyway
+	for len(s.order) > 0 && (len(s.order) > seenEnvelopeLimit || now.After(s.expires[s.order[0]])) {
+		delete(s.expires, s.order[0])
+		s.order = s.order[1:]
+	}
+
+	key := string(envelope.Signature)
+	if _, ok := s.expires[key]; ok {
+		return "message was already received"
+	}
+	s.expires[key] = signedAt.Add(signedMessageWindow)
+	s.order = append(s.order, key)
+	return ""
+}
+
+// wrap the slips payload in an envelope signed by the key of this node
+// encrypted: the payload was encrypted by encryptPayload
+// return string: the line to send to peers (including the trailing newline)
+func (p *Peer) signMessage(payload string, encrypted bool) (string, error) {
+	return SignEnvelope(p.privKey, payload, encrypted, time.Now())
+}
+
+// SignEnvelope wraps the payload in an envelope signed by the key, as if it was sent at the given time. The origin
+// is the peer owning the key
+// return string: the line to send to peers (including the trailing newline)
+func SignEnvelope(key crypto.PrivKey, payload string, encrypted bool, at time.Time) (string, error) {
+	origin, err := libp2ppeer.IDFromPrivateKey(key)
+	if err != nil {
+		return "", err
+	}
+	publicKey, err := crypto.MarshalPublicKey(key.GetPublic())
+	if err != nil {
+		return "", err
+	}
+
+	envelope := &SignedEnvelope{
+		Origin:    origin.Pretty(),
+		PublicKey: publicKey,
+		Timestamp: at.Unix(),
+		Payload:   payload,
+		Encrypted: encrypted,
+	}
+	if envelope.Signature, err = key.Sign(envelope.signedData()); err != nil {
+		return "", err
+	}
+
+	data, err := json.Marshal(envelope)
+	if err != nil {
+		return "", err
+	}
+	return "signed " + base64.StdEncoding.EncodeToString(data) + "\n", nil
+}
+
+// Decode the envelope and verify that it was signed by its origin
+// return *SignedEnvelope: the decoded envelope, nil if it can't be decoded
+// return error: nil if the signature is valid
+func openEnvelope(encoded string) (*SignedEnvelope, error) {
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	envelope := &SignedEnvelope{}
+	if err = json.Unmarshal(data, envelope); err != nil {
+		return nil, err
+	}
+
+	publicKey, err := crypto.UnmarshalPublicKey(envelope.PublicKey)
+	if err != nil {
+		return envelope, err
+	}
+	keyOwner, err := libp2ppeer.IDFromPublicKey(publicKey)
+	if err != nil {
+		return envelope, err
+	}
+	if keyOwner.Pretty() != envelope.Origin {
+		return envelope, errors.New("message is signed by a different key than the one of its origin")
+	}
+	if ok, err := publicKey.Verify(envelope.signedData(), envelope.Signature); err != nil || !ok {
+		return envelope, errors.New("invalid signature")
+	}
+	return envelope, nil
+}
+
+// forward a signed message to slips, together with the result of the signature verification
+// Plain messages with invalid signatures are forwarded too (without the origin), so slips can see them, but the peer
+// that sent them is penalized. Encrypted messages are only decrypted once the signature was verified. Messages outside
+// of the time window, received before, or that can't be decrypted are dropped and penalized
+func (p *Peer) handleSignedMessage(remotePeerData *PeerData, command *[]string) {
+	if len(*command) != 2 {
+		fmt.Println("[SIGNING] Invalid signed message format")
+		remotePeerData.AddInteraction(InteractionSignature, OutcomeInvalid, 0, "invalid signed message format")
+		return
+	}
+
+	report := &schema.Report{
+		Reporter:   remotePeerData.PeerID,
+		ReportTime: time.Now().Unix(),
+		Signature:  schema.SignatureValid,
+	}
+
+	envelope, err := openEnvelope((*command)[1])
+	if envelope == nil {
+		fmt.Println("[SIGNING] Signed message could not be decoded -", err)
+		remotePeerData.AddInteraction(InteractionSignature, OutcomeInvalid, 0, "signed message could not be decoded")
+		return
+	}
+	if err != nil {
+		fmt.Printf("[SIGNING] Message from %s has an invalid signature - %s\n", remotePeerData.PeerID, err)
+		remotePeerData.AddInteraction(InteractionSignature, OutcomeInvalid, 0, "invalid signature: "+err.Error())
+		// the payload of an unauthenticated message is never decrypted
+		if envelope.Encrypted {
+			return
+		}
+		report.Message = envelope.Payload
+		report.Signature = schema.SignatureInvalid
+		p.shareReport(report)
+		return
+	}
+
+	if reason := p.envelopes.check(envelope, time.Now()); reason != "" {
+		fmt.Printf("[SIGNING] Dropping message from %s - %s\n", remotePeerData.PeerID, reason)
+		remotePeerData.AddInteraction(InteractionSignature, OutcomeInvalid, 0, reason)
+		return
+	}
+
+	report.Message = envelope.Payload
+	report.Origin = envelope.Origin
+	report.SignedAt = envelope.Timestamp
+
+	if envelope.Encrypted {
+		plain, decryptErr := decryptPayload(envelope.Payload, p.privKey)
+		if decryptErr != nil {
+			// the sender signed a payload this node can't read, it is penalized like for an invalid signature
+			fmt.Printf("[ENCRYPTION] Message from %s could not be decrypted - %s\n", remotePeerData.PeerID, decryptErr)
+			remotePeerData.AddInteraction(InteractionSignature, OutcomeInvalid, 0, "decryption failed: "+decryptErr.Error())
+			return
+		}
+		report.Message = plain
+		report.Encrypted = true
+	}
+
+	if rawDecodedText, err := base64.StdEncoding.DecodeString(report.Message); err == nil {
+		fmt.Printf("Received from [ %s ] : %s\n", remotePeerData.PeerID, rawDecodedText)
+	}
+	p.shareReport(report)
+}
+
+// the data covered by the signature
+func (e *SignedEnvelope) signedData() []byte {
+	prefix := "p2p4slips message|"
+	if e.Encrypted {
+		prefix = "p2p4slips encrypted message|"
+	}
+	return []byte(prefix + e.Origin + "|" + strconv.FormatInt(e.Timestamp, 10) + "|" + e.Payload)
+}
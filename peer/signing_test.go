@@ -0,0 +1,140 @@
+package peer
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/crypto"
+	libp2ppeer "github.com/libp2p/go-libp2p-core/peer"
+)
+
+// decode the line created by SignEnvelope, without verifying it
+func decodeEnvelope(t *testing.T, line string) *SignedEnvelope {
+	data, err := base64.StdEncoding.DecodeString(strings.TrimSuffix(strings.TrimPrefix(line, "signed "), "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	envelope := &SignedEnvelope{}
+	if err = json.Unmarshal(data, envelope); err != nil {
+		t.Fatal(err)
+	}
+	return envelope
+}
+
+// encode the envelope as the argument of a signed message
+func encodeEnvelope(t *testing.T, envelope *SignedEnvelope) string {
+	data, err := json.Marshal(envelope)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(data)
+}
+
+func TestOpenEnvelope(t *testing.T) {
+	key, _, _ := crypto.GenerateEd25519Key(rand.Reader)
+	otherKey, _, _ := crypto.GenerateEd25519Key(rand.Reader)
+	otherPublic, _ := crypto.MarshalPublicKey(otherKey.GetPublic())
+	otherId, _ := libp2ppeer.IDFromPrivateKey(otherKey)
+
+	tests := []struct {
+		name   string
+		modify func(e *SignedEnvelope)
+		valid  bool
+	}{
+		{"unchanged", func(e *SignedEnvelope) {}, true},
+		{"payload replaced", func(e *SignedEnvelope) { e.Payload = "Zm9yZ2Vk" }, false},
+		{"timestamp changed", func(e *SignedEnvelope) { e.Timestamp++ }, false},
+		{"encrypted flag set", func(e *SignedEnvelope) { e.Encrypted = true }, false},
+		{"origin of another key", func(e *SignedEnvelope) { e.Origin = otherId.Pretty() }, false},
+		{"key of another origin", func(e *SignedEnvelope) { e.PublicKey = otherPublic }, false},
+		{"key and origin replaced", func(e *SignedEnvelope) {
+			e.PublicKey = otherPublic
+			e.Origin = otherId.Pretty()
+		}, false},
+		{"signature missing", func(e *SignedEnvelope) { e.Signature = nil }, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			line, err := SignEnvelope(key, "cGF5bG9hZA==", false, time.Now())
+			if err != nil {
+				t.Fatal(err)
+			}
+			envelope := decodeEnvelope(t, line)
+			test.modify(envelope)
+
+			opened, err := openEnvelope(encodeEnvelope(t, envelope))
+			if opened == nil {
+				t.Fatal("envelope could not be decoded")
+			}
+			if valid := err == nil; valid != test.valid {
+				t.Errorf("signature valid %v, expected %v (%v)", valid, test.valid, err)
+			}
+		})
+	}
+}
+
+func TestOpenEnvelopeGarbage(t *testing.T) {
+	for _, encoded := range []string{"", "not base64!", base64.StdEncoding.EncodeToString([]byte("not json"))} {
+		if envelope, err := openEnvelope(encoded); envelope != nil || err == nil {
+			t.Errorf("%q was decoded", encoded)
+		}
+	}
+}
+
+func TestSeenEnvelopes(t *testing.T) {
+	now := time.Now()
+	envelope := func(signature string, at time.Time) *SignedEnvelope {
+		return &SignedEnvelope{Timestamp: at.Unix(), Signature: []byte(signature)}
+	}
+
+	tests := []struct {
+		name     string
+		received []*SignedEnvelope // received before, at now
+		envelope *SignedEnvelope
+		at       time.Time
+		accepted bool
+	}{
+		{"fresh", nil, envelope("a", now), now, true},
+		{"replayed", []*SignedEnvelope{envelope("a", now)}, envelope("a", now), now, false},
+		{"other signature", []*SignedEnvelope{envelope("a", now)}, envelope("b", now), now, true},
+		{"too old", nil, envelope("a", now.Add(-signedMessageWindow-time.Second)), now, false},
+		{"from the future", nil, envelope("a", now.Add(signedMessageWindow+time.Second)), now, false},
+		{"at the edge of the window", nil, envelope("a", now.Add(-signedMessageWindow+time.Second)), now, true},
+		// once the original is outside of the window, the replay is rejected by its time
+		{"replayed after the window", []*SignedEnvelope{envelope("a", now)}, envelope("a", now),
+			now.Add(signedMessageWindow + time.Second), false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			seen := newSeenEnvelopes()
+			for _, e := range test.received {
+				if reason := seen.check(e, now); reason != "" {
+					t.Fatal(reason)
+				}
+			}
+			reason := seen.check(test.envelope, test.at)
+			if accepted := reason == ""; accepted != test.accepted {
+				t.Errorf("accepted %v, expected %v (%s)", accepted, test.accepted, reason)
+			}
+		})
+	}
+}
+
+// expired envelopes are forgotten, so the memory doesn't grow with the traffic
+func TestSeenEnvelopesForget(t *testing.T) {
+	now := time.Now()
+	seen := newSeenEnvelopes()
+	seen.check(&SignedEnvelope{Timestamp: now.Unix(), Signature: []byte("a")}, now)
+
+	later := now.Add(signedMessageWindow + time.Minute)
+	seen.check(&SignedEnvelope{Timestamp: later.Unix(), Signature: []byte("b")}, later)
+	if len(seen.expires) != 1 || len(seen.order) != 1 {
+		t.Errorf("%d envelopes remembered, expected only the last one", len(seen.expires))
+	}
+}
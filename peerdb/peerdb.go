@@ -0,0 +1,235 @@
+// Package peerdb stores peer records and their interaction history in an embedded key-value database (bbolt).
+// Unlike the JSON peerstore file, which is rewritten as a whole, interactions are written one by one as they happen,
+// and old interactions can be pruned or queried by time.
+package peerdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+var (
+	peersBucket        = []byte("peers")
+	interactionsBucket = []byte("interactions")
+)
+
+// Interaction is a single rating of a peer, together with what it was for. Interactions stored before kinds were
+// recorded have an empty kind.
+type Interaction struct {
+	Time    time.Time
+	Rating  float64
+	Kind    string
+	Outcome string
+	Details string
+}
+
+// the part of an interaction stored after the rating
+type interactionEvent struct {
+	Kind    string `json:"k"`
+	Outcome string `json:"o"`
+	Details string `json:"d,omitempty"`
+}
+
+type DB struct {
+	bolt *bbolt.DB
+}
+
+// Open the database file, creating it if needed
+func Open(path string) (*DB, error) {
+	b, err := bbolt.Open(path, 0600, &bbolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = b.Update(func(tx *bbolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(peersBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(interactionsBucket)
+		return err
+	})
+	if err != nil {
+		_ = b.Close()
+		return nil, err
+	}
+	return &DB{bolt: b}, nil
+}
+
+func (db *DB) Close() error {
+	return db.bolt.Close()
+}
+
+// PutPeers saves the records of peers (any serialized form, the database doesn't interpret them) in one transaction
+func (db *DB) PutPeers(records map[string][]byte) error {
+	return db.bolt.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(peersBucket)
+		for peerId, record := range records {
+			if err := bucket.Put([]byte(peerId), record); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Peers returns the records of all stored peers
+func (db *DB) Peers() (map[string][]byte, error) {
+	records := make(map[string][]byte)
+	err := db.bolt.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(peersBucket).ForEach(func(k, v []byte) error {
+			// values are only valid inside the transaction
+			records[string(k)] = append([]byte(nil), v...)
+			return nil
+		})
+	})
+	return records, err
+}
+
+// DeletePeer removes the record and the history of the peer
+func (db *DB) DeletePeer(peerId string) error {
+	return db.bolt.Update(func(tx *bbolt.Tx) error {
+		if err := tx.Bucket(peersBucket).Delete([]byte(peerId)); err != nil {
+			return err
+		}
+		err := tx.Bucket(interactionsBucket).DeleteBucket([]byte(peerId))
+		if err == bbolt.ErrBucketNotFound {
+			return nil
+		}
+		return err
+	})
+}
+
+// AddInteractions appends interactions to the history of the peer
+func (db *DB) AddInteractions(peerId string, interactions ...Interaction) error {
+	return db.bolt.Update(func(tx *bbolt.Tx) error {
+		bucket, err := tx.Bucket(interactionsBucket).CreateBucketIfNotExists([]byte(peerId))
+		if err != nil {
+			return err
+		}
+		for _, interaction := range interactions {
+			// keys are timestamps, two interactions in the same nanosecond are stored one nanosecond apart
+			key := timeKey(interaction.Time)
+			for bucket.Get(key) != nil {
+				key = timeKey(keyTime(key).Add(time.Nanosecond))
+			}
+			value, err := encodeInteraction(interaction)
+			if err != nil {
+				return err
+			}
+			if err = bucket.Put(key, value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Interactions returns the history of the peer since the given time (zero time for the whole history), oldest first
+func (db *DB) Interactions(peerId string, since time.Time) ([]Interaction, error) {
+	var interactions []Interaction
+	err := db.bolt.View(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(interactionsBucket).Bucket([]byte(peerId))
+		if bucket == nil {
+			return nil
+		}
+
+		cursor := bucket.Cursor()
+		k, v := cursor.First()
+		if !since.IsZero() {
+			k, v = cursor.Seek(timeKey(since))
+		}
+		for ; k != nil; k, v = cursor.Next() {
+			interactions = append(interactions, decodeInteraction(keyTime(k), v))
+		}
+		return nil
+	})
+	return interactions, err
+}
+
+// LastInteractions returns at most n of the latest interactions of the peer since the given time (zero time for the
+// whole history), oldest first
+func (db *DB) LastInteractions(peerId string, since time.Time, n int) ([]Interaction, error) {
+	var interactions []Interaction
+	err := db.bolt.View(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(interactionsBucket).Bucket([]byte(peerId))
+		if bucket == nil {
+			return nil
+		}
+
+		limit := timeKey(since)
+		cursor := bucket.Cursor()
+		for k, v := cursor.Last(); k != nil && len(interactions) < n; k, v = cursor.Prev() {
+			if !since.IsZero() && bytes.Compare(k, limit) < 0 {
+				break
+			}
+			interactions = append(interactions, decodeInteraction(keyTime(k), v))
+		}
+		return nil
+	})
+	// the cursor went from the latest interaction back
+	for i, j := 0, len(interactions)-1; i < j; i, j = i+1, j-1 {
+		interactions[i], interactions[j] = interactions[j], interactions[i]
+	}
+	return interactions, err
+}
+
+// Prune deletes all interactions older than the given time
+// return int: number of deleted interactions
+func (db *DB) Prune(before time.Time) (int, error) {
+	deleted := 0
+	err := db.bolt.Update(func(tx *bbolt.Tx) error {
+		limit := timeKey(before)
+		return tx.Bucket(interactionsBucket).ForEach(func(peerId, _ []byte) error {
+			cursor := tx.Bucket(interactionsBucket).Bucket(peerId).Cursor()
+			for k, _ := cursor.First(); k != nil && bytes.Compare(k, limit) < 0; k, _ = cursor.First() {
+				if err := cursor.Delete(); err != nil {
+					return err
+				}
+				deleted++
+			}
+			return nil
+		})
+	})
+	return deleted, err
+}
+
+// values start with the rating as a big endian float, followed by the kind, outcome and details as JSON
+func encodeInteraction(interaction Interaction) ([]byte, error) {
+	value := make([]byte, 8)
+	binary.BigEndian.PutUint64(value, math.Float64bits(interaction.Rating))
+	if interaction.Kind == "" {
+		return value, nil
+	}
+	event, err := json.Marshal(interactionEvent{interaction.Kind, interaction.Outcome, interaction.Details})
+	if err != nil {
+		return nil, err
+	}
+	return append(value, event...), nil
+}
+
+func decodeInteraction(t time.Time, value []byte) Interaction {
+	interaction := Interaction{Time: t, Rating: math.Float64frombits(binary.BigEndian.Uint64(value))}
+	event := interactionEvent{}
+	if len(value) > 8 && json.Unmarshal(value[8:], &event) == nil {
+		interaction.Kind = event.Kind
+		interaction.Outcome = event.Outcome
+		interaction.Details = event.Details
+	}
+	return interaction
+}
+
+// timestamps are stored as big endian nanoseconds, so the byte order of keys matches the order of time
+func timeKey(t time.Time) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(t.UnixNano()))
+	return key
+}
+
+func keyTime(key []byte) time.Time {
+	return time.Unix(0, int64(binary.BigEndian.Uint64(key)))
+}
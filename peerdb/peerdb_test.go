@@ -0,0 +1,160 @@
+package peerdb
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func openTestDB(t *testing.T) *DB {
+	db, err := Open(filepath.Join(t.TempDir(), "peers.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	return db
+}
+
+// ratings of the interactions, in order
+func ratings(interactions []Interaction) []float64 {
+	r := make([]float64, len(interactions))
+	for i, interaction := range interactions {
+		r[i] = interaction.Rating
+	}
+	return r
+}
+
+func equalRatings(a []float64, b []float64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// ten interactions a second apart, rated 0 to 9, and an interaction of another peer
+func historyDB(t *testing.T, start time.Time) *DB {
+	db := openTestDB(t)
+	for i := 0; i < 10; i++ {
+		err := db.AddInteractions("a", Interaction{Time: start.Add(time.Duration(i) * time.Second), Rating: float64(i),
+			Kind: "ping", Outcome: "success"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.AddInteractions("b", Interaction{Time: start, Rating: 1}); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestInteractions(t *testing.T) {
+	start := time.Unix(1600000000, 0)
+	db := historyDB(t, start)
+
+	tests := []struct {
+		name     string
+		peer     string
+		since    time.Time
+		last     int // 0 reads with Interactions
+		expected []float64
+	}{
+		{"whole history", "a", time.Time{}, 0, []float64{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}},
+		{"since", "a", start.Add(7 * time.Second), 0, []float64{7, 8, 9}},
+		{"since the end", "a", start.Add(time.Hour), 0, []float64{}},
+		{"unknown peer", "c", time.Time{}, 0, []float64{}},
+		{"last", "a", time.Time{}, 3, []float64{7, 8, 9}},
+		{"last more than stored", "a", time.Time{}, 20, []float64{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}},
+		{"last since", "a", start.Add(8 * time.Second), 5, []float64{8, 9}},
+		{"last of unknown peer", "c", time.Time{}, 5, []float64{}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var interactions []Interaction
+			var err error
+			if test.last == 0 {
+				interactions, err = db.Interactions(test.peer, test.since)
+			} else {
+				interactions, err = db.LastInteractions(test.peer, test.since, test.last)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r := ratings(interactions); !equalRatings(r, test.expected) {
+				t.Errorf("got ratings %v, expected %v", r, test.expected)
+			}
+		})
+	}
+}
+
+func TestPrune(t *testing.T) {
+	start := time.Unix(1600000000, 0)
+	db := historyDB(t, start)
+
+	deleted, err := db.Prune(start.Add(4 * time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// four interactions of a and the one of b
+	if deleted != 5 {
+		t.Errorf("%d interactions deleted, expected 5", deleted)
+	}
+
+	interactions, _ := db.Interactions("a", time.Time{})
+	if r := ratings(interactions); !equalRatings(r, []float64{4, 5, 6, 7, 8, 9}) {
+		t.Errorf("ratings %v remain", r)
+	}
+	if interactions[0].Kind != "ping" || interactions[0].Outcome != "success" {
+		t.Errorf("kind %q and outcome %q were not kept", interactions[0].Kind, interactions[0].Outcome)
+	}
+	if interactions, _ = db.Interactions("b", time.Time{}); len(interactions) != 0 {
+		t.Error("old interaction of another peer remains")
+	}
+}
+
+// interactions in the same nanosecond are all kept, in the order they were added
+func TestInteractionsAtSameTime(t *testing.T) {
+	db := openTestDB(t)
+	now := time.Now()
+	err := db.AddInteractions("a", Interaction{Time: now, Rating: 1}, Interaction{Time: now, Rating: 0.5},
+		Interaction{Time: now, Rating: 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	interactions, _ := db.Interactions("a", time.Time{})
+	if r := ratings(interactions); !equalRatings(r, []float64{1, 0.5, 0}) {
+		t.Errorf("got ratings %v", r)
+	}
+}
+
+func TestDeletePeer(t *testing.T) {
+	db := historyDB(t, time.Unix(1600000000, 0))
+	if err := db.PutPeers(map[string][]byte{"a": []byte("record a"), "b": []byte("record b")}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.DeletePeer("a"); err != nil {
+		t.Fatal(err)
+	}
+	// a peer without history can be deleted too
+	if err := db.DeletePeer("c"); err != nil {
+		t.Fatal(err)
+	}
+
+	records, _ := db.Peers()
+	if _, ok := records["a"]; ok || string(records["b"]) != "record b" {
+		t.Errorf("records %v remain", records)
+	}
+	if interactions, _ := db.Interactions("a", time.Time{}); len(interactions) != 0 {
+		t.Error("history of the deleted peer remains")
+	}
+	if interactions, _ := db.Interactions("b", time.Time{}); len(interactions) != 1 {
+		t.Error("history of another peer was deleted")
+	}
+}
@@ -0,0 +1,295 @@
+package schema
+
+import (
+	"encoding/json"
+)
+
+// PeerUpdate is sent to Slips whenever information about a remote peer changes
+type PeerUpdate struct {
+	PeerID      string   `json:"peerid"`
+	Ip          string   `json:"ip,omitempty"`
+	Reliability float64  `json:"reliability"`
+	Timestamp   int64    `json:"timestamp"`
+	Latency     *Latency `json:"latency,omitempty"`
+	// result of the capability handshake, missing if it didn't happen yet
+	Compatible      *bool    `json:"compatible,omitempty"`
+	ProtocolVersion int      `json:"protocol_version,omitempty"`
+	Features        []string `json:"features,omitempty"`
+	// quality of reports judged by Slips, missing if there was no feedback yet
+	ReportQuality *float64 `json:"report_quality,omitempty"`
+	Trust         float64  `json:"trust"`
+}
+
+// Latency summarizes round trip times of recent pings to a peer, in milliseconds
+type Latency struct {
+	P50     float64 `json:"p50"`
+	P90     float64 `json:"p90"`
+	P99     float64 `json:"p99"`
+	Samples int     `json:"samples"`
+}
+
+// Report is a message received from a remote peer, which is forwarded to Slips
+// Reporter is the peer that delivered the message, Origin is the peer that created and signed it. Origin is only
+// set if the signature is valid.
+type Report struct {
+	Reporter   string `json:"reporter"`
+	ReportID   string `json:"report_id"`
+	ReportTime int64  `json:"report_time"`
+	Message    string `json:"message"`
+	Origin     string `json:"origin,omitempty"`
+	Signature  string `json:"signature"`
+	SignedAt   int64  `json:"signed_at,omitempty"`
+	Encrypted  bool   `json:"encrypted,omitempty"`
+}
+
+// results of the signature verification of a Report
+const (
+	SignatureValid    = "valid"
+	SignatureInvalid  = "invalid"
+	SignatureUnsigned = "unsigned"
+)
+
+// BulkTransfer reports the progress and the result of a bulk transfer to or from a remote peer
+type BulkTransfer struct {
+	TransferID string `json:"transfer_id"`
+	PeerID     string `json:"peerid"`
+	Direction  string `json:"direction"`
+	Name       string `json:"name"`
+	State      string `json:"state"`
+	Size       int64  `json:"size"`
+	BytesDone  int64  `json:"bytes_done"`
+	Sha256     string `json:"sha256,omitempty"`
+	File       string `json:"file,omitempty"`
+	Error      string `json:"error,omitempty"`
+	Timestamp  int64  `json:"timestamp"`
+}
+
+// directions and states of a BulkTransfer
+const (
+	BulkIncoming = "incoming"
+	BulkOutgoing = "outgoing"
+	BulkProgress = "progress"
+	BulkComplete = "complete"
+	BulkFailed   = "failed"
+)
+
+// Identity describes this node. Addresses include the peer id, so they can be used to connect to the node.
+type Identity struct {
+	PeerID            string   `json:"peerid"`
+	PublicKey         string   `json:"public_key"`
+	KeyType           string   `json:"key_type"`
+	ListenAddresses   []string `json:"listen_addresses"`
+	ObservedAddresses []string `json:"observed_addresses"`
+	ProtocolVersion   int      `json:"protocol_version"`
+	Protocols         []string `json:"protocols"`
+	StartTime         int64    `json:"start_time"`
+	Timestamp         int64    `json:"timestamp"`
+}
+
+// ReportFeedback is sent by Slips to rate a report it received from a remote peer
+type ReportFeedback struct {
+	MessageType   string  `json:"message_type"`
+	SchemaVersion int     `json:"schema_version,omitempty"`
+	PeerID        string  `json:"peerid"`
+	ReportID      string  `json:"report_id"`
+	Rating        float64 `json:"rating"`
+}
+
+// Interaction is a rated interaction with a remote peer
+type Interaction struct {
+	PeerID      string  `json:"peerid"`
+	Kind        string  `json:"kind"`
+	Outcome     string  `json:"outcome"`
+	Rating      float64 `json:"rating"`
+	Reliability float64 `json:"reliability"`
+	Details     string  `json:"details,omitempty"`
+	Timestamp   int64   `json:"timestamp"`
+}
+
+// InteractionQuery is sent by Slips to get the interactions with a remote peer. Empty fields match everything
+type InteractionQuery struct {
+	MessageType   string `json:"message_type"`
+	SchemaVersion int    `json:"schema_version,omitempty"`
+	QueryID       string `json:"query_id,omitempty"`
+	PeerID        string `json:"peerid"`
+	Since         int64  `json:"since,omitempty"`
+	Until         int64  `json:"until,omitempty"`
+	Kind          string `json:"kind,omitempty"`
+	Outcome       string `json:"outcome,omitempty"`
+	Last          int    `json:"last,omitempty"`
+}
+
+// InteractionHistory answers an InteractionQuery
+type InteractionHistory struct {
+	QueryID      string               `json:"query_id,omitempty"`
+	PeerID       string               `json:"peerid"`
+	Known        bool                 `json:"known"`
+	Reliability  float64              `json:"reliability"`
+	Interactions []HistoryInteraction `json:"interactions"`
+}
+
+// HistoryInteraction is one interaction of an InteractionHistory
+type HistoryInteraction struct {
+	Kind      string  `json:"kind"`
+	Outcome   string  `json:"outcome"`
+	Rating    float64 `json:"rating"`
+	Details   string  `json:"details,omitempty"`
+	Timestamp int64   `json:"timestamp"`
+}
+
+// Message is the envelope of all messages sent to Slips
+type Message struct {
+	MessageType     string      `json:"message_type"`
+	SchemaVersion   int         `json:"schema_version"`
+	MessageContents interface{} `json:"message_contents"`
+}
+
+// PigeonScroll is a request from Slips to send a message to other peers
+type PigeonScroll struct {
+	SchemaVersion int       `json:"schema_version,omitempty"`
+	Message       string    `json:"message"`
+	Recipient     string    `json:"recipient,omitempty"`
+	Recipients    []string  `json:"recipients,omitempty"`
+	Selector      *Selector `json:"selector,omitempty"`
+	Strategy      *Strategy `json:"strategy,omitempty"`
+	Encrypt       bool      `json:"encrypt,omitempty"`
+	Bulk          *Bulk     `json:"bulk,omitempty"`
+}
+
+// Bulk asks for the message to be sent with the bulk transfer protocol, which is meant for large content such as
+// blocklists. The content is stored to a file by the recipients.
+type Bulk struct {
+	Name string `json:"name"`
+}
+
+// Selector narrows down the recipients of a PigeonScroll. Zero values mean that the filter is not used.
+type Selector struct {
+	Top            int      `json:"top,omitempty"`
+	MinReliability float64  `json:"min_reliability,omitempty"`
+	Version        string   `json:"version,omitempty"`
+	Exclude        []string `json:"exclude,omitempty"`
+}
+
+// modes of spreading a message among the recipients
+const (
+	StrategyAll      = "all"
+	StrategyRandom   = "random"
+	StrategyWeighted = "weighted"
+)
+
+// Strategy describes how a message is spread among the recipients of a PigeonScroll
+type Strategy struct {
+	Mode string `json:"mode,omitempty"`
+	// nil uses the default fanout, 0 means no limit
+	Fanout *int `json:"fanout,omitempty"`
+}
+
+// AllRecipients returns the recipient and the recipient list of the scroll combined
+func (ps *PigeonScroll) AllRecipients() []string {
+	if ps.Recipient == "" {
+		return ps.Recipients
+	}
+	return append([]string{ps.Recipient}, ps.Recipients...)
+}
+
+// NewPeerUpdate wraps the update in an envelope with the current schema version
+func NewPeerUpdate(update PeerUpdate) *Message {
+	return &Message{MessageType: PeerUpdateType, SchemaVersion: Version, MessageContents: update}
+}
+
+// NewReport wraps the report in an envelope with the current schema version
+func NewReport(report Report) *Message {
+	return &Message{MessageType: ReportType, SchemaVersion: Version, MessageContents: report}
+}
+
+// NewBulkTransfer wraps the transfer status in an envelope with the current schema version
+func NewBulkTransfer(transfer BulkTransfer) *Message {
+	return &Message{MessageType: BulkTransferType, SchemaVersion: Version, MessageContents: transfer}
+}
+
+// NewIdentity wraps the identity in an envelope with the current schema version
+func NewIdentity(identity Identity) *Message {
+	return &Message{MessageType: IdentityType, SchemaVersion: Version, MessageContents: identity}
+}
+
+// NewInteraction wraps the interaction in an envelope with the current schema version
+func NewInteraction(interaction Interaction) *Message {
+	return &Message{MessageType: InteractionType, SchemaVersion: Version, MessageContents: interaction}
+}
+
+// NewInteractionHistory wraps the history in an envelope with the current schema version
+func NewInteractionHistory(history InteractionHistory) *Message {
+	return &Message{MessageType: InteractionHistoryType, SchemaVersion: Version, MessageContents: history}
+}
+
+// Encode marshals the message and validates it against its schema
+func (m *Message) Encode() ([]byte, error) {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	if err = Validate(m.MessageType, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// DecodePigeonScroll validates the JSON received from Slips and parses it
+func DecodePigeonScroll(data []byte) (*PigeonScroll, error) {
+	if err := Validate(PigeonScrollType, data); err != nil {
+		return nil, err
+	}
+
+	ps := &PigeonScroll{}
+	if err := json.Unmarshal(data, ps); err != nil {
+		return nil, err
+	}
+
+	if err := CheckVersion(ps.SchemaVersion); err != nil {
+		return nil, err
+	}
+	return ps, nil
+}
+
+// DecodeReportFeedback validates the feedback received from Slips and parses it
+func DecodeReportFeedback(data []byte) (*ReportFeedback, error) {
+	if err := Validate(ReportFeedbackType, data); err != nil {
+		return nil, err
+	}
+
+	feedback := &ReportFeedback{}
+	if err := json.Unmarshal(data, feedback); err != nil {
+		return nil, err
+	}
+
+	if err := CheckVersion(feedback.SchemaVersion); err != nil {
+		return nil, err
+	}
+	return feedback, nil
+}
+
+// DecodeInteractionQuery validates the query received from Slips and parses it
+func DecodeInteractionQuery(data []byte) (*InteractionQuery, error) {
+	if err := Validate(InteractionQueryType, data); err != nil {
+		return nil, err
+	}
+
+	query := &InteractionQuery{}
+	if err := json.Unmarshal(data, query); err != nil {
+		return nil, err
+	}
+
+	if err := CheckVersion(query.SchemaVersion); err != nil {
+		return nil, err
+	}
+	return query, nil
+}
+
+// CommandType returns the message_type of a command from Slips, empty for pigeon scrolls, which don't have one
+func CommandType(data []byte) string {
+	command := struct {
+		MessageType string `json:"message_type"`
+	}{}
+	_ = json.Unmarshal(data, &command)
+	return command.MessageType
+}
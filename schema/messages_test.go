@@ -0,0 +1,131 @@
+package schema
+
+import (
+	"testing"
+)
+
+func TestDecodePigeonScroll(t *testing.T) {
+	tests := []struct {
+		name  string
+		json  string
+		valid bool
+	}{
+		{"single recipient", `{"message": "aGk=", "recipient": "*"}`, true},
+		{"recipient list", `{"message": "aGk=", "recipients": ["a", "b"]}`, true},
+		{"selector only", `{"message": "aGk=", "selector": {"top": 3, "version": ">=2"}}`, true},
+		{"current version", `{"schema_version": 1, "message": "aGk=", "recipient": "*"}`, true},
+		{"strategy", `{"message": "aGk=", "recipient": "*", "strategy": {"mode": "weighted", "fanout": 0}}`, true},
+		{"bulk", `{"message": "aGk=", "recipient": "*", "bulk": {"name": "blocklist-1.txt"}}`, true},
+		{"encrypted", `{"message": "aGk=", "recipient": "a", "encrypt": true}`, true},
+		{"extra field", `{"message": "aGk=", "recipient": "*", "priority": 1}`, false},
+		{"extra field in selector", `{"message": "aGk=", "selector": {"top": 1, "random": true}}`, false},
+		{"extra field in strategy", `{"message": "aGk=", "recipient": "*", "strategy": {"seed": 1}}`, false},
+		{"no message", `{"recipient": "*"}`, false},
+		{"empty message", `{"message": "", "recipient": "*"}`, false},
+		{"no recipient", `{"message": "aGk="}`, false},
+		{"empty recipient list", `{"message": "aGk=", "recipients": []}`, false},
+		{"unknown strategy", `{"message": "aGk=", "recipient": "*", "strategy": {"mode": "nearest"}}`, false},
+		{"negative fanout", `{"message": "aGk=", "recipient": "*", "strategy": {"fanout": -1}}`, false},
+		{"zero top", `{"message": "aGk=", "selector": {"top": 0}}`, false},
+		{"reliability above 1", `{"message": "aGk=", "selector": {"min_reliability": 1.5}}`, false},
+		{"invalid version constraint", `{"message": "aGk=", "selector": {"version": "latest"}}`, false},
+		// bulk names end up in file names, so paths must not get through
+		{"bulk name with a path", `{"message": "aGk=", "recipient": "*", "bulk": {"name": "../../etc/passwd"}}`,
+			false},
+		{"future version", `{"schema_version": 99, "message": "aGk=", "recipient": "*"}`, false},
+		{"not json", `message`, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := DecodePigeonScroll([]byte(test.json))
+			if valid := err == nil; valid != test.valid {
+				t.Errorf("valid %v, expected %v (%v)", valid, test.valid, err)
+			}
+		})
+	}
+}
+
+func TestDecodeCommands(t *testing.T) {
+	tests := []struct {
+		name   string
+		decode func(data []byte) error
+		json   string
+		valid  bool
+	}{
+		{"feedback", decodeFeedback, `{"message_type": "report_feedback", "peerid": "a", "report_id": "r", "rating": 1}`,
+			true},
+		{"feedback rating above 1", decodeFeedback,
+			`{"message_type": "report_feedback", "peerid": "a", "report_id": "r", "rating": 2}`, false},
+		{"feedback without report", decodeFeedback, `{"message_type": "report_feedback", "peerid": "a", "rating": 1}`,
+			false},
+		{"feedback extra field", decodeFeedback,
+			`{"message_type": "report_feedback", "peerid": "a", "report_id": "r", "rating": 1, "weight": 2}`, false},
+		{"query", decodeQuery, `{"message_type": "interaction_query", "peerid": "a", "kind": "ping", "last": 5}`, true},
+		{"query unknown kind", decodeQuery, `{"message_type": "interaction_query", "peerid": "a", "kind": "dns"}`,
+			false},
+		{"query negative since", decodeQuery, `{"message_type": "interaction_query", "peerid": "a", "since": -1}`,
+			false},
+		{"query of wrong type", decodeQuery, `{"message_type": "report_feedback", "peerid": "a"}`, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.decode([]byte(test.json))
+			if valid := err == nil; valid != test.valid {
+				t.Errorf("valid %v, expected %v (%v)", valid, test.valid, err)
+			}
+		})
+	}
+}
+
+func decodeFeedback(data []byte) error {
+	_, err := DecodeReportFeedback(data)
+	return err
+}
+
+func decodeQuery(data []byte) error {
+	_, err := DecodeInteractionQuery(data)
+	return err
+}
+
+// messages to slips are checked before they are sent
+func TestEncode(t *testing.T) {
+	compatible := true
+	tests := []struct {
+		name    string
+		message *Message
+		valid   bool
+	}{
+		{"peer update", NewPeerUpdate(PeerUpdate{PeerID: "a", Reliability: 0.5, Compatible: &compatible}), true},
+		{"peer update without peer", NewPeerUpdate(PeerUpdate{Reliability: 0.5}), false},
+		{"report", NewReport(Report{ReportID: "r", Reporter: "a", ReportTime: 1, Message: "aGk=",
+			Signature: SignatureValid}), true},
+		{"report with unknown signature", NewReport(Report{ReportID: "r", Reporter: "a", ReportTime: 1, Message: "aGk=",
+			Signature: "maybe"}), false},
+		{"interaction", NewInteraction(Interaction{PeerID: "a", Kind: "ping", Outcome: "success", Rating: 1}), true},
+		{"interaction of unknown kind", NewInteraction(Interaction{PeerID: "a", Kind: "dns", Outcome: "success"}),
+			false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := test.message.Encode()
+			if valid := err == nil; valid != test.valid {
+				t.Errorf("valid %v, expected %v (%v)", valid, test.valid, err)
+			}
+		})
+	}
+}
+
+func TestCommandType(t *testing.T) {
+	for data, expected := range map[string]string{
+		`{"message_type": "report_feedback"}`:   ReportFeedbackType,
+		`{"message": "aGk=", "recipient": "*"}`: "",
+		`not json`:                              "",
+	} {
+		if commandType := CommandType([]byte(data)); commandType != expected {
+			t.Errorf("type of %s is %q, expected %q", data, commandType, expected)
+		}
+	}
+}
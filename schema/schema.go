@@ -0,0 +1,88 @@
+// Package schema describes all messages exchanged between the pigeon and Slips over Redis.
+// Every message type has a published JSON Schema (see the json directory), which is used to validate both the
+// messages received from Slips and the messages sent to Slips.
+package schema
+
+import (
+	"embed"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/xeipuuv/gojsonschema"
+)
+
+// Version of the message schema. It is sent in every message, so Slips and the pigeon can detect a mismatch.
+// Increase it whenever a change to the schema is not backwards compatible.
+const Version = 1
+
+// names of the published schemas, these are also the message types used in the message_type field
+const (
+	PeerUpdateType     = "peer_update"
+	ReportType         = "go_data"
+	PigeonScrollType   = "pigeon_scroll"
+	BulkTransferType   = "bulk_transfer"
+	IdentityType       = "identity"
+	InteractionType    = "interaction"
+	ReportFeedbackType = "report_feedback"
+	// InteractionQueryType is sent by Slips, and answered with InteractionHistoryType
+	InteractionQueryType   = "interaction_query"
+	InteractionHistoryType = "interaction_history"
+)
+
+//go:embed json/*.json
+var files embed.FS
+
+var compiled = map[string]*gojsonschema.Schema{}
+
+func init() {
+	for _, name := range []string{PeerUpdateType, ReportType, PigeonScrollType, BulkTransferType, IdentityType,
+		InteractionType, ReportFeedbackType, InteractionQueryType, InteractionHistoryType} {
+		raw, err := Raw(name)
+		if err != nil {
+			panic(err)
+		}
+		s, err := gojsonschema.NewSchema(gojsonschema.NewBytesLoader(raw))
+		if err != nil {
+			panic(fmt.Sprintf("schema %s is invalid: %s", name, err))
+		}
+		compiled[name] = s
+	}
+}
+
+// Raw returns the published JSON Schema of the given message type
+func Raw(name string) ([]byte, error) {
+	return files.ReadFile("json/" + name + ".json")
+}
+
+// Validate checks the JSON document against the schema of the given message type
+// return error: nil if the document is valid, otherwise a description of all problems found
+func Validate(name string, document []byte) error {
+	s, ok := compiled[name]
+	if !ok {
+		return fmt.Errorf("unknown schema %q", name)
+	}
+
+	result, err := s.Validate(gojsonschema.NewBytesLoader(document))
+	if err != nil {
+		return err
+	}
+	if result.Valid() {
+		return nil
+	}
+
+	problems := make([]string, 0, len(result.Errors()))
+	for _, e := range result.Errors() {
+		problems = append(problems, e.String())
+	}
+	return errors.New(strings.Join(problems, "; "))
+}
+
+// CheckVersion reports a mismatch between the schema version of a received message and the version of this program.
+// Version 0 means that the field was missing, which is accepted for compatibility with older Slips versions.
+func CheckVersion(version int) error {
+	if version == 0 || version == Version {
+		return nil
+	}
+	return fmt.Errorf("schema version mismatch: got %d, expected %d", version, Version)
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+	"github.com/stratosphereips/p2p4slips/database"
+	"github.com/stratosphereips/p2p4slips/peer"
+	"github.com/stratosphereips/p2p4slips/schema"
+	"github.com/stratosphereips/p2p4slips/slistener"
+	"github.com/stratosphereips/p2p4slips/utils"
+)
+
+// how long the messaging check waits for the message to arrive
+const selfTestMessageTimeout = 10 * time.Second
+
+// check that the pigeon can run with the given configuration, without starting it
+// usage: p2p4slips self-test [flags]
+func runSelfTest(args []string) int {
+	fs := flag.NewFlagSet("self-test", flag.ExitOnError)
+	// the same flags as the pigeon, so the configuration that will be used is the one checked
+	cfg := utils.RegisterFlags(fs)
+	fs.Usage = func() {
+		fmt.Println("Usage: ./p2p4slips self-test [flags]")
+		fmt.Println("Check the database, the key file, the listen port and messaging between peers on loopback")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+	if cfg.RenameWithPort {
+		renameFilesAndChannels(cfg)
+	}
+
+	checks := []struct {
+		name string
+		run  func(cfg *utils.Config) (string, error)
+	}{
+		{"redis", checkRedis},
+		{"key", checkKey},
+		{"port", checkPort},
+		{"messaging", checkMessaging},
+	}
+
+	passed := true
+	for _, check := range checks {
+		detail, err := check.run(cfg)
+		if err != nil {
+			passed = false
+			fmt.Printf("[SELF-TEST] FAIL %s - %s\n", check.name, err)
+		} else {
+			fmt.Printf("[SELF-TEST] PASS %s - %s\n", check.name, detail)
+		}
+	}
+
+	if !passed {
+		return 1
+	}
+	return 0
+}
+
+func checkRedis(cfg *utils.Config) (string, error) {
+	rdb := redis.NewClient(&redis.Options{Addr: cfg.RedisDb, DialTimeout: 5 * time.Second})
+	defer rdb.Close()
+	if err := rdb.Ping().Err(); err != nil {
+		return "", err
+	}
+	return "connected to " + cfg.RedisDb, nil
+}
+
+func checkKey(cfg *utils.Config) (string, error) {
+	if cfg.KeyFile == "" {
+		return "no key file, a one time key will be used", nil
+	}
+	if _, err := os.Stat(cfg.KeyFile); os.IsNotExist(err) {
+		return fmt.Sprintf("'%s' doesn't exist, a new key will be created", cfg.KeyFile), nil
+	}
+
+	if _, err := utils.ParseKeyType(cfg.KeyType); err != nil {
+		return "", err
+	}
+	passphrase, err := utils.ReadPassphrase(cfg.KeyPassphraseEnv, cfg.KeyPassphraseFile)
+	if err != nil {
+		return "", err
+	}
+	// the key file is only read, the pigeon encrypts a plain key file with the passphrase when it starts
+	if _, err = utils.ReadKey(cfg.KeyFile, passphrase); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("loaded from '%s'", cfg.KeyFile), nil
+}
+
+func checkPort(cfg *utils.Config) (string, error) {
+	address := net.JoinHostPort(cfg.ListenHost, strconv.Itoa(cfg.ListenPort))
+	socket, err := net.Listen("tcp", address)
+	if err != nil {
+		return "", err
+	}
+	_ = socket.Close()
+	return "can listen on " + address, nil
+}
+
+// start two pigeons on loopback, with in-memory buses instead of redis, and check that a signed message sent by one
+// of them reaches the slips side of the other
+func checkMessaging(cfg *utils.Config) (string, error) {
+	started := time.Now()
+	var pigeons []*peer.Peer
+	var buses []*database.MemoryBus
+	defer func() {
+		var wg sync.WaitGroup
+		for i := range pigeons {
+			wg.Add(1)
+			go func(p *peer.Peer, bus *database.MemoryBus) {
+				defer wg.Done()
+				p.Close()
+				bus.Close()
+			}(pigeons[i], buses[i])
+		}
+		wg.Wait()
+	}()
+
+	for i := 0; i < 2; i++ {
+		fs := flag.NewFlagSet("self-test pigeon", flag.ContinueOnError)
+		pigeonCfg := utils.RegisterFlags(fs)
+		err := fs.Parse([]string{"-host", "127.0.0.1", "-port", "0", "-mdns=false", "-pid", cfg.ProtocolID,
+			"-pid-prefix", cfg.ProtocolPrefix})
+		if err != nil {
+			return "", err
+		}
+		bus := database.NewMemoryBus()
+		p := peer.NewPeer(pigeonCfg, bus)
+		if err = p.PeerInit(); err != nil {
+			bus.Close()
+			return "", err
+		}
+		pigeons = append(pigeons, p)
+		buses = append(buses, bus)
+		listener := &slistener.SListener{Peer: p, Bus: bus}
+		go listener.Run()
+	}
+
+	addresses := pigeons[1].Addresses()
+	if len(addresses) == 0 {
+		return "", errors.New("pigeon on loopback has no address")
+	}
+	if err := pigeons[0].Connect(addresses[0]); err != nil {
+		return "", err
+	}
+
+	message := base64.StdEncoding.EncodeToString([]byte(`{"self_test": true}`))
+	scroll, err := json.Marshal(schema.PigeonScroll{SchemaVersion: schema.Version, Message: message,
+		Recipient: pigeons[1].ID(), Strategy: &schema.Strategy{Mode: schema.StrategyAll}})
+	if err != nil {
+		return "", err
+	}
+	buses[0].Publish(string(scroll))
+
+	deadline := time.Now().Add(selfTestMessageTimeout)
+	for time.Now().Before(deadline) {
+		if report := findSelfTestReport(buses[1], message); report != nil {
+			if report.Signature != schema.SignatureValid || report.Origin != pigeons[0].ID() {
+				return "", fmt.Errorf("message arrived with signature %s from origin %q", report.Signature,
+					report.Origin)
+			}
+			return fmt.Sprintf("peers on loopback exchanged messages in %s", time.Since(started).Round(time.Millisecond)),
+				nil
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return "", fmt.Errorf("message between peers on loopback didn't arrive within %s", selfTestMessageTimeout)
+}
+
+// the report with the given message that the pigeon sent to its bus, nil if there is none
+func findSelfTestReport(bus *database.MemoryBus, message string) *schema.Report {
+	for _, published := range bus.Published() {
+		envelope := struct {
+			MessageType     string        `json:"message_type"`
+			MessageContents schema.Report `json:"message_contents"`
+		}{}
+		if json.Unmarshal([]byte(published), &envelope) != nil || envelope.MessageType != schema.ReportType {
+			continue
+		}
+		if envelope.MessageContents.Message == message {
+			return &envelope.MessageContents
+		}
+	}
+	return nil
+}
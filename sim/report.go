@@ -0,0 +1,70 @@
+package sim
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+// WriteCSV writes all samples, one line per sample
+func (r *Report) WriteCSV(w io.Writer) error {
+	out := csv.NewWriter(w)
+	if err := out.Write([]string{"time_s", "behaviour", "model", "peers", "active", "mean", "min", "max"}); err != nil {
+		return err
+	}
+	for _, s := range r.Samples {
+		record := []string{
+			strconv.FormatFloat(s.Time.Seconds(), 'f', 0, 64), s.Behaviour, s.Model, strconv.Itoa(s.Peers),
+			strconv.Itoa(s.Active), formatScore(s.Mean), formatScore(s.Min), formatScore(s.Max),
+		}
+		if err := out.Write(record); err != nil {
+			return err
+		}
+	}
+	out.Flush()
+	return out.Error()
+}
+
+// WriteTable writes the mean reliability of each behaviour over time, with one column per behaviour and model
+func (r *Report) WriteTable(w io.Writer) error {
+	var columns []string
+	seen := map[string]bool{}
+	rows := map[time.Duration]map[string]float64{}
+	var times []time.Duration
+
+	for _, s := range r.Samples {
+		column := s.Behaviour + "/" + s.Model
+		if !seen[column] {
+			seen[column] = true
+			columns = append(columns, column)
+		}
+		if rows[s.Time] == nil {
+			rows[s.Time] = map[string]float64{}
+			times = append(times, s.Time)
+		}
+		rows[s.Time][column] = s.Mean
+	}
+
+	out := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprint(out, "time\t")
+	for _, column := range columns {
+		fmt.Fprintf(out, "%s\t", column)
+	}
+	fmt.Fprintln(out)
+	for _, t := range times {
+		fmt.Fprintf(out, "%s\t", t)
+		for _, column := range columns {
+			fmt.Fprintf(out, "%s\t", formatScore(rows[t][column]))
+		}
+		fmt.Fprintln(out)
+	}
+	fmt.Fprintf(out, "\nevents processed: %d\n", r.Events)
+	return out.Flush()
+}
+
+func formatScore(value float64) string {
+	return strconv.FormatFloat(value, 'f', 3, 64)
+}
@@ -0,0 +1,396 @@
+// Package sim simulates one pigeon and many remote peers on a virtual clock, to show how reliability scores of the
+// peers evolve under different behaviours. It models the ping scheduler, the ping handler and the penalty for
+// invalid signatures, using the same rating functions as the pigeon. Runs with the same seed give the same results.
+package sim
+
+import (
+	"container/heap"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"time"
+
+	"github.com/stratosphereips/p2p4slips/peer"
+)
+
+// Behaviour of a simulated peer
+type Behaviour struct {
+	// probability that the peer answers a ping
+	ReplyRate float64
+	// round trip time of answered pings is uniformly distributed in Rtt +- RttSpread
+	Rtt       time.Duration
+	RttSpread time.Duration
+	// average gap between the pings the peer sends to the pigeon (0 if it doesn't ping)
+	PingGap time.Duration
+	// messages the peer sends per hour, and the fraction of them with an invalid signature
+	MessagesPerHour float64
+	ForgeRate       float64
+}
+
+// Behaviours known to the simulator
+var Behaviours = map[string]Behaviour{
+	"honest": {ReplyRate: 0.99, Rtt: 50 * time.Millisecond, RttSpread: 40 * time.Millisecond,
+		PingGap: 30 * time.Second, MessagesPerHour: 2},
+	"flaky": {ReplyRate: 0.6, Rtt: 3 * time.Second, RttSpread: 3 * time.Second,
+		PingGap: 30 * time.Second, MessagesPerHour: 2},
+	"liar": {ReplyRate: 0.99, Rtt: 50 * time.Millisecond, RttSpread: 40 * time.Millisecond,
+		PingGap: 30 * time.Second, MessagesPerHour: 6, ForgeRate: 0.8},
+	"flooder": {ReplyRate: 0.99, Rtt: 50 * time.Millisecond, RttSpread: 40 * time.Millisecond,
+		PingGap: time.Second},
+}
+
+// TrustModel computes the reliability of a peer from its ratings and the outcomes of the rated interactions, oldest
+// first
+type TrustModel func(ratings []float64, outcomes []string) float64
+
+// Models that can be compared. "average" is the model used by the pigeon.
+var Models = map[string]TrustModel{
+	"average": peer.ComputeReliability,
+	"recent":  recentAverage(100),
+	"ewma":    ewma(0.05),
+}
+
+// average of the last n ratings
+func recentAverage(n int) TrustModel {
+	return func(ratings []float64, outcomes []string) float64 {
+		if len(ratings) > n {
+			ratings = ratings[len(ratings)-n:]
+			outcomes = outcomes[len(outcomes)-n:]
+		}
+		return peer.ComputeReliability(ratings, outcomes)
+	}
+}
+
+// exponentially weighted moving average, newer ratings have more weight. Outcomes are ignored
+func ewma(alpha float64) TrustModel {
+	return func(ratings []float64, _ []string) float64 {
+		value := ratings[0]
+		for _, rating := range ratings[1:] {
+			value = alpha*rating + (1-alpha)*value
+		}
+		return value
+	}
+}
+
+// Config of a simulation
+type Config struct {
+	// number of peers with each behaviour
+	Population map[string]int
+	Duration   time.Duration
+	// how often the reliability of the peers is sampled
+	SampleInterval time.Duration
+	Seed           int64
+	Ping           peer.PingConfig
+	// names of the trust models to compare
+	Models []string
+}
+
+// Sample describes the reliability of all peers with one behaviour, according to one model, at one time
+type Sample struct {
+	Time      time.Duration
+	Behaviour string
+	Model     string
+	Peers     int // peers with at least one rating, only these are included
+	Mean      float64
+	Min       float64
+	Max       float64
+	Active    int
+}
+
+// Report is the result of a simulation
+type Report struct {
+	Samples []Sample
+	// number of processed events, such as pings and messages
+	Events int
+}
+
+type simPeer struct {
+	behaviour string
+	ratings   []float64
+	outcomes  []string // outcome of each rated interaction
+	active    bool
+	interval  time.Duration // current interval of the ping scheduler
+	// last successful ping in either direction on the virtual clock, like PeerData.LastGoodPing
+	lastGoodPing time.Time
+	scheduled    bool // a ping by the pigeon is planned
+}
+
+func (p *simPeer) rate(rating float64, outcome string) {
+	p.ratings = append(p.ratings, rating)
+	p.outcomes = append(p.outcomes, outcome)
+}
+
+// start of the virtual clock
+var simEpoch = time.Unix(0, 0)
+
+type eventKind int
+
+const (
+	pigeonPings eventKind = iota
+	peerPings
+	peerSends
+	sample
+)
+
+type event struct {
+	at   time.Duration
+	seq  int
+	kind eventKind
+	peer int
+}
+
+// events ordered by time, then by the order they were planned in, so the simulation is deterministic
+type eventQueue []event
+
+func (q eventQueue) Len() int { return len(q) }
+func (q eventQueue) Less(i, j int) bool {
+	if q[i].at != q[j].at {
+		return q[i].at < q[j].at
+	}
+	return q[i].seq < q[j].seq
+}
+func (q eventQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *eventQueue) Push(x interface{}) { *q = append(*q, x.(event)) }
+func (q *eventQueue) Pop() interface{} {
+	old := *q
+	e := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return e
+}
+
+type simulation struct {
+	cfg    Config
+	rnd    *rand.Rand
+	queue  eventQueue
+	seq    int
+	peers  []*simPeer
+	models map[string]TrustModel
+	report *Report
+}
+
+// Run runs the simulation
+func Run(cfg Config) (*Report, error) {
+	if cfg.Duration <= 0 || cfg.SampleInterval <= 0 {
+		return nil, errors.New("duration and sample interval must be positive")
+	}
+	if err := cfg.Ping.Validate(); err != nil {
+		return nil, err
+	}
+
+	s := &simulation{
+		cfg:    cfg,
+		rnd:    rand.New(rand.NewSource(cfg.Seed)),
+		models: map[string]TrustModel{},
+		report: &Report{},
+	}
+	for _, name := range cfg.Models {
+		model, ok := Models[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown trust model %q", name)
+		}
+		s.models[name] = model
+	}
+
+	// sorted, so the peers are created in the same order in every run
+	var behaviours []string
+	for name := range cfg.Population {
+		if _, ok := Behaviours[name]; !ok {
+			return nil, fmt.Errorf("unknown behaviour %q", name)
+		}
+		behaviours = append(behaviours, name)
+	}
+	sort.Strings(behaviours)
+	for _, name := range behaviours {
+		for i := 0; i < cfg.Population[name]; i++ {
+			s.addPeer(name)
+		}
+	}
+	if len(s.peers) == 0 {
+		return nil, errors.New("no peers to simulate")
+	}
+
+	s.plan(cfg.SampleInterval, sample, -1)
+	for s.queue.Len() > 0 {
+		e := heap.Pop(&s.queue).(event)
+		if e.at > cfg.Duration {
+			break
+		}
+		s.report.Events++
+		s.handle(e)
+	}
+	return s.report, nil
+}
+
+// add a peer that was just discovered, it is contacted within the base ping interval
+func (s *simulation) addPeer(behaviour string) {
+	index := len(s.peers)
+	s.peers = append(s.peers, &simPeer{behaviour: behaviour})
+	s.activate(index, 0)
+
+	b := Behaviours[behaviour]
+	if b.PingGap > 0 {
+		s.plan(s.spread(b.PingGap), peerPings, index)
+	}
+	if b.MessagesPerHour > 0 {
+		s.plan(s.messageGap(b), peerSends, index)
+	}
+}
+
+func (s *simulation) plan(at time.Duration, kind eventKind, peer int) {
+	s.seq++
+	heap.Push(&s.queue, event{at: at, seq: s.seq, kind: kind, peer: peer})
+}
+
+// a peer becomes active when it contacts the pigeon, and the ping scheduler starts with the base interval
+func (s *simulation) activate(index int, now time.Duration) {
+	p := s.peers[index]
+	if p.active {
+		return
+	}
+	p.active = true
+	p.interval = s.cfg.Ping.Interval
+	if !p.scheduled {
+		p.scheduled = true
+		s.plan(now+s.jitter(p.interval), pigeonPings, index)
+	}
+}
+
+func (s *simulation) handle(e event) {
+	switch e.kind {
+	case pigeonPings:
+		s.pigeonPings(e.peer, e.at)
+	case peerPings:
+		s.peerPings(e.peer, e.at)
+	case peerSends:
+		s.peerSends(e.peer, e.at)
+	case sample:
+		s.sample(e.at)
+		s.plan(e.at+s.cfg.SampleInterval, sample, -1)
+	}
+}
+
+// the ping scheduler of the pigeon pings the peer, see pingScheduler.ping and Peer.sendPing
+func (s *simulation) pigeonPings(index int, now time.Duration) {
+	p := s.peers[index]
+	p.scheduled = false
+	if !p.active {
+		return
+	}
+
+	// peers contacted within the base interval are not pinged, and that counts as a success
+	if !peer.PingDue(s.cfg.Ping, p.lastGoodPing, s.clock(now)) {
+		s.planNextPing(index, now, true)
+		return
+	}
+
+	b := Behaviours[p.behaviour]
+	rtt := b.Rtt + time.Duration((2*s.rnd.Float64()-1)*float64(b.RttSpread))
+	if rtt < time.Millisecond {
+		rtt = time.Millisecond
+	}
+
+	rating, outcome := peer.RatePing(s.cfg.Ping, rtt, s.rnd.Float64() < b.ReplyRate && rtt <= s.cfg.Ping.Timeout)
+	p.rate(rating, outcome)
+	if outcome == peer.OutcomeSuccess {
+		p.lastGoodPing = s.clock(now)
+		s.planNextPing(index, now, true)
+		return
+	}
+
+	if peer.DeactivationDue(s.cfg.Ping, p.lastGoodPing, s.clock(now)) {
+		p.active = false
+		return
+	}
+	s.planNextPing(index, now, false)
+}
+
+// plan the next ping with the interval the ping scheduler would use
+func (s *simulation) planNextPing(index int, now time.Duration, ok bool) {
+	p := s.peers[index]
+	p.interval = peer.NextPingInterval(s.cfg.Ping, p.interval, ok)
+	p.scheduled = true
+	s.plan(now+s.jitter(p.interval), pigeonPings, index)
+}
+
+// the peer pings the pigeon, pings closer than the minimal gap are penalized, see Peer.handlePing
+func (s *simulation) peerPings(index int, now time.Duration) {
+	p := s.peers[index]
+	s.activate(index, now)
+
+	p.rate(peer.RateReceivedPing(s.cfg.Ping, p.lastGoodPing, s.clock(now)))
+	p.lastGoodPing = s.clock(now)
+
+	s.plan(now+s.spread(Behaviours[p.behaviour].PingGap), peerPings, index)
+}
+
+// the peer sends a message, messages with invalid signatures are penalized, see Peer.handleSignedMessage
+func (s *simulation) peerSends(index int, now time.Duration) {
+	p := s.peers[index]
+	s.activate(index, now)
+
+	b := Behaviours[p.behaviour]
+	if s.rnd.Float64() < b.ForgeRate {
+		p.rate(0, peer.OutcomeInvalid)
+	}
+	s.plan(now+s.messageGap(b), peerSends, index)
+}
+
+func (s *simulation) sample(now time.Duration) {
+	var behaviours []string
+	for name := range s.cfg.Population {
+		behaviours = append(behaviours, name)
+	}
+	sort.Strings(behaviours)
+
+	for _, behaviour := range behaviours {
+		for _, modelName := range s.cfg.Models {
+			model := s.models[modelName]
+			sample := Sample{Time: now, Behaviour: behaviour, Model: modelName, Min: math.Inf(1), Max: math.Inf(-1)}
+			total := 0.0
+			for _, p := range s.peers {
+				if p.behaviour != behaviour {
+					continue
+				}
+				if p.active {
+					sample.Active++
+				}
+				if len(p.ratings) == 0 {
+					continue
+				}
+				reliability := model(p.ratings, p.outcomes)
+				total += reliability
+				sample.Peers++
+				sample.Min = math.Min(sample.Min, reliability)
+				sample.Max = math.Max(sample.Max, reliability)
+			}
+			if sample.Peers == 0 {
+				sample.Min, sample.Max = 0, 0
+			} else {
+				sample.Mean = total / float64(sample.Peers)
+			}
+			s.report.Samples = append(s.report.Samples, sample)
+		}
+	}
+}
+
+// the time on the virtual clock, for the rules of the pigeon that work with timestamps
+func (s *simulation) clock(now time.Duration) time.Time {
+	return simEpoch.Add(now)
+}
+
+// randomly shift the interval by up to the configured jitter fraction, like the ping scheduler does
+func (s *simulation) jitter(interval time.Duration) time.Duration {
+	return peer.JitterInterval(s.cfg.Ping, interval, s.rnd)
+}
+
+// a gap between 0.8 and 1.2 times the given one
+func (s *simulation) spread(gap time.Duration) time.Duration {
+	return time.Duration(float64(gap) * (0.8 + 0.4*s.rnd.Float64()))
+}
+
+// time to the next message, messages arrive as a Poisson process
+func (s *simulation) messageGap(b Behaviour) time.Duration {
+	return time.Duration(s.rnd.ExpFloat64() / b.MessagesPerHour * float64(time.Hour))
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/stratosphereips/p2p4slips/peer"
+	"github.com/stratosphereips/p2p4slips/sim"
+	"github.com/stratosphereips/p2p4slips/utils"
+)
+
+// simulate how reliability of peers with different behaviours evolves, without any network
+// usage: p2p4slips simulate [flags]
+func runSimulate(args []string) int {
+	fs := flag.NewFlagSet("simulate", flag.ExitOnError)
+	// the ping flags of the pigeon configure the simulated pigeon as well
+	cfg := utils.RegisterFlags(fs)
+	population := fs.String("population", "honest=80,flaky=10,liar=5,flooder=5", "Number of simulated peers "+
+		"with each behaviour: "+strings.Join(behaviourNames(), ", "))
+	duration := fs.Duration("duration", 24*time.Hour, "Simulated time")
+	sampleInterval := fs.Duration("sample-interval", time.Hour, "How often the reliability of peers is sampled")
+	seed := fs.Int64("seed", 1, "Seed of the random generator, runs with the same seed give the same results")
+	models := fs.String("models", "average", "Comma separated trust models to compare: "+
+		strings.Join(modelNames(), ", "))
+	format := fs.String("format", "table", "Output format: table or csv")
+	fs.Usage = func() {
+		fmt.Println("Usage: ./p2p4slips simulate [flags]")
+		fmt.Println("Simulate peers with different behaviours on a virtual clock and report their reliability")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+
+	counts, err := parsePopulation(*population)
+	if err != nil {
+		fmt.Println("[SIMULATE] Invalid population -", err)
+		return 2
+	}
+	if *format != "table" && *format != "csv" {
+		fmt.Printf("[SIMULATE] Unknown output format %q\n", *format)
+		return 2
+	}
+
+	report, err := sim.Run(sim.Config{
+		Population:     counts,
+		Duration:       *duration,
+		SampleInterval: *sampleInterval,
+		Seed:           *seed,
+		Ping:           peer.NewPingConfig(cfg),
+		Models:         strings.Split(*models, ","),
+	})
+	if err != nil {
+		fmt.Println("[SIMULATE] Simulation failed -", err)
+		return 1
+	}
+
+	if *format == "csv" {
+		err = report.WriteCSV(os.Stdout)
+	} else {
+		err = report.WriteTable(os.Stdout)
+	}
+	if err != nil {
+		fmt.Println("[SIMULATE] Writing the report failed -", err)
+		return 1
+	}
+	return 0
+}
+
+// parse a list such as honest=80,liar=5
+func parsePopulation(value string) (map[string]int, error) {
+	counts := map[string]int{}
+	for _, item := range strings.Split(value, ",") {
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("expected behaviour=count, got %q", item)
+		}
+		count, err := strconv.Atoi(parts[1])
+		if err != nil || count < 0 {
+			return nil, fmt.Errorf("invalid count in %q", item)
+		}
+		counts[strings.TrimSpace(parts[0])] = count
+	}
+	return counts, nil
+}
+
+func behaviourNames() []string {
+	var names []string
+	for name := range sim.Behaviours {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func modelNames() []string {
+	var names []string
+	for name := range sim.Models {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
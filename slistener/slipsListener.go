@@ -1,32 +1,27 @@
 package slistener
 
 import (
-	"encoding/json"
-	"errors"
 	"fmt"
 	"strings"
 
 	"github.com/stratosphereips/p2p4slips/database"
 	"github.com/stratosphereips/p2p4slips/peer"
+	"github.com/stratosphereips/p2p4slips/schema"
 )
 
 type SListener struct {
 	Peer *peer.Peer
-}
-
-type PigeonScroll struct {
-	Message   string `json:"message"`
-	Recipient string `json:"recipient"`
+	Bus  database.Bus
 }
 
 func (s *SListener) Run() {
 
 	// Consume messages. (msgs arriving here are the ones sent by slips to ask other peers about ips )
-	for msg := range database.DBW.Ch {
+	for msg := range s.Bus.Commands() {
 		// if redis is stopped, golang will show an error:
 		// pubsub.go:160: redis: discarding bad PubSub connection: EOF
 		// I don't know where to catch this, but it is not a problem. When redis is restarted, pubsub listens again
-		s.handleCommand(msg.Payload)
+		s.handleCommand(msg)
 	}
 }
 
@@ -39,6 +34,15 @@ func (s *SListener) handleCommand(message string) {
 		return
 	}
 
+	switch schema.CommandType([]byte(message)) {
+	case schema.ReportFeedbackType:
+		s.handleFeedback(message)
+		return
+	case schema.InteractionQueryType:
+		s.handleInteractionQuery(message)
+		return
+	}
+
 	ps, err := s.parseJson(message)
 
 	if err != nil {
@@ -48,30 +52,39 @@ func (s *SListener) handleCommand(message string) {
 
 	//fmt.Println("[SLISTENER] Message sent from Slips: ", ps)
 
-	// send the message to the peer specified in the scroll
-	s.Peer.SendMessageToPeerId(ps.Message, ps.Recipient)
+	// send the message to the peers specified in the scroll
+	s.Peer.SendSlipsMessage(ps)
 
 	// the responses should be processed by remote peers eventually
 	// and should be processed by the peer listening loop
 	// and saved to slips database from there
 }
 
-func (s *SListener) parseJson(message string) (*PigeonScroll, error) {
-	ps := &PigeonScroll{}
-
-	if err := json.Unmarshal([]byte(message), ps); err != nil {
-		fmt.Println("[SLISTENER] ", err)
-		return nil, err
+// rate the quality of a report of a peer, as judged by slips
+func (s *SListener) handleFeedback(message string) {
+	feedback, err := schema.DecodeReportFeedback([]byte(message))
+	if err != nil {
+		fmt.Println("[SLISTENER] Report feedback from Slips doesn't match the schema -", err)
+		return
 	}
+	s.Peer.HandleReportFeedback(feedback)
+}
 
-	if ps.Message == "" {
-		fmt.Println("[SLISTENER] JSON is missing the Message field")
-		return nil, errors.New("message field missing")
+// send slips the interaction history of a peer
+func (s *SListener) handleInteractionQuery(message string) {
+	query, err := schema.DecodeInteractionQuery([]byte(message))
+	if err != nil {
+		fmt.Println("[SLISTENER] Interaction query from Slips doesn't match the schema -", err)
+		return
 	}
+	s.Peer.HandleInteractionQuery(query)
+}
 
-	if ps.Recipient == "" {
-		fmt.Println("[SLISTENER] JSON is missing the Recipient field")
-		return nil, errors.New("recipient field missing")
+func (s *SListener) parseJson(message string) (*schema.PigeonScroll, error) {
+	ps, err := schema.DecodePigeonScroll([]byte(message))
+	if err != nil {
+		fmt.Println("[SLISTENER] Message from Slips doesn't match the schema -", err)
+		return nil, err
 	}
 
 	if !strings.HasSuffix(ps.Message, "\n") {
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/stratosphereips/p2p4slips/peer"
+	"github.com/stratosphereips/p2p4slips/peerdb"
+	"github.com/stratosphereips/p2p4slips/utils"
+)
+
+// export known peers to a signed file
+// usage: p2p4slips export [flags] <output file>
+func runExport(args []string) int {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	cfg := utils.RegisterFlags(fs)
+	fs.Usage = func() {
+		fmt.Println("Usage: ./p2p4slips export [flags] <output file>")
+		fmt.Println("Export known peers to a file signed by the key of this node")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+	renameFilesAndChannels(cfg)
+
+	key, err := loadNodeKey(cfg)
+	if err != nil {
+		fmt.Println("[EXPORT] Loading key failed -", err)
+		return 1
+	}
+
+	ps, err := openPeerStore(cfg)
+	if err != nil {
+		fmt.Println("[EXPORT] Loading peerstore failed -", err)
+		return 1
+	}
+	defer closePeerStore(ps)
+
+	data, err := ps.Export(key)
+	if err == nil {
+		err = utils.WriteFileAtomic(fs.Arg(0), data, 0600)
+	}
+	if err != nil {
+		fmt.Println("[EXPORT] Export failed -", err)
+		return 1
+	}
+
+	fmt.Printf("[EXPORT] Exported %d peers to '%s'\n", len(ps.AllPeers), fs.Arg(0))
+	return 0
+}
+
+// merge peers from a file created by export into the local peerstore
+// usage: p2p4slips import [flags] <input file>
+func runImport(args []string) int {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	keepReliability := fs.Bool("keep-reliability", false, "Take over interaction history and reliability of "+
+		"imported peers. By default, imported peers start with no history and known peers keep their own")
+	trustedExporter := fs.String("exporter", "", "Only accept files exported by the node with this peer id")
+	cfg := utils.RegisterFlags(fs)
+	fs.Usage = func() {
+		fmt.Println("Usage: ./p2p4slips import [flags] <input file>")
+		fmt.Println("Merge peers exported by another node into the local peerstore. Don't run it while the node is running")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+	renameFilesAndChannels(cfg)
+
+	if cfg.PeerstoreFile == "" && cfg.PeerstoreDB == "" {
+		fmt.Println("[IMPORT] No peerstore to import into, use -peerstore-file or -peerstore-db")
+		return 2
+	}
+
+	data, err := ioutil.ReadFile(fs.Arg(0))
+	if err != nil {
+		fmt.Println("[IMPORT] Reading export failed -", err)
+		return 1
+	}
+	payload, err := peer.VerifyExport(data)
+	if err != nil {
+		fmt.Println("[IMPORT] Export can't be trusted -", err)
+		return 1
+	}
+	if *trustedExporter != "" && payload.Exporter != *trustedExporter {
+		fmt.Printf("[IMPORT] Export was created by %s, not by %s\n", payload.Exporter, *trustedExporter)
+		return 1
+	}
+	fmt.Printf("[IMPORT] Export of %d peers by %s, created %s\n", len(payload.Peers), payload.Exporter,
+		payload.Created)
+
+	ps, err := openPeerStore(cfg)
+	if err != nil {
+		fmt.Println("[IMPORT] Loading peerstore failed -", err)
+		return 1
+	}
+	defer closePeerStore(ps)
+
+	added, updated := ps.MergePeers(payload.Peers, *keepReliability)
+	if err = ps.SaveToFile(nil); err != nil {
+		fmt.Println("[IMPORT] Saving peerstore failed -", err)
+		return 1
+	}
+
+	fmt.Printf("[IMPORT] Added %d peers, updated %d peers\n", added, updated)
+	return 0
+}
+
+// load the identity key of this node as configured. The key file must exist, a new or one time key would sign the
+// export with an identity that no peer knows
+func loadNodeKey(cfg *utils.Config) (crypto.PrivKey, error) {
+	if cfg.KeyFile == "" {
+		return nil, errors.New("no key file given, the export must be signed by the key of the node (-key-file)")
+	}
+	passphrase, err := utils.ReadPassphrase(cfg.KeyPassphraseEnv, cfg.KeyPassphraseFile)
+	if err != nil {
+		return nil, err
+	}
+	return utils.ReadKey(cfg.KeyFile, passphrase)
+}
+
+// load the peerstore as configured, without starting the node
+func openPeerStore(cfg *utils.Config) (*peer.PeerStore, error) {
+	if cfg.PeerstoreFile == "" && cfg.PeerstoreDB == "" {
+		return nil, errors.New("no peerstore given, use -peerstore-file or -peerstore-db")
+	}
+
+	ps := &peer.PeerStore{SaveFile: cfg.PeerstoreFile, Retention: cfg.PeerstoreRetention}
+	if cfg.PeerstoreDB != "" {
+		db, err := peerdb.Open(cfg.PeerstoreDB)
+		if err != nil {
+			return nil, err
+		}
+		ps.DB = db
+	}
+
+	ps.ReadFromFile(nil)
+	return ps, nil
+}
+
+func closePeerStore(ps *peer.PeerStore) {
+	if ps.DB != nil {
+		_ = ps.DB.Close()
+	}
+}
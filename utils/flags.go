@@ -2,57 +2,153 @@ package utils
 
 import (
 	"flag"
+	"time"
 )
 
 type Config struct {
-	RendezvousString string
-	ProtocolID       string
-	KeyFile          string
-	PeerstoreFile    string
-	RenameWithPort   bool
-	ListenHost       string
-	ListenPort       int
-	ResetKeys        bool
-	RedisDb          string
-	RedisDelete      bool
-	RedisChannelPyGo string
-	RedisChannelGoPy string
-	RunTests         bool
-	ShowHelp         bool
+	RendezvousString      string
+	Mdns                  bool
+	ProtocolID            string
+	ProtocolPrefix        string
+	KeyFile               string
+	PeerstoreFile         string
+	PeerstoreSaveInterval time.Duration
+	PeerstoreDB           string
+	PeerstoreRetention    time.Duration
+	BulkDir               string
+	BulkQuotaMB           int64
+	BulkMaxPerPeer        int
+	BulkPartTTL           time.Duration
+	Compression           bool
+	MetricsAddress        string
+	RenameWithPort        bool
+	ListenHost            string
+	ListenPort            int
+	ResetKeys             bool
+	KeyType               string
+	RotateKey             bool
+	KeyPassphraseEnv      string
+	KeyPassphraseFile     string
+	RedisDb               string
+	RedisDelete           bool
+	RedisChannelPyGo      string
+	RedisChannelGoPy      string
+	RedisKeySuffix        string // appended to the Redis keys of this node, set by -rename-with-port
+	SelectionMode         string
+	Fanout                int
+	ShareInteractions     string
+	ReportQualityWeight   float64
+	PingInterval          time.Duration
+	PingMaxInterval       time.Duration
+	PingJitter            float64
+	PingTimeout           time.Duration
+	PingDeactivateAfter   time.Duration
+	PingMinGap            time.Duration
+	PingParallelism       int
+	ShowHelp              bool
 }
 
+// ParseFlags parses the command line of the main program
 func ParseFlags() *Config {
+	c := RegisterFlags(flag.CommandLine)
+	flag.Parse()
+	return c
+}
+
+// RegisterFlags defines all configuration flags on the flag set. Subcommands use it to accept the same options as
+// the main program. The returned config is filled in when the flag set is parsed.
+func RegisterFlags(fs *flag.FlagSet) *Config {
 	c := &Config{}
 
-	flag.StringVar(&c.RendezvousString, "rendezvous", "slips", "Unique string to identify group "+
+	fs.StringVar(&c.RendezvousString, "rendezvous", "slips", "Unique string to identify group "+
 		"of nodes. Share this with your friends to let them connect with you")
-	flag.StringVar(&c.ListenHost, "host", "", "The bootstrap node host listen address\n")
-	flag.StringVar(&c.ProtocolID, "pid", "/slips/1.0", "Sets a protocol id for stream headers")
-	flag.IntVar(&c.ListenPort, "port", 4001, "node listen port")
+	fs.BoolVar(&c.Mdns, "mdns", true, "Discover peers on the local network with mDNS")
+	fs.StringVar(&c.ListenHost, "host", "", "IPv4 address to listen on. If no address is specified, "+
+		"all interfaces are used")
+	fs.StringVar(&c.ProtocolID, "pid", "/slips/1.0", "Sets a protocol id for stream headers. This is the legacy "+
+		"protocol carrying all traffic, it is used with peers that don't know the per-channel protocols")
+	fs.StringVar(&c.ProtocolPrefix, "pid-prefix", "/slips", "Prefix of the per-channel protocol ids "+
+		"(<prefix>/control/<version>, <prefix>/data/<version>)")
+	fs.IntVar(&c.ListenPort, "port", 4001, "node listen port, 0 picks a free port")
 
-	flag.StringVar(&c.KeyFile, "key-file", "", "File containing keys. If it is provided, keys "+
+	fs.StringVar(&c.KeyFile, "key-file", "", "File containing keys. If it is provided, keys "+
 		"will be loaded from the file and saved to it for later use. If no file is specified, one time keys will be "+
 		"generated")
-	flag.BoolVar(&c.ResetKeys, "key-reset", false, "Delete old keys and create new ones")
+	fs.BoolVar(&c.ResetKeys, "key-reset", false, "Delete old keys and create new ones. This is also "+
+		"required to replace a key file that can't be read or decoded")
+	fs.StringVar(&c.KeyType, "key-type", "ed25519", "Type of newly generated keys: ed25519, rsa, ecdsa "+
+		"or secp256k1")
+	fs.StringVar(&c.KeyPassphraseEnv, "key-passphrase-env", "", "Name of an environment variable with "+
+		"the passphrase protecting the key file. If a passphrase is set, the key file is encrypted")
+	fs.StringVar(&c.KeyPassphraseFile, "key-passphrase-file", "", "File containing the passphrase "+
+		"protecting the key file. Alternative to -key-passphrase-env")
+	fs.BoolVar(&c.RotateKey, "key-rotate", false, "Replace the key in the key file with a new one and exit. "+
+		"On the next start, peers are told about the new identity, so they keep the reputation of the old one")
 
-	flag.StringVar(&c.PeerstoreFile, "peerstore-file", "", "File containing known peers. If it is"+
+	fs.StringVar(&c.PeerstoreFile, "peerstore-file", "", "File containing known peers. If it is"+
 		" provided, peers will be loaded from the file and saved to it for later use. If no file is specified, or if "+
 		"the file cannot be decrypted with the given private key, empty peerstore will be created")
 
-	flag.BoolVar(&c.RenameWithPort, "rename-with-port", false, "Port is appended to filenames and "+
-		"channels for convenient running of more peers on one host. Set to false to keep filenames unchanged")
+	fs.DurationVar(&c.PeerstoreSaveInterval, "peerstore-save-interval", 5*time.Minute, "How often the "+
+		"peerstore is saved while running, so a crash doesn't lose all reputation data. 0 saves it only on shutdown")
 
-	flag.StringVar(&c.RedisDb, "redis-db", "localhost:6379", "Remote redis database")
+	fs.StringVar(&c.PeerstoreDB, "peerstore-db", "", "Database file for known peers and their "+
+		"interaction history. If it is provided, it is used instead of the peerstore file, and peers from the "+
+		"peerstore file are imported into it when it is empty")
+	fs.DurationVar(&c.PeerstoreRetention, "peerstore-retention", 0, "Interactions with peers and "+
+		"ratings of their reports older than this are forgotten. 0 keeps the whole history")
 
-	flag.BoolVar(&c.RedisDelete, "redis-delete", false, "Delete database when starting the program")
+	fs.StringVar(&c.BulkDir, "bulk-dir", "", "Directory where content received by bulk transfers (such as "+
+		"blocklists) is stored, together with unfinished transfers that can be resumed. If no directory is "+
+		"specified, bulk transfers from other peers are refused")
+	fs.Int64Var(&c.BulkQuotaMB, "bulk-quota-mb", 1024, "Maximum size in MiB of all content in the bulk "+
+		"directory, received and unfinished. Offers that don't fit are refused, so remove content that was "+
+		"processed")
+	fs.IntVar(&c.BulkMaxPerPeer, "bulk-max-per-peer", 4, "Maximum number of unfinished bulk transfers from "+
+		"one peer")
+	fs.DurationVar(&c.BulkPartTTL, "bulk-part-ttl", 24*time.Hour, "Unfinished bulk transfers that weren't "+
+		"resumed for this long are deleted")
 
-	flag.BoolVar(&c.RunTests, "test", false, "Run a test script instead of the main program")
+	fs.BoolVar(&c.Compression, "compression", true, "Compress messages to peers that support it. Peers "+
+		"agree on compression when they exchange capabilities after hello")
+	fs.StringVar(&c.MetricsAddress, "metrics-addr", "", "Address (such as localhost:9090) where metrics are "+
+		"served over HTTP at /debug/vars. If no address is specified, metrics are not served")
 
-	flag.StringVar(&c.RedisChannelPyGo, "redis-channel-pygo", "p2p_pygo", "Channel for listening to commands")
-	flag.StringVar(&c.RedisChannelGoPy, "redis-channel-gopy", "p2p_gopy", "Channel for sending data to slips")
+	fs.BoolVar(&c.RenameWithPort, "rename-with-port", false, "Port is appended to filenames, "+
+		"channels and redis keys for convenient running of more peers on one host. Set to false to keep filenames unchanged")
 
-	flag.BoolVar(&c.ShowHelp, "help", false, "Display Help")
+	fs.StringVar(&c.RedisDb, "redis-db", "localhost:6379", "Remote redis database")
+
+	fs.BoolVar(&c.RedisDelete, "redis-delete", false, "Delete database when starting the program")
+
+	fs.StringVar(&c.RedisChannelPyGo, "redis-channel-pygo", "p2p_pygo", "Channel for listening to commands")
+	fs.StringVar(&c.RedisChannelGoPy, "redis-channel-gopy", "p2p_gopy", "Channel for sending data to slips")
+
+	fs.StringVar(&c.SelectionMode, "selection", "weighted", "Default strategy for choosing recipients of "+
+		"broadcasts: all, random or weighted (random sample weighted by peer reliability). Slips can override it "+
+		"for each message")
+	fs.IntVar(&c.Fanout, "fanout", 50, "Default maximum number of peers receiving one message, 0 means no limit")
+	fs.StringVar(&c.ShareInteractions, "share-interactions", "failures", "Which rated interactions with peers "+
+		"are sent to slips, to show why the reliability of a peer changed: none, failures or all")
+	fs.Float64Var(&c.ReportQualityWeight, "report-quality-weight", 0.5, "Weight (0 to 1) of the quality of "+
+		"reports, as rated by slips, in the trust of a peer. The rest of the trust is the reliability of the peer on "+
+		"the network. Trust decides which peers get messages. Peers without rated reports are trusted by reliability")
+
+	fs.DurationVar(&c.PingInterval, "ping-interval", 15*time.Second, "Base interval between pings of one "+
+		"peer. Peers contacted within this interval are not pinged")
+	fs.DurationVar(&c.PingMaxInterval, "ping-max-interval", 40*time.Second, "Responsive peers are pinged "+
+		"less often, up to this interval. With jitter and the ping timeout added, it must stay below "+
+		"-ping-deactivate-after")
+	fs.Float64Var(&c.PingJitter, "ping-jitter", 0.2, "Random change of the ping interval, as a fraction "+
+		"of the interval (at least 0, less than 1)")
+	fs.DurationVar(&c.PingTimeout, "ping-timeout", 10*time.Second, "Time to wait for a ping reply")
+	fs.DurationVar(&c.PingDeactivateAfter, "ping-deactivate-after", 60*time.Second, "Peers without a "+
+		"successful ping for this long are deactivated")
+	fs.DurationVar(&c.PingMinGap, "ping-min-gap", 5*time.Second, "Peers pinging this node more often than "+
+		"this are penalized")
+	fs.IntVar(&c.PingParallelism, "ping-parallelism", 8, "Maximum number of pings sent at the same time")
+
+	fs.BoolVar(&c.ShowHelp, "help", false, "Display Help")
 
-	flag.Parse()
 	return c
 }
@@ -0,0 +1,164 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// encryptedKey is the content of a key file protected by a passphrase
+// The key used for encryption is derived from the passphrase by Argon2id, the parameters are stored with the data so
+// they can be increased later without breaking old files.
+type encryptedKey struct {
+	Kdf        string `json:"kdf"`
+	Salt       []byte `json:"salt"`
+	Time       uint32 `json:"time"`
+	Memory     uint32 `json:"memory"`
+	Threads    uint8  `json:"threads"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// Argon2id parameters for newly encrypted keys (memory is in KiB)
+const (
+	kdfName    = "argon2id"
+	kdfTime    = 3
+	kdfMemory  = 64 * 1024
+	kdfThreads = 4
+	kdfSaltLen = 16
+	kdfKeyLen  = 32
+)
+
+// limits of the Argon2id parameters read from key files, a damaged or crafted file must not exhaust the machine
+const (
+	kdfMaxTime    = 16
+	kdfMaxMemory  = 1024 * 1024
+	kdfMaxThreads = 16
+	kdfMinSaltLen = 8
+)
+
+// Read the passphrase protecting the key file
+// envVar: name of an environment variable holding the passphrase
+// file: file holding the passphrase (a trailing newline is ignored)
+// return []byte: the passphrase, or nil if neither source is set, which means that the key file is not encrypted
+func ReadPassphrase(envVar string, file string) ([]byte, error) {
+	if envVar != "" && file != "" {
+		return nil, errors.New("passphrase can be read either from an environment variable or from a file, not both")
+	}
+
+	var passphrase []byte
+	if envVar != "" {
+		value, ok := os.LookupEnv(envVar)
+		if !ok {
+			return nil, fmt.Errorf("environment variable %s with the key passphrase is not set", envVar)
+		}
+		passphrase = []byte(value)
+	} else if file != "" {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		passphrase = bytes.TrimRight(data, "\r\n")
+	} else {
+		return nil, nil
+	}
+
+	if len(passphrase) == 0 {
+		return nil, errors.New("key passphrase is empty")
+	}
+	return passphrase, nil
+}
+
+// encrypt the marshaled key with a key derived from the passphrase
+func encryptKey(data []byte, passphrase []byte) ([]byte, error) {
+	ek := &encryptedKey{Kdf: kdfName, Time: kdfTime, Memory: kdfMemory, Threads: kdfThreads,
+		Salt: make([]byte, kdfSaltLen)}
+	if _, err := rand.Read(ek.Salt); err != nil {
+		return nil, err
+	}
+
+	aead, err := ek.cipher(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	ek.Nonce = make([]byte, aead.NonceSize())
+	if _, err = rand.Read(ek.Nonce); err != nil {
+		return nil, err
+	}
+	ek.Ciphertext = aead.Seal(nil, ek.Nonce, data, []byte(ek.Kdf))
+
+	return json.Marshal(ek)
+}
+
+// decrypt a key file. Return the data unchanged if the file is not encrypted
+// return encrypted bool: whether the file was encrypted
+func decryptKey(data []byte, passphrase []byte) (plain []byte, encrypted bool, err error) {
+	ek := &encryptedKey{}
+	if json.Unmarshal(data, ek) != nil || ek.Kdf == "" {
+		// marshaled keys are protobuf, which never parses as this JSON
+		return data, false, nil
+	}
+
+	if passphrase == nil {
+		return nil, true, errors.New("key file is encrypted, but no passphrase was given")
+	}
+	if ek.Kdf != kdfName {
+		return nil, true, fmt.Errorf("unsupported key derivation function '%s'", ek.Kdf)
+	}
+
+	aead, err := ek.cipher(passphrase)
+	if err != nil {
+		return nil, true, err
+	}
+	if len(ek.Nonce) != aead.NonceSize() {
+		return nil, true, errors.New("key file is damaged")
+	}
+	plain, err = aead.Open(nil, ek.Nonce, ek.Ciphertext, []byte(ek.Kdf))
+	if err != nil {
+		return nil, true, errors.New("wrong passphrase, or the key file is damaged")
+	}
+	return plain, true, nil
+}
+
+// check that the key derivation parameters are within the limits
+func (ek *encryptedKey) checkParameters() error {
+	if ek.Time < 1 || ek.Time > kdfMaxTime {
+		return fmt.Errorf("key file has an invalid number of passes %d, it must be between 1 and %d", ek.Time,
+			kdfMaxTime)
+	}
+	if ek.Threads < 1 || ek.Threads > kdfMaxThreads {
+		return fmt.Errorf("key file has an invalid number of threads %d, it must be between 1 and %d", ek.Threads,
+			kdfMaxThreads)
+	}
+	// argon2 needs at least 8 KiB of memory per thread
+	if ek.Memory < 8*uint32(ek.Threads) || ek.Memory > kdfMaxMemory {
+		return fmt.Errorf("key file has an invalid memory size %d KiB, it must be between %d and %d KiB", ek.Memory,
+			8*uint32(ek.Threads), kdfMaxMemory)
+	}
+	if len(ek.Salt) < kdfMinSaltLen {
+		return errors.New("key file has a too short salt")
+	}
+	return nil
+}
+
+// derive the encryption key from the passphrase and prepare AES-GCM
+// Parameters outside of the limits are rejected before anything is derived
+func (ek *encryptedKey) cipher(passphrase []byte) (cipher.AEAD, error) {
+	if err := ek.checkParameters(); err != nil {
+		return nil, err
+	}
+	key := argon2.IDKey(passphrase, ek.Salt, ek.Time, ek.Memory, ek.Threads, kdfKeyLen)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
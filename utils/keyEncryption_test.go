@@ -0,0 +1,138 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestKeyEncryptionRoundTrip(t *testing.T) {
+	data := []byte("marshaled key")
+	encrypted, err := encryptKey(data, []byte("passphrase"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(encrypted, data) {
+		t.Error("encrypted file contains the key")
+	}
+
+	plain, wasEncrypted, err := decryptKey(encrypted, []byte("passphrase"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !wasEncrypted || !bytes.Equal(plain, data) {
+		t.Errorf("decrypted %q (encrypted %v), expected %q", plain, wasEncrypted, data)
+	}
+}
+
+// change the encrypted key file before decryption
+func modifyEncryptedKey(t *testing.T, data []byte, modify func(ek *encryptedKey)) []byte {
+	ek := &encryptedKey{}
+	if err := json.Unmarshal(data, ek); err != nil {
+		t.Fatal(err)
+	}
+	modify(ek)
+	data, err := json.Marshal(ek)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// damaged files and wrong passphrases are rejected, and so are parameters out of the limits, before Argon2id runs
+func TestKeyDecryptionFailures(t *testing.T) {
+	tests := []struct {
+		name       string
+		passphrase []byte
+		modify     func(ek *encryptedKey)
+	}{
+		{"no passphrase", nil, nil},
+		{"wrong passphrase", []byte("wrong"), nil},
+		{"ciphertext changed", []byte("passphrase"), func(ek *encryptedKey) { ek.Ciphertext[0] ^= 1 }},
+		{"salt changed", []byte("passphrase"), func(ek *encryptedKey) { ek.Salt[0] ^= 1 }},
+		{"nonce too short", []byte("passphrase"), func(ek *encryptedKey) { ek.Nonce = ek.Nonce[1:] }},
+		{"unknown kdf", []byte("passphrase"), func(ek *encryptedKey) { ek.Kdf = "scrypt" }},
+		{"zero passes", []byte("passphrase"), func(ek *encryptedKey) { ek.Time = 0 }},
+		{"too many passes", []byte("passphrase"), func(ek *encryptedKey) { ek.Time = kdfMaxTime + 1 }},
+		{"zero threads", []byte("passphrase"), func(ek *encryptedKey) { ek.Threads = 0 }},
+		{"too many threads", []byte("passphrase"), func(ek *encryptedKey) { ek.Threads = kdfMaxThreads + 1 }},
+		{"too little memory", []byte("passphrase"), func(ek *encryptedKey) { ek.Memory = 8*uint32(ek.Threads) - 1 }},
+		{"too much memory", []byte("passphrase"), func(ek *encryptedKey) { ek.Memory = 1 << 31 }},
+		{"short salt", []byte("passphrase"), func(ek *encryptedKey) { ek.Salt = ek.Salt[:kdfMinSaltLen-1] }},
+	}
+
+	encrypted, err := encryptKey([]byte("marshaled key"), []byte("passphrase"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data := encrypted
+			if test.modify != nil {
+				data = modifyEncryptedKey(t, encrypted, test.modify)
+			}
+			plain, wasEncrypted, err := decryptKey(data, test.passphrase)
+			if err == nil {
+				t.Errorf("key was decrypted to %q", plain)
+			}
+			if !wasEncrypted {
+				t.Error("encrypted key was not recognized")
+			}
+		})
+	}
+}
+
+// marshaled keys are passed through, so key files from before encryption still work
+func TestKeyDecryptionPlain(t *testing.T) {
+	key, err := SafeKeyGen(keyTypes["ed25519"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(t.TempDir(), "key")
+	if err = SaveKey(file, key, nil); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plain, wasEncrypted, err := decryptKey(data, []byte("passphrase"))
+	if err != nil || wasEncrypted || !bytes.Equal(plain, data) {
+		t.Errorf("plain key file was changed (encrypted %v, error %v)", wasEncrypted, err)
+	}
+}
+
+// a key saved with a passphrase is loaded with it, and only with it
+func TestEncryptedKeyFile(t *testing.T) {
+	key, err := SafeKeyGen(keyTypes["ed25519"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(t.TempDir(), "key")
+	if err = SaveKey(file, key, []byte("passphrase")); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := ReadKey(file, []byte("passphrase"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !loaded.Equals(key) {
+		t.Error("loaded key differs from the saved one")
+	}
+	for _, passphrase := range [][]byte{nil, []byte("wrong")} {
+		if _, err = ReadKey(file, passphrase); err == nil {
+			t.Errorf("key was read with passphrase %q", passphrase)
+		}
+		// the identity must not be replaced when the passphrase is wrong
+		if _, err = LoadKey(file, false, keyTypes["ed25519"], passphrase); err == nil {
+			t.Errorf("key was loaded with passphrase %q", passphrase)
+		}
+	}
+	if loaded, err = ReadKey(file, []byte("passphrase")); err != nil || !loaded.Equals(key) {
+		t.Error("key file was changed by a failed load")
+	}
+}
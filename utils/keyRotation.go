@@ -0,0 +1,155 @@
+package utils
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/crypto"
+	libp2ppeer "github.com/libp2p/go-libp2p-core/peer"
+)
+
+// RotationAnnouncement tells peers that the node replaced its identity key. It is signed by both the old and the
+// new key, so peers can be sure that the owner of the old identity created it, and that the new identity agrees.
+type RotationAnnouncement struct {
+	OldPublicKey []byte `json:"old_public_key"`
+	NewPublicKey []byte `json:"new_public_key"`
+	Timestamp    int64  `json:"timestamp"`
+	OldSignature []byte `json:"old_signature"`
+	NewSignature []byte `json:"new_signature"`
+}
+
+// suffixes of files created next to the key file during rotation
+const (
+	OldKeySuffix       = ".old"
+	AnnouncementSuffix = ".rotation"
+)
+
+// Replace the key in the key file with a new one, and prepare an announcement of the new identity
+// The old key is kept in keyFile.old and the announcement is saved to keyFile.rotation. The node sends the
+// announcement to its peers after startup, so they can carry the reputation of the old identity over to the new one.
+// keyFile: file with the current key, it must exist
+// keyType: type of the new key
+// passphrase: passphrase protecting the key files, nil if they are not encrypted
+func RotateKey(keyFile string, keyType int, passphrase []byte) error {
+	if keyFile == "" {
+		return errors.New("key rotation requires a key file")
+	}
+	// LoadKey would create a new key, and the rotation would announce an identity that no peer has seen
+	if _, err := os.Stat(keyFile); err != nil {
+		return err
+	}
+
+	oldKey, err := LoadKey(keyFile, false, keyType, passphrase)
+	if err != nil {
+		return err
+	}
+
+	newKey, err := SafeKeyGen(keyType)
+	if err != nil {
+		return err
+	}
+
+	announcement, err := NewRotationAnnouncement(oldKey, newKey)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(announcement)
+	if err != nil {
+		return err
+	}
+
+	// save the old key and the announcement first, so a failure never leaves the node without its old identity
+	if err = SaveKey(keyFile+OldKeySuffix, oldKey, passphrase); err != nil {
+		return err
+	}
+	if err = WriteFileAtomic(keyFile+AnnouncementSuffix, data, 0600); err != nil {
+		return err
+	}
+	if err = SaveKey(keyFile, newKey, passphrase); err != nil {
+		return err
+	}
+
+	oldId, _ := libp2ppeer.IDFromPrivateKey(oldKey)
+	newId, _ := libp2ppeer.IDFromPrivateKey(newKey)
+	fmt.Printf("[KEY UTIL] Rotated key from %s to %s\n", oldId.Pretty(), newId.Pretty())
+	return nil
+}
+
+// Load the announcement prepared by RotateKey. Return nil if there is none
+func LoadRotationAnnouncement(keyFile string) *RotationAnnouncement {
+	if keyFile == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(keyFile + AnnouncementSuffix)
+	if err != nil {
+		return nil
+	}
+
+	announcement := &RotationAnnouncement{}
+	if err = json.Unmarshal(data, announcement); err != nil {
+		fmt.Println("[KEY UTIL] Rotation announcement could not be decoded -", err)
+		return nil
+	}
+	return announcement
+}
+
+// NewRotationAnnouncement creates an announcement of the new key, signed by both keys
+func NewRotationAnnouncement(oldKey crypto.PrivKey, newKey crypto.PrivKey) (*RotationAnnouncement, error) {
+	oldPub, err := crypto.MarshalPublicKey(oldKey.GetPublic())
+	if err != nil {
+		return nil, err
+	}
+	newPub, err := crypto.MarshalPublicKey(newKey.GetPublic())
+	if err != nil {
+		return nil, err
+	}
+
+	a := &RotationAnnouncement{OldPublicKey: oldPub, NewPublicKey: newPub, Timestamp: time.Now().Unix()}
+	if a.OldSignature, err = oldKey.Sign(a.signedData()); err != nil {
+		return nil, err
+	}
+	if a.NewSignature, err = newKey.Sign(a.signedData()); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Verify both signatures of the announcement
+// return oldId, newId: the identities before and after the rotation
+// return err: if the announcement is malformed or a signature doesn't match
+func (a *RotationAnnouncement) Verify() (oldId libp2ppeer.ID, newId libp2ppeer.ID, err error) {
+	oldPub, err := crypto.UnmarshalPublicKey(a.OldPublicKey)
+	if err != nil {
+		return "", "", err
+	}
+	newPub, err := crypto.UnmarshalPublicKey(a.NewPublicKey)
+	if err != nil {
+		return "", "", err
+	}
+
+	if ok, err := oldPub.Verify(a.signedData(), a.OldSignature); err != nil || !ok {
+		return "", "", errors.New("invalid signature of the old key")
+	}
+	if ok, err := newPub.Verify(a.signedData(), a.NewSignature); err != nil || !ok {
+		return "", "", errors.New("invalid signature of the new key")
+	}
+
+	if oldId, err = libp2ppeer.IDFromPublicKey(oldPub); err != nil {
+		return "", "", err
+	}
+	if newId, err = libp2ppeer.IDFromPublicKey(newPub); err != nil {
+		return "", "", err
+	}
+	return oldId, newId, nil
+}
+
+// the data covered by both signatures
+func (a *RotationAnnouncement) signedData() []byte {
+	return []byte(fmt.Sprintf("p2p4slips key rotation|%s|%s|%d", base64.StdEncoding.EncodeToString(a.OldPublicKey),
+		base64.StdEncoding.EncodeToString(a.NewPublicKey), a.Timestamp))
+}
@@ -0,0 +1,140 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/libp2p/go-libp2p-core/crypto"
+	libp2ppeer "github.com/libp2p/go-libp2p-core/peer"
+)
+
+// the rotation keeps the old key, replaces the current one and announces the change signed by both
+func TestRotateKey(t *testing.T) {
+	for _, passphrase := range [][]byte{nil, []byte("passphrase")} {
+		file := filepath.Join(t.TempDir(), "key")
+		oldKey, err := LoadKey(file, false, crypto.Ed25519, passphrase)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err = RotateKey(file, crypto.Ed25519, passphrase); err != nil {
+			t.Fatal(err)
+		}
+
+		newKey, err := ReadKey(file, passphrase)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if newKey.Equals(oldKey) {
+			t.Error("key was not replaced")
+		}
+		keptKey, err := ReadKey(file+OldKeySuffix, passphrase)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !keptKey.Equals(oldKey) {
+			t.Error("old key was not kept")
+		}
+
+		announcement := LoadRotationAnnouncement(file)
+		if announcement == nil {
+			t.Fatal("announcement was not saved")
+		}
+		oldId, newId, err := announcement.Verify()
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectedOld, _ := libp2ppeer.IDFromPrivateKey(oldKey)
+		expectedNew, _ := libp2ppeer.IDFromPrivateKey(newKey)
+		if oldId != expectedOld || newId != expectedNew {
+			t.Errorf("announcement from %s to %s, expected %s to %s", oldId, newId, expectedOld, expectedNew)
+		}
+	}
+}
+
+// a rotation that can't load the current key changes nothing
+func TestRotateKeyFailures(t *testing.T) {
+	dir := t.TempDir()
+	encrypted := filepath.Join(dir, "encrypted")
+	key, err := LoadKey(encrypted, false, crypto.Ed25519, []byte("passphrase"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		file       string
+		passphrase []byte
+	}{
+		{"no key file", "", nil},
+		{"missing key file", filepath.Join(dir, "missing"), nil},
+		{"wrong passphrase", encrypted, []byte("wrong")},
+		{"no passphrase", encrypted, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := RotateKey(test.file, crypto.Ed25519, test.passphrase); err == nil {
+				t.Fatal("key was rotated")
+			}
+			for _, suffix := range []string{OldKeySuffix, AnnouncementSuffix} {
+				if _, err := os.Stat(test.file + suffix); !os.IsNotExist(err) {
+					t.Errorf("%s was created", test.file+suffix)
+				}
+			}
+		})
+	}
+
+	if loaded, err := ReadKey(encrypted, []byte("passphrase")); err != nil || !loaded.Equals(key) {
+		t.Error("key file was changed by a failed rotation")
+	}
+	if _, err = os.Stat(filepath.Join(dir, "missing")); !os.IsNotExist(err) {
+		t.Error("missing key file was created")
+	}
+}
+
+// any change to the announcement, or a signature by another key, is detected
+func TestRotationAnnouncementVerify(t *testing.T) {
+	oldKey, _ := SafeKeyGen(crypto.Ed25519)
+	newKey, _ := SafeKeyGen(crypto.Ed25519)
+	otherKey, _ := SafeKeyGen(crypto.Ed25519)
+	otherPublic, _ := crypto.MarshalPublicKey(otherKey.GetPublic())
+
+	tests := []struct {
+		name   string
+		modify func(a *RotationAnnouncement)
+		valid  bool
+	}{
+		{"unchanged", func(a *RotationAnnouncement) {}, true},
+		{"timestamp changed", func(a *RotationAnnouncement) { a.Timestamp++ }, false},
+		{"old key replaced", func(a *RotationAnnouncement) { a.OldPublicKey = otherPublic }, false},
+		{"new key replaced", func(a *RotationAnnouncement) { a.NewPublicKey = otherPublic }, false},
+		{"keys swapped", func(a *RotationAnnouncement) {
+			a.OldPublicKey, a.NewPublicKey = a.NewPublicKey, a.OldPublicKey
+			a.OldSignature, a.NewSignature = a.NewSignature, a.OldSignature
+		}, false},
+		{"old signature missing", func(a *RotationAnnouncement) { a.OldSignature = nil }, false},
+		{"new signature missing", func(a *RotationAnnouncement) { a.NewSignature = nil }, false},
+		// someone holding only the new key claims an identity it doesn't own
+		{"old signature by the new key", func(a *RotationAnnouncement) {
+			a.OldSignature, _ = newKey.Sign(a.signedData())
+		}, false},
+		{"garbage key", func(a *RotationAnnouncement) { a.OldPublicKey = []byte("garbage") }, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			announcement, err := NewRotationAnnouncement(oldKey, newKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			test.modify(announcement)
+
+			_, _, err = announcement.Verify()
+			if valid := err == nil; valid != test.valid {
+				t.Errorf("announcement valid %v, expected %v (%v)", valid, test.valid, err)
+			}
+		})
+	}
+}
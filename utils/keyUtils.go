@@ -2,66 +2,148 @@ package utils
 
 import (
 	"crypto/rand"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"os"
+	"strings"
 
 	"github.com/libp2p/go-libp2p-core/crypto"
 )
 
-func LoadKey(keyFile string, keyReset bool) crypto.PrivKey {
+// key types that can be used for the identity of the node
+var keyTypes = map[string]int{
+	"ed25519":   crypto.Ed25519,
+	"rsa":       crypto.RSA,
+	"ecdsa":     crypto.ECDSA,
+	"secp256k1": crypto.Secp256k1,
+}
+
+// size of generated RSA keys, other key types have a fixed size
+const rsaBits = 2048
+
+// ParseKeyType converts the name of a key type (ed25519, rsa, ecdsa or secp256k1) to its libp2p constant
+func ParseKeyType(name string) (int, error) {
+	keyType, ok := keyTypes[strings.ToLower(name)]
+	if !ok {
+		return 0, fmt.Errorf("unknown key type '%s'", name)
+	}
+	return keyType, nil
+}
+
+// Load the private key from the key file, or generate a new one
+// keyFile: file with the key. If empty, a one time key is generated
+// keyReset: generate a new key and overwrite the key file, even if it contains a valid key
+// keyType: type of newly generated keys, existing keys are loaded regardless of their type
+// passphrase: passphrase protecting the key file, nil if the file is not encrypted
+// return error: if the key file exists, but can't be read, decrypted or decoded, or if other users can access it.
+// Such a file is never overwritten unless keyReset is set, since that would silently change the identity of the node
+func LoadKey(keyFile string, keyReset bool, keyType int, passphrase []byte) (crypto.PrivKey, error) {
 	var prvKey crypto.PrivKey
 	var err error
 
 	if keyReset {
 		// generate new key
 		fmt.Println("[KEY UTIL] Generating a new key")
-		prvKey = SafeKeyGen()
-		SaveKey(keyFile, prvKey)
-		return prvKey
+		prvKey, err = SafeKeyGen(keyType)
+		if err != nil {
+			return nil, err
+		}
+		return prvKey, SaveKey(keyFile, prvKey, passphrase)
 	}
 
 	if keyFile == "" {
 		fmt.Println("[KEY UTIL] Using a one time key")
-		prvKey = SafeKeyGen()
-		return prvKey
+		return SafeKeyGen(keyType)
 	}
 
 	// load from file
+	prvKey, encrypted, err := readKey(keyFile, passphrase)
+	if os.IsNotExist(err) {
+		fmt.Printf("[KEY UTIL] Key file '%s' doesn't exist, generating a new key\n", keyFile)
+		prvKey, err = SafeKeyGen(keyType)
+		if err != nil {
+			return nil, err
+		}
+		return prvKey, SaveKey(keyFile, prvKey, passphrase)
+	}
+	if err != nil {
+		fmt.Println("[KEY UTIL] Refusing to overwrite the key file, use -key-reset to replace it with a new key")
+		return nil, err
+	}
+
+	if !encrypted && passphrase != nil {
+		// the passphrase was given on purpose, so the plain key is replaced by the encrypted one
+		fmt.Println("[KEY UTIL] Key file is not encrypted, encrypting it with the given passphrase")
+		return prvKey, SaveKey(keyFile, prvKey, passphrase)
+	}
+
+	// key was loaded okay, no need to save it
+	return prvKey, nil
+}
+
+// Read the private key from an existing key file. Unlike LoadKey, this never generates, encrypts or saves a key
+// return error: if the key file doesn't exist, can't be read, decrypted or decoded, or if other users can access it
+func ReadKey(keyFile string, passphrase []byte) (crypto.PrivKey, error) {
+	prvKey, _, err := readKey(keyFile, passphrase)
+	return prvKey, err
+}
+
+// read, decrypt and decode the key file
+// return bool: true if the key file is encrypted
+func readKey(keyFile string, passphrase []byte) (crypto.PrivKey, bool, error) {
+	info, err := os.Stat(keyFile)
+	if err == nil && info.Mode().Perm()&0077 != 0 {
+		fmt.Printf("[KEY UTIL] Key file '%s' is accessible by other users (permissions %s), run 'chmod 600 %s'\n",
+			keyFile, info.Mode().Perm(), keyFile)
+		return nil, false, fmt.Errorf("insecure permissions %s of key file '%s'", info.Mode().Perm(), keyFile)
+	}
+
 	data, err := ioutil.ReadFile(keyFile)
+	if os.IsNotExist(err) {
+		return nil, false, err
+	}
 	if err != nil {
 		fmt.Printf("[KEY UTIL] Key could not be read from file '%s' - %s\n", keyFile, err)
-		prvKey = SafeKeyGen()
-		SaveKey(keyFile, prvKey)
-		return prvKey
+		return nil, false, err
 	}
 
-	// unpack data
-	prvKey, err = crypto.UnmarshalPrivateKey(data)
+	// decrypt and unpack data
+	data, encrypted, err := decryptKey(data, passphrase)
 	if err != nil {
-		fmt.Printf("[KEY UTIL] Key could not be decoded - %s\n", err)
-		prvKey = SafeKeyGen()
-		SaveKey(keyFile, prvKey)
-		return prvKey
+		fmt.Printf("[KEY UTIL] Key could not be decrypted - %s\n", err)
+		return nil, false, err
 	}
 
-	// key was loaded okay, no need to save it
-	return prvKey
+	prvKey, err := crypto.UnmarshalPrivateKey(data)
+	if err != nil {
+		fmt.Printf("[KEY UTIL] Key could not be decoded - %s\n", err)
+		return nil, false, err
+	}
+	return prvKey, encrypted, nil
 }
 
-func SafeKeyGen() crypto.PrivKey {
+func SafeKeyGen(keyType int) (crypto.PrivKey, error) {
 	r := rand.Reader
-	prvKey, _, err := crypto.GenerateKeyPairWithReader(crypto.RSA, 2048, r)
+	prvKey, _, err := crypto.GenerateKeyPairWithReader(keyType, rsaBits, r)
 	if err != nil {
 		fmt.Printf("[KEY UTIL] Error generating key - %s\n", err)
-		return nil
+		return nil, err
 	}
-	return prvKey
+	return prvKey, nil
 }
 
-func SaveKey(keyFile string, prvKey crypto.PrivKey) {
+// Save the key to the key file, encrypted if a passphrase is given
+// The file is replaced atomically and only its owner can access it
+func SaveKey(keyFile string, prvKey crypto.PrivKey, passphrase []byte) error {
 	// do not save null key
 	if prvKey == nil {
-		return
+		return errors.New("no key to save")
+	}
+
+	// empty file name means that keys are not saved
+	if keyFile == "" {
+		return nil
 	}
 
 	fmt.Printf("[KEY UTIL] Saving key to file '%s'\n", keyFile)
@@ -70,14 +152,22 @@ func SaveKey(keyFile string, prvKey crypto.PrivKey) {
 	marshaledKey, err := crypto.MarshalPrivateKey(prvKey)
 	if err != nil {
 		fmt.Println("[KEY UTIL] Key saving failed:", err)
-		return
+		return err
+	}
+
+	if passphrase != nil {
+		marshaledKey, err = encryptKey(marshaledKey, passphrase)
+		if err != nil {
+			fmt.Println("[KEY UTIL] Key encryption failed:", err)
+			return err
+		}
 	}
 
 	// save new key to file
-	// TODO: change file permissions
-	err = ioutil.WriteFile(keyFile, marshaledKey, 0777)
+	err = WriteFileAtomic(keyFile, marshaledKey, 0600)
 	if err != nil {
 		fmt.Println("[KEY UTIL] Key saving failed:", err)
-		return
+		return err
 	}
+	return nil
 }